@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+	"go.starlark.net/starlark"
+)
+
+var changedCmd = &cobra.Command{
+	Use:   "changed ROOT",
+	Short: "Get metadata for the files changed between two git revisions",
+	Long: `Get metadata for every file that changed between --base and --head in the git
+repository that ROOT is in, along with every file whose metadata may have changed
+because a METADATA file above it, or a .meta file that one loads, changed.
+
+Without --head, --base is compared to the working tree, and metadata is read from
+it. Otherwise, metadata is read from --head.
+
+Returns {file: {"changed": bool, "deleted": bool, "metadata_changed_by": [...],
+"values": {key: value}}}, with the values of every --key, or of every key if
+none are given.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runChanged,
+}
+
+var (
+	changedBase string
+	changedHead string
+	changedKeys []string
+)
+
+func runChanged(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+
+	encoder, err := outputEncoder(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	paths, err := metadata.GitChangedPaths(repoRoot, changedBase, changedHead)
+	if err != nil {
+		return err
+	}
+
+	opts, err := repoOptions(metadata.WithCache(metadata.NewMemoryCache()))
+	if err != nil {
+		return err
+	}
+	if changedHead != "" {
+		gitFS, err := metadata.NewGitFS(repoRoot, changedHead)
+		if err != nil {
+			return err
+		}
+		defer gitFS.Close()
+		opts = append(opts, metadata.WithFS(gitFS))
+	}
+
+	tree, files, err := metadata.AnalyzeChangesContext(cmd.Context(), repoRoot, paths, opts...)
+	if err != nil {
+		return err
+	}
+
+	result := make(map[string]starlark.Value)
+	for _, file := range files {
+		values, err := tree.GetManyContext(cmd.Context(), file.Path, changedKeys)
+		if err != nil {
+			return err
+		}
+
+		keys := changedKeys
+		if keys == nil {
+			keys = make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+		}
+		fileValues := starlark.NewDict(len(keys))
+		for _, key := range keys {
+			val, ok := values[key]
+			if !ok {
+				val = starlark.None
+			}
+			if err := fileValues.SetKey(starlark.String(key), val); err != nil {
+				return err
+			}
+		}
+
+		changedBy := make([]starlark.Value, 0, len(file.MetadataChangedBy))
+		for _, path := range file.MetadataChangedBy {
+			changedBy = append(changedBy, starlark.String(filepath.ToSlash(path)))
+		}
+
+		info := starlark.NewDict(4)
+		if err := info.SetKey(starlark.String("changed"), starlark.Bool(file.Changed)); err != nil {
+			return err
+		}
+		if err := info.SetKey(starlark.String("deleted"), starlark.Bool(file.Deleted)); err != nil {
+			return err
+		}
+		if err := info.SetKey(starlark.String("metadata_changed_by"), starlark.NewList(changedBy)); err != nil {
+			return err
+		}
+		if err := info.SetKey(starlark.String("values"), fileValues); err != nil {
+			return err
+		}
+		result[filepath.ToSlash(file.Path)] = info
+	}
+
+	return encoder.EncodeFileMap(cmd.OutOrStdout(), result)
+}
+
+func init() {
+	changedCmd.Flags().StringVar(&changedBase, "base", "", "Revision to compare against")
+	changedCmd.Flags().StringVar(&changedHead, "head", "", "Revision to compare, instead of the working tree")
+	changedCmd.Flags().StringArrayVarP(&changedKeys, "key", "k", nil, "Metadata key to get, can be given multiple times")
+	changedCmd.MarkFlagRequired("base")
+	rootCmd.AddCommand(changedCmd)
+}
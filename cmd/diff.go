@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+	"go.starlark.net/starlark"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff ROOT REV1 REV2",
+	Short: "Compare the merged metadata of every file between two git revisions",
+	Long: `Compare the merged metadata of every file between two revisions of the git
+repository that ROOT is in. Both revisions are read from the git object store,
+so nothing is checked out. Each revision is read with its own config file, and
+--format defaults to the format in the config file of REV2.
+
+Returns {file: {key: {"change": "added" | "removed" | "changed", "old": value,
+"new": value}}} for every value that differs, or a Markdown table for posting
+in code review with --markdown.`,
+	Args: cobra.ExactArgs(3),
+	RunE: runDiff,
+}
+
+var (
+	diffKeys     []string
+	diffMarkdown bool
+)
+
+// gitTree builds the tree of a revision, and returns the files in it
+func gitTree(ctx context.Context, repoRoot string, gitFS *metadata.GitFS) (*metadata.MetadataTree, []string, error) {
+	opts, err := repoOptions(metadata.WithFS(gitFS), metadata.WithCache(metadata.NewMemoryCache()))
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := metadata.NewRepo(repoRoot, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := repo.FilesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := metadata.NewEagerTreeContext(ctx, repoRoot, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, files, nil
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+
+	oldFS, err := metadata.NewGitFS(repoRoot, args[1])
+	if err != nil {
+		return err
+	}
+	defer oldFS.Close()
+	newFS, err := metadata.NewGitFS(repoRoot, args[2])
+	if err != nil {
+		return err
+	}
+	defer newFS.Close()
+
+	encoder, err := outputEncoderFor(newFS)
+	if err != nil {
+		return err
+	}
+
+	oldTree, oldFiles, err := gitTree(cmd.Context(), repoRoot, oldFS)
+	if err != nil {
+		return err
+	}
+	newTree, newFiles, err := gitTree(cmd.Context(), repoRoot, newFS)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := metadata.DiffTreesContext(cmd.Context(), oldTree, newTree, oldFiles, newFiles, diffKeys)
+	if err != nil {
+		return err
+	}
+
+	if diffMarkdown {
+		return metadata.WriteDiffMarkdown(cmd.OutOrStdout(), diffs)
+	}
+
+	result := make(map[string]starlark.Value)
+	for _, diff := range diffs {
+		path := filepath.ToSlash(diff.Path)
+		if _, ok := result[path]; !ok {
+			result[path] = starlark.NewDict(1)
+		}
+
+		change := starlark.NewDict(3)
+		if err := change.SetKey(starlark.String("change"), starlark.String(diff.Kind)); err != nil {
+			return err
+		}
+		if diff.Old != nil {
+			if err := change.SetKey(starlark.String("old"), diff.Old); err != nil {
+				return err
+			}
+		}
+		if diff.New != nil {
+			if err := change.SetKey(starlark.String("new"), diff.New); err != nil {
+				return err
+			}
+		}
+		if err := result[path].(*starlark.Dict).SetKey(starlark.String(diff.Key), change); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeFileMap(cmd.OutOrStdout(), result)
+}
+
+func init() {
+	diffCmd.Flags().StringArrayVarP(&diffKeys, "key", "k", nil, "Metadata key to compare, can be given multiple times")
+	diffCmd.Flags().BoolVar(&diffMarkdown, "markdown", false, "Write a Markdown table instead of --format")
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Generate files for other tools from metadata",
+}
+
+var exportCodeownersCmd = &cobra.Command{
+	Use:   "codeowners ROOT",
+	Short: "Generate a CODEOWNERS file from an owners key",
+	Long: `Generate a GitHub or GitLab CODEOWNERS file that gives every file in the repo
+the merged value of an owners key, which must be a string or a list of strings.
+
+The file is written to stdout, or to --output. With --check, nothing is written
+and the command fails if the existing file is not up to date. The existing file
+is --output if given, otherwise the first of .github/CODEOWNERS, CODEOWNERS and
+docs/CODEOWNERS that exists in ROOT.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runExportCodeowners,
+}
+
+var (
+	exportCodeownersKey    string
+	exportCodeownersOutput string
+	exportCodeownersCheck  bool
+)
+
+// Where GitHub looks for a CODEOWNERS file, in order
+var codeownersLocations = []string{
+	filepath.Join(".github", "CODEOWNERS"),
+	"CODEOWNERS",
+	filepath.Join("docs", "CODEOWNERS"),
+}
+
+func runExportCodeowners(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+	opts, err := repoOptions(metadata.WithCache(metadata.NewMemoryCache()))
+	if err != nil {
+		return err
+	}
+	repo, err := metadata.NewRepo(repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+	files, err := repo.FilesContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	tree, err := metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+
+	codeowners, err := metadata.GenerateCodeownersContext(cmd.Context(), tree, files, exportCodeownersKey)
+	if err != nil {
+		return err
+	}
+
+	var generated bytes.Buffer
+	header := fmt.Sprintf("Generated from the '%s' metadata key by `meta export codeowners`.\nDo not edit by hand.", exportCodeownersKey)
+	if err := codeowners.Write(&generated, header); err != nil {
+		return err
+	}
+
+	if exportCodeownersCheck {
+		path := exportCodeownersOutput
+		if path == "" {
+			for _, location := range codeownersLocations {
+				if _, err := os.Stat(filepath.Join(repoRoot, location)); err == nil {
+					path = filepath.Join(repoRoot, location)
+					break
+				}
+			}
+			if path == "" {
+				return fmt.Errorf("Cannot find a CODEOWNERS file in %s", repoRoot)
+			}
+		}
+
+		existing, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(existing, generated.Bytes()) {
+			return fmt.Errorf("%s is out of date, regenerate it with 'meta export codeowners'", path)
+		}
+		return nil
+	}
+
+	if exportCodeownersOutput != "" {
+		return ioutil.WriteFile(exportCodeownersOutput, generated.Bytes(), 0644)
+	}
+	_, err = cmd.OutOrStdout().Write(generated.Bytes())
+	return err
+}
+
+func init() {
+	exportCodeownersCmd.Flags().StringVar(&exportCodeownersKey, "key", "owners", "Metadata key to read owners from")
+	exportCodeownersCmd.Flags().StringVarP(&exportCodeownersOutput, "output", "o", "", "File to write to instead of stdout")
+	exportCodeownersCmd.Flags().BoolVar(&exportCodeownersCheck, "check", false, "Check that the existing CODEOWNERS file is up to date instead of writing it")
+	exportCmd.AddCommand(exportCodeownersCmd)
+	rootCmd.AddCommand(exportCmd)
+}
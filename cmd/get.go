@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/alex-torok/metadata/metadata"
 	"github.com/spf13/cobra"
@@ -18,16 +19,43 @@ var getCmd = &cobra.Command{
 var getMultiCmd = &cobra.Command{
 	Use:   "multi ROOT KEY FILE...",
 	Short: "Get metadata values for multiple files",
-	Args:  cobra.MinimumNArgs(3),
-	RunE:  runGetMulti,
+	Long: `Get metadata values for multiple files.
+
+With --key or --all-keys, KEY is not given, and the values of every requested
+key are returned for each file as {file: {key: value}}.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(getMultiKeys) > 0 || getMultiAllKeys {
+			return cobra.MinimumNArgs(2)(cmd, args)
+		}
+		return cobra.MinimumNArgs(3)(cmd, args)
+	},
+	RunE: runGetMulti,
 }
 
+var (
+	getMultiKeys    []string
+	getMultiAllKeys bool
+)
+
 func runGetMulti(cmd *cobra.Command, args []string) error {
+	if len(getMultiKeys) > 0 || getMultiAllKeys {
+		return runGetMultiKeys(cmd, args)
+	}
+
 	repoRoot, _ := filepath.Abs(args[0])
 	key := args[1]
 	files := args[2:]
 
-	tree, err := metadata.NewEagerTree(repoRoot, "METADATA")
+	encoder, err := outputEncoder(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	opts, err := repoOptions()
+	if err != nil {
+		return err
+	}
+	tree, err := metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
 	if err != nil {
 		fmt.Fprintln(cmd.ErrOrStderr(), err)
 		os.Exit(1)
@@ -35,7 +63,7 @@ func runGetMulti(cmd *cobra.Command, args []string) error {
 
 	allMetadata := make(map[string]starlark.Value)
 	for _, file := range files {
-		val, err := tree.GetMergedValue(file, key)
+		val, err := tree.GetMergedValueContext(cmd.Context(), file, key)
 		if err != nil {
 			switch e := err.(type) {
 			case metadata.NoMetadataFoundError:
@@ -48,12 +76,67 @@ func runGetMulti(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	j, err := metadata.FileMapToJson(allMetadata)
+	return encoder.EncodeFileMap(cmd.OutOrStdout(), allMetadata)
+}
+
+func runGetMultiKeys(cmd *cobra.Command, args []string) error {
+	if len(getMultiKeys) > 0 && getMultiAllKeys {
+		return fmt.Errorf("--key and --all-keys cannot be used together")
+	}
+
+	repoRoot, _ := filepath.Abs(args[0])
+	files := args[1:]
+
+	encoder, err := outputEncoder(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	opts, err := repoOptions()
 	if err != nil {
 		return err
 	}
-	fmt.Fprintln(cmd.OutOrStdout(), j)
-	return nil
+	tree, err := metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+
+	// A nil key list gets every key that applies to each file
+	var keys []string
+	if !getMultiAllKeys {
+		keys = getMultiKeys
+	}
+
+	allMetadata := make(map[string]starlark.Value)
+	for _, file := range files {
+		values, err := tree.GetManyContext(cmd.Context(), file, keys)
+		if err != nil {
+			return err
+		}
+
+		fileKeys := keys
+		if fileKeys == nil {
+			fileKeys = make([]string, 0, len(values))
+			for key := range values {
+				fileKeys = append(fileKeys, key)
+			}
+			sort.Strings(fileKeys)
+		}
+
+		fileValues := starlark.NewDict(len(fileKeys))
+		for _, key := range fileKeys {
+			val, ok := values[key]
+			if !ok {
+				val = starlark.None
+			}
+			if err := fileValues.SetKey(starlark.String(key), val); err != nil {
+				return err
+			}
+		}
+		allMetadata[file] = fileValues
+	}
+
+	return encoder.EncodeFileMap(cmd.OutOrStdout(), allMetadata)
 }
 
 var getOneCmd = &cobra.Command{
@@ -68,27 +151,32 @@ func runGetOne(cmd *cobra.Command, args []string) error {
 	key := args[1]
 	file := args[2]
 
-	tree, err := metadata.NewEagerTree(repoRoot, "METADATA")
+	encoder, err := outputEncoder(repoRoot)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(repoRoot)
-	val, err := tree.GetMergedValue(file, key)
+	opts, err := repoOptions()
+	if err != nil {
+		return err
+	}
+	tree, err := metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
 	if err != nil {
 		return err
 	}
 
-	j, err := metadata.ValueToJson(val)
+	val, err := tree.GetMergedValueContext(cmd.Context(), file, key)
 	if err != nil {
 		return err
 	}
-	fmt.Fprintln(cmd.OutOrStdout(), j)
-	return nil
+
+	return encoder.EncodeValue(cmd.OutOrStdout(), val)
 }
 
 func init() {
 	getCmd.AddCommand(getOneCmd)
+	getMultiCmd.Flags().StringArrayVarP(&getMultiKeys, "key", "k", nil, "Metadata key to get, can be given multiple times")
+	getMultiCmd.Flags().BoolVar(&getMultiAllKeys, "all-keys", false, "Get every metadata key that applies to each file")
 	getCmd.AddCommand(getMultiCmd)
 	rootCmd.AddCommand(getCmd)
 }
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import ROOT",
+	Short: "Generate METADATA files from CODEOWNERS or OWNERS files",
+	Long: `Translate the owners in a GitHub or GitLab CODEOWNERS file, or in Chromium
+OWNERS files, into METADATA files that set an owners key, along with a .meta
+file that defines it.
+
+The CODEOWNERS file is --codeowners if given, otherwise the first of
+.github/CODEOWNERS, CODEOWNERS and docs/CODEOWNERS that exists in ROOT. With
+--chromium, every OWNERS file in ROOT is imported instead.
+
+Constructs that cannot be translated are reported, and the files they apply to
+are given explicit entries. Before anything is written, the imported METADATA
+files are checked to give every file the same owners as the original files.
+Existing METADATA files have the imported owners appended to them.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runImport,
+}
+
+var (
+	importCodeowners string
+	importChromium   bool
+	importKey        string
+	importMeta       string
+	importDryRun     bool
+)
+
+func runImport(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+	repoOpts, err := repoOptions()
+	if err != nil {
+		return err
+	}
+	repo, err := metadata.NewRepo(repoRoot, repoOpts...)
+	if err != nil {
+		return err
+	}
+	opts := metadata.ImportOptions{Key: importKey, MetaPath: importMeta}
+
+	var imp *metadata.OwnersImport
+	if importChromium {
+		imp, err = metadata.ImportChromiumOwners(repo, opts)
+	} else {
+		path := importCodeowners
+		if path == "" {
+			for _, location := range codeownersLocations {
+				if _, err := os.Stat(filepath.Join(repoRoot, location)); err == nil {
+					path = location
+					break
+				}
+			}
+			if path == "" {
+				return fmt.Errorf("Cannot find a CODEOWNERS file in %s", repoRoot)
+			}
+		}
+		imp, err = metadata.ImportCodeowners(repo, path, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	stderr := cmd.ErrOrStderr()
+	for _, problem := range imp.Problems {
+		fmt.Fprintln(stderr, problem)
+	}
+	if len(imp.ExplicitFiles) > 0 {
+		fmt.Fprintf(stderr, "%d files were given explicit entries to keep their owners\n", len(imp.ExplicitFiles))
+	}
+	if len(imp.Mismatches) > 0 {
+		for _, file := range imp.Mismatches {
+			fmt.Fprintf(stderr, "%s: owners differ after importing\n", file)
+		}
+		return fmt.Errorf("Cannot import owners: %d files would get different owners", len(imp.Mismatches))
+	}
+
+	metaPath := filepath.Join(repoRoot, importMeta)
+	if existing, err := ioutil.ReadFile(metaPath); err == nil && string(existing) != imp.Files[importMeta] {
+		return fmt.Errorf("Cannot write %s: the file already exists, choose another one with --meta", metaPath)
+	}
+
+	paths := make([]string, 0, len(imp.Files))
+	for path := range imp.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if importDryRun {
+			fmt.Fprintf(cmd.OutOrStdout(), "# %s\n%s\n", path, imp.Files[path])
+			continue
+		}
+		fullPath := filepath.Join(repoRoot, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(imp.Files[path]), 0644); err != nil {
+			return err
+		}
+	}
+	if !importDryRun {
+		fmt.Fprintf(stderr, "Wrote %d files\n", len(paths))
+	}
+	return nil
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importCodeowners, "codeowners", "", "Repo-relative path of the CODEOWNERS file to import")
+	importCmd.Flags().BoolVar(&importChromium, "chromium", false, "Import Chromium OWNERS files instead of a CODEOWNERS file")
+	importCmd.Flags().StringVar(&importKey, "key", "owners", "Metadata key to put owners in")
+	importCmd.Flags().StringVar(&importMeta, "meta", "owners.meta", "Repo-relative path of the .meta file to write")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Print the files instead of writing them")
+	rootCmd.AddCommand(importCmd)
+}
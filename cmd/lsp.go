@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/alex-torok/metadata/lsp"
+	"github.com/spf13/cobra"
+)
+
+var lspCmd = &cobra.Command{
+	Use:   "lsp [ROOT]",
+	Short: "Run a language server for METADATA and .meta files over stdio",
+	Long: `Run a Language Server Protocol server over stdin and stdout.
+
+The server reports parse and merge errors as diagnostics, shows the meta()
+definition of keys on hover, jumps to definitions across load(), completes keys,
+load() paths and glob() paths, and shows merged values as inlay hints. The repo
+root is taken from the editor, falling back to ROOT or the current directory.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := "."
+		if len(args) > 0 {
+			root = args[0]
+		}
+		opts, err := repoOptions()
+		if err != nil {
+			return err
+		}
+		return lsp.NewServer(os.Stdin, os.Stdout, root, opts...).Run()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lspCmd)
+}
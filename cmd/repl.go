@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+	"go.starlark.net/repl"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+var replCmd = &cobra.Command{
+	Use:   "repl ROOT",
+	Short: "Explore the metadata of a repo in a Starlark REPL",
+	Long: `Build the tree for ROOT and start a Starlark REPL with these functions:
+
+  get(path, key)              the merged value of key for path, or None
+  explain(path, key)          how the merged value of key for path was built up
+  entries(dir)                the entries of the METADATA file in dir, "" for the root
+  files_matching(key, pred)   every file whose merged value of key makes pred(value) true
+  keys()                      every key used in the tree
+
+.meta modules can be loaded with load(), like in METADATA files, and the merge
+functions of the keys they define called on sample values:
+
+  >>> load("//owners.meta", "owners")
+  >>> owners.vertical_merge(["alice"], ["bob"])`,
+	Args: cobra.ExactArgs(1),
+	RunE: runRepl,
+}
+
+func runRepl(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+	opts, err := repoOptions()
+	if err != nil {
+		return err
+	}
+	repo, err := metadata.NewRepo(repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+	files, err := repo.FilesContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	tree, err := metadata.NewLiveTreeContext(cmd.Context(), repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+
+	thread := &starlark.Thread{
+		Name: "repl",
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			path, err := tree.ResolveModule("", module)
+			if err != nil {
+				return nil, err
+			}
+			return tree.ModuleContext(replContext(thread), path)
+		},
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Loaded the metadata of %s, with keys: %v\n", repoRoot, tree.Keys())
+	repl.REPL(thread, replGlobals(tree, files))
+	return nil
+}
+
+// replContext returns the context that the REPL cancels on Control-C
+func replContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local("context").(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// replGlobals returns the functions of the REPL, for the tree of a repo with
+// the given files
+func replGlobals(tree *metadata.LiveTree, files []string) starlark.StringDict {
+	get := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var path, key string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "key", &key); err != nil {
+			return nil, err
+		}
+		value, err := tree.GetContext(replContext(thread), filepath.FromSlash(path), key)
+		if _, ok := err.(metadata.NoMetadataFoundError); ok {
+			return starlark.None, nil
+		}
+		return value, err
+	}
+
+	explain := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var path, key string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "key", &key); err != nil {
+			return nil, err
+		}
+		explanation, err := tree.ExplainContext(replContext(thread), filepath.FromSlash(path), key)
+		if err != nil {
+			return nil, err
+		}
+
+		levels := make([]starlark.Value, 0, len(explanation.Levels))
+		for _, level := range explanation.Levels {
+			levels = append(levels, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"metadata_file": starlark.String(level.MetadataFile),
+				"entries":       entryList(level.Entries),
+				"value":         level.Value,
+				"merged":        level.Merged,
+			}))
+		}
+		return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"file":   starlark.String(explanation.File),
+			"key":    starlark.String(explanation.Key),
+			"levels": starlark.NewList(levels),
+			"value":  noneIfNil(explanation.Value),
+		}), nil
+	}
+
+	entries := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		dir := ""
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "dir?", &dir); err != nil {
+			return nil, err
+		}
+		return entryList(tree.Entries(filepath.FromSlash(dir))), nil
+	}
+
+	filesMatching := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key string
+		var pred starlark.Callable
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "pred", &pred); err != nil {
+			return nil, err
+		}
+		matching := make([]starlark.Value, 0)
+		for _, file := range files {
+			value, err := tree.GetContext(replContext(thread), file, key)
+			if _, ok := err.(metadata.NoMetadataFoundError); ok {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			result, err := starlark.Call(thread, pred, starlark.Tuple{value}, nil)
+			if err != nil {
+				return nil, err
+			}
+			if result.Truth() {
+				matching = append(matching, starlark.String(filepath.ToSlash(file)))
+			}
+		}
+		return starlark.NewList(matching), nil
+	}
+
+	keys := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+			return nil, err
+		}
+		keys := make([]starlark.Value, 0)
+		for _, key := range tree.Keys() {
+			keys = append(keys, starlark.String(key))
+		}
+		return starlark.NewList(keys), nil
+	}
+
+	return starlark.StringDict{
+		"get":            starlark.NewBuiltin("get", get),
+		"explain":        starlark.NewBuiltin("explain", explain),
+		"entries":        starlark.NewBuiltin("entries", entries),
+		"files_matching": starlark.NewBuiltin("files_matching", filesMatching),
+		"keys":           starlark.NewBuiltin("keys", keys),
+		"struct":         starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+}
+
+// entryList converts entries into a list of structs
+func entryList(entries []metadata.Entry) *starlark.List {
+	list := make([]starlark.Value, 0, len(entries))
+	for _, entry := range entries {
+		files := make([]starlark.Value, 0)
+		for _, file := range entry.FileMatchSet().ExactMatches() {
+			files = append(files, starlark.String(file))
+		}
+		globs := make([]starlark.Value, 0)
+		for _, glob := range entry.FileMatchSet().Globs() {
+			globs = append(globs, starlark.String(glob.Pattern()))
+		}
+		list = append(list, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"key":      starlark.String(entry.Key()),
+			"value":    entry.Value(),
+			"position": starlark.String(entry.Position().String()),
+			"files":    starlark.NewList(files),
+			"globs":    starlark.NewList(globs),
+		}))
+	}
+	return starlark.NewList(list)
+}
+
+func noneIfNil(value starlark.Value) starlark.Value {
+	if value == nil {
+		return starlark.None
+	}
+	return value
+}
+
+func init() {
+	rootCmd.AddCommand(replCmd)
+}
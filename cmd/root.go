@@ -1,9 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/alex-torok/metadata/metadata"
 	"github.com/spf13/cobra"
 )
 
@@ -13,9 +21,143 @@ var rootCmd = &cobra.Command{
 	SilenceUsage: true,
 }
 
+var (
+	outputFormat string
+
+	walkIgnore      []string
+	walkNoGitignore bool
+	walkTrackedOnly bool
+	walkSymlinks    string
+	noConfig        bool
+
+	maxSteps uint64
+	timeout  time.Duration
+
+	verbose  bool
+	logLevel string
+)
+
+// logLevels are the values of --log-level, from most to least detailed
+var logLevels = []struct {
+	name  string
+	level slog.Level
+}{
+	{"trace", metadata.LevelTrace},
+	{"debug", slog.LevelDebug},
+	{"info", slog.LevelInfo},
+	{"warn", slog.LevelWarn},
+	{"error", slog.LevelError},
+}
+
+// Execute runs the command given by the arguments. Interrupting it cancels the
+// context of the command, which stops any parsing or merging in progress.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
+
+// outputEncoder returns the encoder for the --format flag, or for the format
+// in the config file of the repo at root if the flag isn't given
+func outputEncoder(root string) (metadata.Encoder, error) {
+	return outputEncoderFor(os.DirFS(root))
+}
+
+// outputEncoderFor is outputEncoder for a repo read from a filesystem, like a
+// revision of it
+func outputEncoderFor(fsys fs.FS) (metadata.Encoder, error) {
+	format := outputFormat
+	if !rootCmd.PersistentFlags().Changed("format") && !noConfig {
+		config, err := metadata.LoadConfig(fsys)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil && config.Format != "" {
+			format = config.Format
+		}
+	}
+	return metadata.EncoderFor(format)
+}
+
+// repoOptions returns the options for how the repo is walked, from the flags
+// shared by every command, followed by extra options
+func repoOptions(extra ...metadata.Option) ([]metadata.Option, error) {
+	symlinks, err := metadata.ParseSymlinkMode(walkSymlinks)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []metadata.Option{
+		metadata.WithIgnore(walkIgnore...),
+		metadata.WithSymlinks(symlinks),
+	}
+	if walkNoGitignore {
+		opts = append(opts, metadata.WithoutGitignore())
+	}
+	if walkTrackedOnly {
+		opts = append(opts, metadata.WithTrackedOnly())
+	}
+	if noConfig {
+		opts = append(opts, metadata.WithoutConfig())
+	}
+	if rootCmd.PersistentFlags().Changed("max-steps") {
+		opts = append(opts, metadata.WithMaxExecutionSteps(maxSteps))
+	}
+	if rootCmd.PersistentFlags().Changed("timeout") {
+		opts = append(opts, metadata.WithTimeout(timeout))
+	}
+
+	logger, err := newLogger()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, metadata.WithLogger(logger))
+	return append(opts, extra...), nil
+}
+
+// newLogger returns a logger that writes to stderr at the level given by
+// --log-level, or --verbose
+func newLogger() (*slog.Logger, error) {
+	name := logLevel
+	if verbose && !rootCmd.PersistentFlags().Changed("log-level") {
+		name = "debug"
+	}
+
+	names := make([]string, 0, len(logLevels))
+	for _, l := range logLevels {
+		names = append(names, l.name)
+		if l.name != strings.ToLower(name) {
+			continue
+		}
+		handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: l.level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// slog would print trace as DEBUG-4
+				if a.Key == slog.LevelKey && a.Value.Any() == metadata.LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+				return a
+			},
+		})
+		return slog.New(handler), nil
+	}
+	return nil, fmt.Errorf("Unknown log level '%s', expected one of: %s", name, strings.Join(names, ", "))
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "format", "json",
+		"Output format, one of: "+strings.Join(metadata.EncoderNames(), ", "))
+	rootCmd.PersistentFlags().StringArrayVar(&walkIgnore, "ignore", nil, "Pattern of paths to skip, in .gitignore syntax, can be given multiple times")
+	rootCmd.PersistentFlags().BoolVar(&walkNoGitignore, "no-gitignore", false, "Don't skip paths ignored by .gitignore files")
+	rootCmd.PersistentFlags().BoolVar(&walkTrackedOnly, "tracked-only", false, "Only read files in the git index")
+	rootCmd.PersistentFlags().BoolVar(&noConfig, "no-config", false, "Ignore the "+metadata.ConfigFilename+" file of the repo")
+	rootCmd.PersistentFlags().Uint64Var(&maxSteps, "max-steps", 0, "Maximum number of Starlark steps for loading a module or calling a merge function, 0 for no limit")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Maximum time for loading a module or calling a merge function, 0 for no limit")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log at debug level, same as --log-level=debug")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "warn", "Level to log to stderr at, one of: trace, debug, info, warn, error")
+	rootCmd.PersistentFlags().StringVar(&walkSymlinks, "symlinks", "skip", "What to do with symlinks, one of: skip, follow, error")
+}
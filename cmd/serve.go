@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"path/filepath"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve ROOT",
+	Short: "Serve metadata queries over HTTP and JSON-RPC",
+	Long: `Build the metadata tree once and answer queries against it until interrupted.
+
+HTTP requests are served as JSON at /get, /multi, /explain, /list-matching and
+/dump. JSON-RPC requests on the unix socket call the methods Metadata.Get,
+Metadata.Multi, Metadata.Explain, Metadata.ListMatching and Metadata.Dump.
+
+Without --http or --socket, HTTP is served on localhost:7070. With only
+--socket, nothing is served over HTTP.
+
+With --watch, METADATA and .meta files are watched for changes and only the
+parts of the tree that they affect are reloaded.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runServe,
+}
+
+// Address that HTTP is served on when neither --http nor --socket is given
+const defaultServeHTTPAddr = "localhost:7070"
+
+var (
+	serveHTTPAddr   string
+	serveSocketPath string
+	serveWatch      bool
+)
+
+func runServe(cmd *cobra.Command, args []string) error {
+	httpAddr := serveHTTPAddr
+	if !cmd.Flags().Changed("http") && serveSocketPath == "" {
+		httpAddr = defaultServeHTTPAddr
+	}
+	if httpAddr == "" && serveSocketPath == "" {
+		return fmt.Errorf("At least one of --http or --socket is required")
+	}
+
+	repoRoot, _ := filepath.Abs(args[0])
+	opts, err := repoOptions(metadata.WithCache(metadata.NewMemoryCache()))
+	if err != nil {
+		return err
+	}
+	repo, err := metadata.NewRepo(repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+	files, err := repo.FilesContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	var tree metadata.Tree
+	if serveWatch {
+		liveTree, err := metadata.NewLiveTreeContext(cmd.Context(), repoRoot, opts...)
+		if err != nil {
+			return err
+		}
+		watcher, err := metadata.Watch(liveTree)
+		if err != nil {
+			return err
+		}
+		defer watcher.Close()
+
+		// Reload errors leave the tree as it was, so keep serving
+		go func() {
+			for err := range watcher.Errors() {
+				fmt.Fprintf(cmd.ErrOrStderr(), "Cannot reload metadata: %v\n", err)
+			}
+		}()
+		tree = liveTree
+	} else {
+		tree, err = metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	service := metadata.NewService(tree, files)
+
+	errs := make(chan error, 2)
+
+	if httpAddr != "" {
+		server := &http.Server{
+			Addr:    httpAddr,
+			Handler: metadata.NewHTTPHandler(service),
+		}
+		defer server.Shutdown(context.Background())
+
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+		fmt.Fprintf(cmd.ErrOrStderr(), "Serving HTTP on %s\n", httpAddr)
+	}
+
+	if serveSocketPath != "" {
+		rpcServer := rpc.NewServer()
+		if err := rpcServer.RegisterName("Metadata", service); err != nil {
+			return err
+		}
+
+		listener, err := net.Listen("unix", serveSocketPath)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+			}
+		}()
+		fmt.Fprintf(cmd.ErrOrStderr(), "Serving JSON-RPC on %s\n", serveSocketPath)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-cmd.Context().Done():
+		return nil
+	}
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveHTTPAddr, "http", "", "Address to serve HTTP on (default "+defaultServeHTTPAddr+" without --socket)")
+	serveCmd.Flags().StringVar(&serveSocketPath, "socket", "", "Path of a unix socket to serve JSON-RPC on")
+	serveCmd.Flags().BoolVar(&serveWatch, "watch", false, "Reload METADATA and .meta files when they change")
+	rootCmd.AddCommand(serveCmd)
+}
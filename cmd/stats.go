@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats ROOT",
+	Short: "Report how big and how expensive the metadata of a repo is",
+	Long: `Build the tree for ROOT, get the merged value of every key for every file, and
+report:
+
+  - how many METADATA and .meta files, entries and globs there are
+  - how many entries there are for each key
+  - the METADATA files and modules that took the longest to parse
+  - how many calls, Starlark steps and how much time each merge function took
+  - how many loads were served from the module cache, and how many merged
+    values from the value cache
+  - how much memory the tree uses
+
+With --cpuprofile and --memprofile, pprof profiles of the whole run are written
+too.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runStats,
+}
+
+var (
+	statsTop        int
+	statsCPUProfile string
+	statsMemProfile string
+)
+
+func runStats(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+
+	if statsCPUProfile != "" {
+		f, err := os.Create(statsCPUProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	stats := metadata.NewStats()
+	opts, err := repoOptions(metadata.WithStats(stats), metadata.WithCache(metadata.NewMemoryCache()))
+	if err != nil {
+		return err
+	}
+	repo, err := metadata.NewRepo(repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+	files, err := repo.FilesContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	heapBefore := heapInUse()
+	start := time.Now()
+	tree, err := metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
+	if err != nil {
+		return err
+	}
+	buildTime := time.Since(start)
+	treeMemory := heapInUse() - heapBefore
+
+	start = time.Now()
+	keys := tree.Keys()
+	for _, file := range files {
+		if _, err := tree.GetManyContext(cmd.Context(), file, keys); err != nil {
+			return err
+		}
+	}
+	mergeTime := time.Since(start)
+
+	if statsMemProfile != "" {
+		f, err := os.Create(statsMemProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			return err
+		}
+	}
+
+	metaFiles, entries, globs := 0, 0, 0
+	for _, file := range files {
+		if strings.HasSuffix(file, ".meta") {
+			metaFiles++
+		}
+	}
+	entriesPerKey := make(map[string]int)
+	err = tree.Walk(func(dirPath string, dirEntries []metadata.Entry) error {
+		for _, entry := range dirEntries {
+			entries++
+			entriesPerKey[entry.Key()]++
+			globs += len(entry.FileMatchSet().Globs())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	runtime.KeepAlive(tree)
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "METADATA files:\t%d\n", len(stats.ParseTimes))
+	fmt.Fprintf(w, ".meta files:\t%d\n", metaFiles)
+	fmt.Fprintf(w, "Files:\t%d\n", len(files))
+	fmt.Fprintf(w, "Entries:\t%d\n", entries)
+	fmt.Fprintf(w, "Globs:\t%d\n", globs)
+	fmt.Fprintf(w, "Build time:\t%v\n", buildTime)
+	fmt.Fprintf(w, "Merge time:\t%v\n", mergeTime)
+	fmt.Fprintf(w, "Tree memory:\t%s\n", formatBytes(treeMemory))
+	fmt.Fprintf(w, "Module cache:\t%s\n", hitRate(stats.ModuleCacheHits, stats.ModuleLoads))
+	fmt.Fprintf(w, "Value cache:\t%s\n", hitRate(stats.ValueCacheHits, stats.ValueLookups))
+	if stats.ProgramLookups > 0 {
+		fmt.Fprintf(w, "Program cache:\t%s\n", hitRate(stats.ProgramCacheHits, stats.ProgramLookups))
+	}
+
+	fmt.Fprintln(w, "\nEntries per key:")
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\t%d\n", key, entriesPerKey[key])
+	}
+
+	fmt.Fprintf(w, "\nSlowest METADATA files:\n")
+	writeDurations(w, stats.ParseTimes, statsTop)
+
+	modules := make(map[string]time.Duration)
+	for path, d := range stats.ModuleTimes {
+		if !repo.IsMetadataFile(filepath.Base(path)) {
+			modules[path] = d
+		}
+	}
+	fmt.Fprintf(w, "\nSlowest modules:\n")
+	writeDurations(w, modules, statsTop)
+
+	functions := make([]string, 0, len(stats.MergeFunctions))
+	for name := range stats.MergeFunctions {
+		functions = append(functions, name)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		a, b := stats.MergeFunctions[functions[i]], stats.MergeFunctions[functions[j]]
+		if a.Steps != b.Steps {
+			return a.Steps > b.Steps
+		}
+		return functions[i] < functions[j]
+	})
+	fmt.Fprintf(w, "\nMerge functions:\n")
+	fmt.Fprintf(w, "  function\tcalls\tsteps\ttime\n")
+	for _, name := range functions {
+		m := stats.MergeFunctions[name]
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%v\n", name, m.Calls, m.Steps, m.Duration)
+	}
+	return w.Flush()
+}
+
+// writeDurations writes the n longest durations, longest first
+func writeDurations(w io.Writer, durations map[string]time.Duration, n int) {
+	names := make([]string, 0, len(durations))
+	for name := range durations {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if durations[names[i]] != durations[names[j]] {
+			return durations[names[i]] > durations[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if n > 0 && len(names) > n {
+		names = names[:n]
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%v\n", name, durations[name])
+	}
+}
+
+// heapInUse returns the bytes used by live objects, after collecting garbage
+func heapInUse() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
+
+func formatBytes(n int64) string {
+	if n < 0 {
+		n = 0
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func hitRate(hits, total int) string {
+	if total == 0 {
+		return "no lookups"
+	}
+	return fmt.Sprintf("%d of %d hits (%.0f%%)", hits, total, 100*float64(hits)/float64(total))
+}
+
+func init() {
+	statsCmd.Flags().IntVar(&statsTop, "top", 10, "How many of the slowest files and modules to list, 0 for all")
+	statsCmd.Flags().StringVar(&statsCPUProfile, "cpuprofile", "", "Write a pprof CPU profile to this file")
+	statsCmd.Flags().StringVar(&statsMemProfile, "memprofile", "", "Write a pprof heap profile to this file")
+	rootCmd.AddCommand(statsCmd)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/alex-torok/metadata/metadata"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate ROOT",
+	Short: "Check that every METADATA file in a repo parses",
+	Long: `Parse every METADATA file under ROOT, without stopping at the first one that
+fails, and print every error with where it happened. Files under a METADATA
+file that fails to parse are reported as tainted, since their metadata would be
+missing whatever it sets.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runValidate,
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	repoRoot, _ := filepath.Abs(args[0])
+	opts, err := repoOptions(metadata.WithKeepGoing())
+	if err != nil {
+		return err
+	}
+
+	_, err = metadata.NewEagerTreeContext(cmd.Context(), repoRoot, opts...)
+	errs, ok := err.(metadata.ParseErrors)
+	if !ok {
+		return err
+	}
+
+	stderr := cmd.ErrOrStderr()
+	for _, e := range errs {
+		fmt.Fprintln(stderr, e)
+		if dir := filepath.Dir(e.File); dir != "." {
+			fmt.Fprintf(stderr, "    files under %s are tainted\n", dir)
+		} else {
+			fmt.Fprintln(stderr, "    every file is tainted")
+		}
+	}
+	return fmt.Errorf("Cannot validate %s: %d METADATA files failed to parse", repoRoot, len(errs))
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,431 @@
+package lsp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/alex-torok/metadata/metadata"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// How many loads to follow when looking for where a name is defined
+const maxLoadDepth = 16
+
+// Longest merged value shown in an inlay hint
+const maxHintLength = 60
+
+var builtinDocs = map[string]string{
+	"meta":     "meta(key, vertical_merge=None, horizontal_merge=None)\n\nDefines a function that adds entries for a metadata key.",
+	"metadata": "metadata(key, value, files=None)\n\nAdds an entry for a metadata key that has no merge functions.",
+	"glob":     "glob(pattern)\n\nMatches files relative to the METADATA file, for use in files=[...].",
+}
+
+func (s *Server) hover(params textDocumentPositionParams) (interface{}, error) {
+	path, ok := s.relativePath(params.TextDocument.URI)
+	if !ok {
+		return nil, nil
+	}
+	text := s.text(path)
+	f, err := syntax.Parse(path, text, 0)
+	if err != nil {
+		return nil, nil
+	}
+
+	line, col := fromLSP(text, params.Position)
+	id := identAt(f, line, col)
+	if id == nil {
+		return nil, nil
+	}
+	start, end := id.Span()
+	r := &Range{Start: toLSP(text, start), End: toLSP(text, end)}
+
+	if doc, ok := builtinDocs[id.Name]; ok {
+		if _, bound := topLevelBinding(f, id.Name); !bound {
+			return Hover{Contents: markdown("```python\n" + doc + "\n```"), Range: r}, nil
+		}
+	}
+
+	value := s.valueOf(path, f, id)
+	if value == nil {
+		return nil, nil
+	}
+
+	m, ok := value.(*metadata.StarlarkMeta)
+	if !ok {
+		return Hover{
+			Contents: markdown(fmt.Sprintf("```python\n%s: %s\n```", id.Name, value.Type())),
+			Range:    r,
+		}, nil
+	}
+
+	var b strings.Builder
+	pos := m.Position()
+	if source := s.statementSource(pos); source != "" {
+		fmt.Fprintf(&b, "```python\n%s\n```\n\n", source)
+	}
+	fmt.Fprintf(&b, "Sets metadata key `%s`\n\n", m.Key())
+	fmt.Fprintf(&b, "- Vertical merge: %s\n", mergeDescription(m.VerticalMerge()))
+	fmt.Fprintf(&b, "- Horizontal merge: %s\n", mergeDescription(m.HorizontalMerge()))
+	if pos.IsValid() {
+		fmt.Fprintf(&b, "\nDefined in `%s:%d`", pos.Filename(), pos.Line)
+	}
+	return Hover{Contents: markdown(b.String()), Range: r}, nil
+}
+
+func markdown(value string) MarkupContent {
+	return MarkupContent{Kind: "markdown", Value: value}
+}
+
+func mergeDescription(fn starlark.Callable) string {
+	if fn == nil {
+		return "none, values cannot be merged"
+	}
+	return "`" + fn.Name() + "`"
+}
+
+// statementSource returns the source of the top-level statement at a position
+func (s *Server) statementSource(pos syntax.Position) string {
+	if !pos.IsValid() {
+		return ""
+	}
+	f, err := s.parse(pos.Filename())
+	if err != nil {
+		return ""
+	}
+	stmt := stmtAt(f, pos.Line)
+	if stmt == nil {
+		return ""
+	}
+
+	start, end := stmt.Span()
+	text := s.text(pos.Filename())
+	lines := make([]string, 0)
+	for line := int(start.Line) - 1; line <= int(end.Line)-1; line++ {
+		lines = append(lines, lineText(text, line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// valueOf returns the value of a top-level name in a file, or nil if it
+// doesn't have one
+func (s *Server) valueOf(path string, f *syntax.File, id *syntax.Ident) starlark.Value {
+	if s.tree == nil {
+		return nil
+	}
+
+	module, name := path, id.Name
+	if load, i := loadOf(f, id); load != nil {
+		module, name = s.modulePath(path, moduleLabel(load)), load.To[i].Name
+	} else if b, ok := topLevelBinding(f, id.Name); !ok {
+		return nil
+	} else if b.module != "" {
+		module, name = s.modulePath(path, b.module), b.name
+	}
+
+	globals, err := s.tree.Module(module)
+	if err != nil {
+		return nil
+	}
+	return globals[name]
+}
+
+// loadOf returns the load statement that an identifier is part of, and the
+// index of the binding that it is part of
+func loadOf(f *syntax.File, id *syntax.Ident) (*syntax.LoadStmt, int) {
+	for _, stmt := range f.Stmts {
+		if load, ok := stmt.(*syntax.LoadStmt); ok {
+			for i := range load.From {
+				if load.From[i] == id || load.To[i] == id {
+					return load, i
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+func (s *Server) definition(params textDocumentPositionParams) (interface{}, error) {
+	path, ok := s.relativePath(params.TextDocument.URI)
+	if !ok {
+		return nil, nil
+	}
+	text := s.text(path)
+	f, err := syntax.Parse(path, text, 0)
+	if err != nil {
+		return nil, nil
+	}
+
+	line, col := fromLSP(text, params.Position)
+	if load := loadModuleAt(f, line, col); load != nil {
+		return Location{URI: s.pathToURI(s.modulePath(path, moduleLabel(load)))}, nil
+	}
+
+	id := identAt(f, line, col)
+	if id == nil {
+		return nil, nil
+	}
+
+	var b binding
+	if load, i := loadOf(f, id); load != nil {
+		b = binding{module: moduleLabel(load), name: load.To[i].Name}
+	} else if b, ok = topLevelBinding(f, id.Name); !ok {
+		return nil, nil
+	} else if b.module == "" {
+		return s.location(path, b.ident), nil
+	}
+
+	module := s.modulePath(path, b.module)
+	defPath, defIdent, ok := s.findDefinition(module, b.name, 0)
+	if !ok {
+		return Location{URI: s.pathToURI(module)}, nil
+	}
+	return s.location(defPath, defIdent), nil
+}
+
+// findDefinition follows loads to find where a name in a module is defined
+func (s *Server) findDefinition(module, name string, depth int) (string, *syntax.Ident, bool) {
+	if depth > maxLoadDepth {
+		return "", nil, false
+	}
+	f, err := s.parse(module)
+	if err != nil {
+		return "", nil, false
+	}
+	b, ok := topLevelBinding(f, name)
+	if !ok {
+		return "", nil, false
+	}
+	if b.module != "" {
+		return s.findDefinition(s.modulePath(module, b.module), b.name, depth+1)
+	}
+	return module, b.ident, true
+}
+
+func (s *Server) location(path string, id *syntax.Ident) Location {
+	text := s.text(path)
+	start, end := id.Span()
+	return Location{
+		URI:   s.pathToURI(path),
+		Range: Range{Start: toLSP(text, start), End: toLSP(text, end)},
+	}
+}
+
+func (s *Server) completion(params textDocumentPositionParams) (interface{}, error) {
+	path, ok := s.relativePath(params.TextDocument.URI)
+	if !ok {
+		return nil, nil
+	}
+	text := s.text(path)
+	ctx := scanContext(text, offsetOf(text, params.Position))
+
+	if !ctx.inString {
+		return s.identifierCompletions(path, text, params.Position), nil
+	}
+
+	// Replace everything typed in the string so far
+	prefixLength := len(utf16.Encode([]rune(ctx.prefix)))
+	replace := Range{
+		Start: Position{Line: params.Position.Line, Character: params.Position.Character - prefixLength},
+		End:   params.Position,
+	}
+	if replace.Start.Character < 0 {
+		replace.Start.Character = 0
+	}
+
+	var items []CompletionItem
+	switch {
+	case ctx.call == "load" && ctx.arg == 0:
+		items = s.moduleCompletions()
+	case ctx.keyword == "key" || ctx.call == "metadata" && ctx.arg == 0 && ctx.keyword == "":
+		items = s.keyCompletions()
+	case ctx.call == "glob" || ctx.keyword == "files":
+		items = s.pathCompletions(filepath.Dir(path), ctx.prefix)
+	}
+
+	for i := range items {
+		items[i].TextEdit = &TextEdit{Range: replace, NewText: items[i].Label}
+	}
+	if items == nil {
+		items = make([]CompletionItem, 0)
+	}
+	return items, nil
+}
+
+// metaFiles returns the repo-relative path of every .meta file in the repo
+func (s *Server) metaFiles() []string {
+	paths := make([]string, 0)
+	_ = filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".meta") {
+			if rel, err := filepath.Rel(s.root, path); err == nil {
+				paths = append(paths, rel)
+			}
+		}
+		return nil
+	})
+	return paths
+}
+
+func (s *Server) moduleCompletions() []CompletionItem {
+	items := make([]CompletionItem, 0)
+	for _, path := range s.metaFiles() {
+		items = append(items, CompletionItem{
+			Label: "//" + filepath.ToSlash(path),
+			Kind:  completionKindFile,
+		})
+	}
+	return items
+}
+
+// keyCompletions returns every key that has entries in the tree or is defined
+// by meta() in a .meta file
+func (s *Server) keyCompletions() []CompletionItem {
+	if s.tree == nil {
+		return nil
+	}
+
+	keys := make(metadata.StringSet)
+	for _, key := range s.tree.Keys() {
+		keys.Add(key)
+	}
+	for _, path := range s.metaFiles() {
+		globals, err := s.tree.Module(path)
+		if err != nil {
+			continue
+		}
+		for _, value := range globals {
+			if m, ok := value.(*metadata.StarlarkMeta); ok {
+				keys.Add(m.Key())
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	items := make([]CompletionItem, 0, len(sorted))
+	for _, key := range sorted {
+		items = append(items, CompletionItem{Label: key, Kind: completionKindConstant, Detail: "metadata key"})
+	}
+	return items
+}
+
+// pathCompletions returns the files and directories that could complete a path
+// relative to a directory
+func (s *Server) pathCompletions(dir, prefix string) []CompletionItem {
+	typedDir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		typedDir = prefix[:i+1]
+	}
+
+	infos, err := os.ReadDir(filepath.Join(s.root, dir, filepath.FromSlash(typedDir)))
+	if err != nil {
+		return nil
+	}
+
+	items := make([]CompletionItem, 0, len(infos))
+	for _, info := range infos {
+		if info.Name() == ".git" {
+			continue
+		}
+		if info.IsDir() {
+			items = append(items, CompletionItem{Label: typedDir + info.Name() + "/", Kind: completionKindFolder})
+		} else {
+			items = append(items, CompletionItem{Label: typedDir + info.Name(), Kind: completionKindFile})
+		}
+	}
+	return items
+}
+
+// identifierCompletions returns the builtins and the top-level names of a file
+func (s *Server) identifierCompletions(path, text string, pos Position) []CompletionItem {
+	items := make([]CompletionItem, 0)
+	for _, name := range []string{"glob", "meta", "metadata"} {
+		items = append(items, CompletionItem{Label: name, Kind: completionKindFunction, Detail: "builtin"})
+	}
+
+	// The line being typed probably doesn't parse yet
+	f, err := syntax.Parse(path, text, 0)
+	if err != nil {
+		lines := strings.Split(text, "\n")
+		if pos.Line < len(lines) {
+			lines[pos.Line] = ""
+		}
+		if f, err = syntax.Parse(path, strings.Join(lines, "\n"), 0); err != nil {
+			return items
+		}
+	}
+
+	for _, b := range loadedNames(f) {
+		item := CompletionItem{Label: b.ident.Name, Kind: completionKindFunction}
+		if s.tree != nil {
+			if globals, err := s.tree.Module(s.modulePath(path, b.module)); err == nil {
+				if m, ok := globals[b.name].(*metadata.StarlarkMeta); ok {
+					item.Detail = "metadata key " + m.Key()
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (s *Server) inlayHints(params inlayHintParams) (interface{}, error) {
+	hints := make([]InlayHint, 0)
+	path, ok := s.relativePath(params.TextDocument.URI)
+	if !ok || s.tree == nil {
+		return hints, nil
+	}
+	text := s.text(path)
+	f, _ := syntax.Parse(path, text, 0)
+
+	for _, entry := range s.documentEntries(path) {
+		file, value, err := s.mergedValue(entry)
+		if err != nil || value == nil {
+			continue
+		}
+
+		// Show the hint at the end of the statement that added the entry
+		line := int(entry.Position().Line)
+		if f != nil {
+			if stmt := stmtAt(f, entry.Position().Line); stmt != nil {
+				_, end := stmt.Span()
+				line = int(end.Line)
+			}
+		}
+		line--
+		if line < params.Range.Start.Line || line > params.Range.End.Line {
+			continue
+		}
+
+		j, err := metadata.ValueToJson(value)
+		if err != nil {
+			j = value.String()
+		}
+		if runes := []rune(j); len(runes) > maxHintLength {
+			j = string(runes[:maxHintLength-3]) + "..."
+		}
+
+		name, _ := filepath.Rel(filepath.Dir(entry.File()), file)
+		hints = append(hints, InlayHint{
+			Position:    endOfLine(text, line),
+			Label:       fmt.Sprintf("%s for %s: %s", entry.Key(), name, j),
+			PaddingLeft: true,
+		})
+	}
+	return hints, nil
+}
@@ -0,0 +1,516 @@
+// Package lsp implements a Language Server Protocol server for METADATA and
+// .meta files
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alex-torok/metadata/metadata"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const diagnosticSource = "meta"
+
+// Server answers LSP requests for the METADATA and .meta files in a repo. The
+// tree is kept up to date with the unsaved contents of every open document.
+type Server struct {
+	conn *conn
+	root string
+	opts []metadata.Option
+
+	// nil until the repo has been parsed successfully once
+	tree *metadata.LiveTree
+	// the error from the last time the tree was built or reloaded
+	treeErr error
+
+	// open documents, keyed by repo-relative path
+	docs map[string]string
+	// documents that diagnostics were last published for
+	published map[string]bool
+
+	shutdown bool
+}
+
+// NewServer creates a server that reads requests from r and writes responses to
+// w. The root of the repo is taken from the client when it initializes, with
+// root as a fallback.
+func NewServer(r io.Reader, w io.Writer, root string, opts ...metadata.Option) *Server {
+	return &Server{
+		conn:      newConn(r, w),
+		root:      root,
+		opts:      opts,
+		docs:      make(map[string]string),
+		published: make(map[string]bool),
+	}
+}
+
+// Run serves requests until the client exits or the input is closed
+func (s *Server) Run() error {
+	for {
+		body, err := s.conn.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.replyError(nil, parseError, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// Notifications don't get a reply
+			continue
+		}
+
+		if err != nil {
+			code := internalError
+			var rpcErr *rpcError
+			if errors.As(err, &rpcErr) {
+				code = rpcErr.code
+			}
+			err = s.replyError(msg.ID, code, err)
+		} else {
+			err = s.conn.write(response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type rpcError struct {
+	code int
+	err  error
+}
+
+func (e *rpcError) Error() string {
+	return e.err.Error()
+}
+
+func (s *Server) replyError(id *json.RawMessage, code int, err error) error {
+	return s.conn.write(errorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   responseError{Code: code, Message: err.Error()},
+	})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return s.conn.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) handle(msg message) (interface{}, error) {
+	if s.shutdown && msg.Method != "exit" {
+		return nil, &rpcError{invalidRequest, errors.New("Server is shut down")}
+	}
+
+	switch msg.Method {
+	case "initialize":
+		var params initializeParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.initialize(params)
+
+	case "initialized":
+		return nil, nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.didChange(params.TextDocument.URI, &params.TextDocument.Text)
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		text := params.ContentChanges[len(params.ContentChanges)-1].Text
+		return nil, s.didChange(params.TextDocument.URI, &text)
+
+	case "textDocument/didSave":
+		var params didCloseParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		path, ok := s.relativePath(params.TextDocument.URI)
+		if !ok {
+			return nil, nil
+		}
+		return nil, s.reload([]string{path})
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.didChange(params.TextDocument.URI, nil)
+
+	case "workspace/didChangeWatchedFiles":
+		var params didChangeWatchedFilesParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		paths := make([]string, 0, len(params.Changes))
+		for _, change := range params.Changes {
+			if path, ok := s.relativePath(change.URI); ok {
+				paths = append(paths, path)
+			}
+		}
+		return nil, s.reload(paths)
+
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params)
+
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params)
+
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params)
+
+	case "textDocument/inlayHint":
+		var params inlayHintParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.inlayHints(params)
+	}
+
+	return nil, &rpcError{methodNotFound, fmt.Errorf("Method %s is not supported", msg.Method)}
+}
+
+func unmarshalParams(msg message, params interface{}) error {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &rpcError{invalidParams, err}
+	}
+	return nil
+}
+
+func (s *Server) initialize(params initializeParams) (interface{}, error) {
+	if path, ok := uriToPath(params.RootURI); ok {
+		s.root = path
+	} else if params.RootPath != "" {
+		s.root = params.RootPath
+	}
+
+	root, err := filepath.Abs(s.root)
+	if err != nil {
+		return nil, err
+	}
+	s.root = root
+	s.buildTree()
+
+	return initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:   textDocumentSyncFull,
+			HoverProvider:      true,
+			DefinitionProvider: true,
+			CompletionProvider: completionOptions{
+				TriggerCharacters: []string{"\"", "'", "/"},
+			},
+			InlayHintProvider: true,
+		},
+		ServerInfo: serverInfo{Name: "meta"},
+	}, nil
+}
+
+// buildTree parses the whole repo, using the contents of the open documents
+func (s *Server) buildTree() {
+	opts := append([]metadata.Option{}, s.opts...)
+	opts = append(opts, metadata.WithOverlay(s.docs))
+	s.tree, s.treeErr = metadata.NewLiveTree(s.root, opts...)
+}
+
+// didChange updates the contents of an open document, or closes it if text is
+// nil, and reloads the tree
+func (s *Server) didChange(uri string, text *string) error {
+	path, ok := s.relativePath(uri)
+	if !ok {
+		return nil
+	}
+
+	if text != nil {
+		s.docs[path] = *text
+		if s.tree != nil {
+			s.tree.SetOverlay(path, *text)
+		}
+	} else {
+		delete(s.docs, path)
+		if s.tree != nil {
+			s.tree.RemoveOverlay(path)
+		}
+	}
+	return s.reload([]string{path})
+}
+
+func (s *Server) reload(paths []string) error {
+	if s.tree == nil {
+		s.buildTree()
+	} else {
+		relevant := make([]string, 0, len(paths))
+		for _, path := range paths {
+			if s.tree.IsRelevant(path) {
+				relevant = append(relevant, path)
+			}
+		}
+		if len(relevant) > 0 {
+			s.treeErr = s.tree.Reload(relevant)
+		}
+	}
+	return s.publishDiagnostics()
+}
+
+// publishDiagnostics sends the diagnostics of every open document, and clears
+// the diagnostics of documents that don't have any anymore
+func (s *Server) publishDiagnostics() error {
+	diagnostics := s.diagnostics()
+
+	paths := make([]string, 0)
+	for path := range diagnostics {
+		paths = append(paths, path)
+	}
+	for path := range s.published {
+		if _, ok := diagnostics[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	for path := range s.docs {
+		if _, ok := diagnostics[path]; !ok && !s.published[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	s.published = make(map[string]bool)
+	for _, path := range paths {
+		fileDiagnostics := diagnostics[path]
+		if fileDiagnostics == nil {
+			fileDiagnostics = make([]Diagnostic, 0)
+		} else {
+			s.published[path] = true
+		}
+		err := s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         s.pathToURI(path),
+			Diagnostics: fileDiagnostics,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diagnostics returns the errors from parsing the repo, and the errors from
+// merging the entries of every open document, keyed by repo-relative path
+func (s *Server) diagnostics() map[string][]Diagnostic {
+	diagnostics := make(map[string][]Diagnostic)
+	if s.treeErr != nil {
+		if !s.addErrorDiagnostics(diagnostics, s.treeErr) {
+			_ = s.notify("window/showMessage", showMessageParams{
+				Type:    messageTypeError,
+				Message: s.treeErr.Error(),
+			})
+		}
+	}
+
+	if s.tree == nil {
+		return diagnostics
+	}
+	for path := range s.docs {
+		for _, entry := range s.documentEntries(path) {
+			if _, _, err := s.mergedValue(entry); err != nil {
+				diagnostics[path] = append(diagnostics[path], Diagnostic{
+					Range:    s.pointRange(path, entry.Position()),
+					Severity: severityError,
+					Source:   diagnosticSource,
+					Message:  err.Error(),
+				})
+			}
+		}
+	}
+	return diagnostics
+}
+
+// addErrorDiagnostics adds a diagnostic for every position that an error from
+// parsing points at, following the errors from loading other modules. Returns
+// false if the error has no positions.
+func (s *Server) addErrorDiagnostics(diagnostics map[string][]Diagnostic, err error) bool {
+	found := false
+	add := func(pos syntax.Position, msg string) {
+		if !pos.IsValid() {
+			return
+		}
+		path := pos.Filename()
+		diagnostics[path] = append(diagnostics[path], Diagnostic{
+			Range:    s.pointRange(path, pos),
+			Severity: severityError,
+			Source:   diagnosticSource,
+			Message:  msg,
+		})
+		found = true
+	}
+
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch err := err.(type) {
+		case syntax.Error:
+			add(err.Pos, err.Msg)
+		case resolve.ErrorList:
+			for _, e := range err {
+				add(e.Pos, e.Msg)
+			}
+		case *metadata.LoadError:
+			add(err.Pos, fmt.Sprintf("cannot load %s: %v", err.Module, err.Err))
+		case *metadata.LoadCycleError:
+			msg := "load cycle: " + strings.Join(err.Modules, " -> ")
+			for _, pos := range err.Loads {
+				add(pos, msg)
+			}
+		case *starlark.EvalError:
+			// Point at the innermost call in each file on the stack
+			seen := make(map[string]bool)
+			for i := len(err.CallStack) - 1; i >= 0; i-- {
+				pos := err.CallStack[i].Pos
+				if pos.IsValid() && !seen[pos.Filename()] {
+					seen[pos.Filename()] = true
+					add(pos, err.Msg)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// documentEntries returns the entries defined by an open METADATA file
+func (s *Server) documentEntries(path string) []metadata.Entry {
+	entries := make([]metadata.Entry, 0)
+	for _, entry := range s.tree.Entries(filepath.Dir(path)) {
+		if entry.File() == path && entry.Position().IsValid() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// mergedValue returns the merged value of an entry's key for a file that the
+// entry applies to, preferring files that exist in the repo
+func (s *Server) mergedValue(entry metadata.Entry) (string, starlark.Value, error) {
+	candidates := entry.FileMatchSet().ExactMatches()
+
+	dir := filepath.Dir(entry.File())
+	if infos, err := os.ReadDir(filepath.Join(s.root, dir)); err == nil {
+		for _, info := range infos {
+			if !info.IsDir() {
+				candidates = append(candidates, filepath.Join(dir, info.Name()))
+			}
+		}
+	}
+
+	for _, file := range candidates {
+		if entry.AppliesTo(file) {
+			value, err := s.tree.Get(file, entry.Key())
+			return file, value, err
+		}
+	}
+	return "", nil, nil
+}
+
+func (s *Server) pointRange(path string, pos syntax.Position) Range {
+	p := toLSP(s.text(path), pos)
+	return Range{Start: p, End: p}
+}
+
+// text returns the contents of a repo-relative path, from its open document if
+// there is one
+func (s *Server) text(path string) string {
+	if text, ok := s.docs[path]; ok {
+		return text
+	}
+	contents, err := os.ReadFile(filepath.Join(s.root, path))
+	if err != nil {
+		return ""
+	}
+	return string(contents)
+}
+
+func (s *Server) parse(path string) (*syntax.File, error) {
+	return syntax.Parse(path, s.text(path), 0)
+}
+
+func uriToPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+func (s *Server) pathToURI(path string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(s.root, path))}
+	return u.String()
+}
+
+// relativePath converts a URI into a repo-relative path. Returns false for URIs
+// outside of the repo.
+func (s *Server) relativePath(uri string) (string, bool) {
+	path, ok := uriToPath(uri)
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// modulePath returns the repo-relative path of the module that a file loads
+// with a label. Without a tree, only labels starting with "//" are understood.
+func (s *Server) modulePath(from, label string) string {
+	if s.tree != nil {
+		if path, err := s.tree.ResolveModule(from, label); err == nil {
+			return path
+		}
+	}
+	return strings.TrimPrefix(label, "//")
+}
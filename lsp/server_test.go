@@ -0,0 +1,331 @@
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ownersMeta = `def _owners_horizontal_merge_impl(left, right):
+    return left + right
+
+def _owners_vertical_merge_impl(upper, lower):
+    return lower + upper
+
+owners = meta(
+    key="owners",
+    horizontal_merge=_owners_horizontal_merge_impl,
+    vertical_merge=_owners_vertical_merge_impl,
+)
+`
+
+const oneMetadata = `load("//owners.meta", "owners")
+
+owners(["bob"], files=[glob("*.py")])
+`
+
+func newTestRepo(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"owners.meta": ownersMeta,
+		"METADATA": `load("//owners.meta", "owners")
+owners(["alice"])
+metadata(key="tier", value=1)
+`,
+		"one/METADATA": oneMetadata,
+		"one/main.py":  "",
+		"one/main.cc":  "",
+	}
+	for path, contents := range files {
+		fullPath := filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+		require.NoError(t, ioutil.WriteFile(fullPath, []byte(contents), 0644))
+	}
+	return root
+}
+
+type testClient struct {
+	t      *testing.T
+	root   string
+	conn   *conn
+	nextID int
+
+	messages      chan testMessage
+	notifications []testMessage
+	done          chan error
+}
+
+// testMessage is any message sent by the server
+type testMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+	Result json.RawMessage  `json:"result"`
+	Error  *responseError   `json:"error"`
+}
+
+func newTestClient(t *testing.T, root string) *testClient {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	c := &testClient{
+		t:        t,
+		root:     root,
+		conn:     newConn(clientReader, clientWriter),
+		messages: make(chan testMessage, 100),
+		done:     make(chan error, 1),
+	}
+
+	server := NewServer(serverReader, serverWriter, root)
+	go func() {
+		c.done <- server.Run()
+		serverWriter.Close()
+	}()
+	go func() {
+		defer close(c.messages)
+		for {
+			body, err := c.conn.read()
+			if err != nil {
+				return
+			}
+			var msg testMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		clientWriter.Close()
+	})
+
+	c.call("initialize", map[string]interface{}{"rootUri": c.uri("")}, nil)
+	c.notify("initialized", struct{}{})
+	return c
+}
+
+func (c *testClient) uri(path string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(c.root, path))}
+	return u.String()
+}
+
+func (c *testClient) notify(method string, params interface{}) {
+	require.NoError(c.t, c.conn.write(notification{JSONRPC: "2.0", Method: method, Params: params}))
+}
+
+// call sends a request and decodes its result into result
+func (c *testClient) call(method string, params interface{}, result interface{}) {
+	resp := c.request(method, params)
+	require.Nil(c.t, resp.Error)
+	if result != nil {
+		require.NoError(c.t, json.Unmarshal(resp.Result, result))
+	}
+}
+
+// request sends a request and waits for its response, collecting the
+// notifications that are sent before it
+func (c *testClient) request(method string, params interface{}) testMessage {
+	c.nextID++
+	id := json.RawMessage(strconv.Itoa(c.nextID))
+	require.NoError(c.t, c.conn.write(struct {
+		JSONRPC string           `json:"jsonrpc"`
+		ID      *json.RawMessage `json:"id"`
+		Method  string           `json:"method"`
+		Params  interface{}      `json:"params"`
+	}{"2.0", &id, method, params}))
+
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			require.True(c.t, ok, "Server closed the connection")
+			if msg.ID == nil {
+				c.notifications = append(c.notifications, msg)
+				continue
+			}
+
+			require.Equal(c.t, string(id), string(*msg.ID))
+			return msg
+
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("Timed out waiting for a response to %s", method)
+		}
+	}
+}
+
+// diagnostics returns the last diagnostics published for a path, waiting for
+// the server to handle everything sent so far
+func (c *testClient) diagnostics(path string) []Diagnostic {
+	c.call("textDocument/hover", textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: c.uri("nothing")},
+	}, nil)
+
+	var last []Diagnostic
+	for _, msg := range c.notifications {
+		if msg.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var params publishDiagnosticsParams
+		require.NoError(c.t, json.Unmarshal(msg.Params, &params))
+		if params.URI == c.uri(path) {
+			last = params.Diagnostics
+		}
+	}
+	return last
+}
+
+func (c *testClient) open(path, text string) {
+	c.notify("textDocument/didOpen", didOpenParams{
+		TextDocument: textDocumentItem{URI: c.uri(path), Text: text},
+	})
+}
+
+func (c *testClient) change(path, text string) {
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]string{"uri": c.uri(path)},
+		"contentChanges": []map[string]string{{"text": text}},
+	})
+}
+
+func (c *testClient) at(path string, line, character int) textDocumentPositionParams {
+	return textDocumentPositionParams{
+		TextDocument: textDocumentIdentifier{URI: c.uri(path)},
+		Position:     Position{Line: line, Character: character},
+	}
+}
+
+func (c *testClient) shutdown() {
+	c.call("shutdown", nil, nil)
+	c.notify("exit", nil)
+	select {
+	case err := <-c.done:
+		assert.NoError(c.t, err)
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("Timed out waiting for the server to exit")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+
+	c.open("one/METADATA", oneMetadata)
+	assert.Empty(t, c.diagnostics("one/METADATA"))
+
+	c.change("one/METADATA", "load(\"//owners.meta\", \"owners\")\n\nowners([\"bob\"]\n")
+	diagnostics := c.diagnostics("one/METADATA")
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, severityError, diagnostics[0].Severity)
+	assert.Equal(t, 3, diagnostics[0].Range.Start.Line)
+
+	// Errors from merging values point at the entry
+	c.change("one/METADATA", "load(\"//owners.meta\", \"owners\")\n\nowners(\"bob\")\n")
+	diagnostics = c.diagnostics("one/METADATA")
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, Position{Line: 2, Character: 6}, diagnostics[0].Range.Start)
+
+	c.change("one/METADATA", oneMetadata)
+	assert.Empty(t, c.diagnostics("one/METADATA"))
+
+	c.shutdown()
+}
+
+func TestDiagnosticsInLoadedModule(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+
+	c.open("one/METADATA", oneMetadata)
+	c.open("owners.meta", "owners = meta(key=\"owners\", vertical_merge=undefined)\n")
+
+	diagnostics := c.diagnostics("owners.meta")
+	require.Len(t, diagnostics, 1)
+	assert.Contains(t, diagnostics[0].Message, "undefined")
+	assert.Equal(t, 0, diagnostics[0].Range.Start.Line)
+
+	// The METADATA file that failed to load the module points at its load()
+	diagnostics = c.diagnostics("METADATA")
+	require.Len(t, diagnostics, 1)
+	assert.Contains(t, diagnostics[0].Message, "cannot load //owners.meta")
+}
+
+func TestHover(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+	c.open("one/METADATA", oneMetadata)
+
+	var hover Hover
+	c.call("textDocument/hover", c.at("one/METADATA", 2, 2), &hover)
+	assert.Contains(t, hover.Contents.Value, "Sets metadata key `owners`")
+	assert.Contains(t, hover.Contents.Value, "Vertical merge: `_owners_vertical_merge_impl`")
+	assert.Contains(t, hover.Contents.Value, "Horizontal merge: `_owners_horizontal_merge_impl`")
+	assert.Contains(t, hover.Contents.Value, "Defined in `owners.meta:7`")
+	assert.Contains(t, hover.Contents.Value, "owners = meta(\n    key=\"owners\",")
+	assert.Equal(t, Range{Start: Position{2, 0}, End: Position{2, 6}}, *hover.Range)
+
+	c.call("textDocument/hover", c.at("one/METADATA", 2, 23), &hover)
+	assert.Contains(t, hover.Contents.Value, "glob(pattern)")
+}
+
+func TestDefinition(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+	c.open("one/METADATA", oneMetadata)
+
+	var location Location
+	c.call("textDocument/definition", c.at("one/METADATA", 2, 2), &location)
+	assert.Equal(t, c.uri("owners.meta"), location.URI)
+	assert.Equal(t, Range{Start: Position{6, 0}, End: Position{6, 6}}, location.Range)
+
+	c.call("textDocument/definition", c.at("one/METADATA", 0, 10), &location)
+	assert.Equal(t, c.uri("owners.meta"), location.URI)
+	assert.Equal(t, Range{}, location.Range)
+}
+
+func TestCompletion(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+
+	labels := func(text string, line, character int) []string {
+		c.open("one/METADATA", text)
+		var items []CompletionItem
+		c.call("textDocument/completion", c.at("one/METADATA", line, character), &items)
+		result := make([]string, 0, len(items))
+		for _, item := range items {
+			result = append(result, item.Label)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"owners", "tier"}, labels(`metadata(key="`, 0, 14))
+	assert.Equal(t, []string{"owners", "tier"}, labels(`metadata("ti`, 0, 12))
+	assert.Equal(t, []string{"//owners.meta"}, labels(`load("//`, 0, 8))
+	assert.Equal(t, []string{"METADATA", "main.cc", "main.py"}, labels(`owners([], files=[glob("`, 0, 24))
+	assert.Equal(t, []string{"METADATA", "main.cc", "main.py"}, labels(`owners([], files=["ma`, 0, 21))
+	assert.Contains(t, labels(oneMetadata+"ow", 3, 2), "owners")
+	assert.Empty(t, labels(`owners(["`, 0, 9))
+}
+
+func TestInlayHints(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+	c.open("one/METADATA", oneMetadata)
+
+	var hints []InlayHint
+	c.call("textDocument/inlayHint", inlayHintParams{
+		TextDocument: textDocumentIdentifier{URI: c.uri("one/METADATA")},
+		Range:        Range{End: Position{Line: 10}},
+	}, &hints)
+	require.Len(t, hints, 1)
+	assert.Equal(t, Position{Line: 2, Character: 37}, hints[0].Position)
+	assert.Equal(t, `owners for main.py: ["bob","alice"]`, hints[0].Label)
+}
+
+func TestUnknownMethod(t *testing.T) {
+	c := newTestClient(t, newTestRepo(t))
+	resp := c.request("textDocument/unknown", struct{}{})
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, methodNotFound, resp.Error.Code)
+	c.shutdown()
+}
@@ -0,0 +1,300 @@
+package lsp
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.starlark.net/syntax"
+)
+
+// Starlark positions have 1-based lines and 1-based columns counted in runes,
+// while LSP positions have 0-based lines and 0-based columns counted in UTF-16
+// code units, so converting between them needs the text of the line.
+
+func lineText(text string, line int) string {
+	lines := strings.SplitN(text, "\n", line+2)
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[line], "\r")
+}
+
+// toLSP converts a Starlark position in text to an LSP position
+func toLSP(text string, pos syntax.Position) Position {
+	if pos.Line < 1 {
+		return Position{}
+	}
+	line := int(pos.Line) - 1
+	runes := []rune(lineText(text, line))
+	col := int(pos.Col) - 1
+	if col < 0 {
+		col = 0
+	}
+	if col > len(runes) {
+		col = len(runes)
+	}
+	return Position{Line: line, Character: len(utf16.Encode(runes[:col]))}
+}
+
+// fromLSP converts an LSP position in text to the line and column of a
+// Starlark position
+func fromLSP(text string, pos Position) (line, col int32) {
+	units := 0
+	col = 1
+	for _, r := range lineText(text, pos.Line) {
+		if units >= pos.Character {
+			break
+		}
+		units += len(utf16.Encode([]rune{r}))
+		col++
+	}
+	return int32(pos.Line) + 1, col
+}
+
+// offsetOf returns the byte offset of an LSP position in text
+func offsetOf(text string, pos Position) int {
+	offset := 0
+	for i := 0; i < pos.Line; i++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+
+	units := 0
+	for offset < len(text) && units < pos.Character && text[offset] != '\n' {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		units += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+// endOfLine returns the LSP position of the end of a 0-based line
+func endOfLine(text string, line int) Position {
+	return Position{Line: line, Character: len(utf16.Encode([]rune(lineText(text, line))))}
+}
+
+// contains reports whether a Starlark position falls within a span
+func contains(start, end syntax.Position, line, col int32) bool {
+	if line < start.Line || line > end.Line {
+		return false
+	}
+	if line == start.Line && col < start.Col {
+		return false
+	}
+	if line == end.Line && col > end.Col {
+		return false
+	}
+	return true
+}
+
+// identAt returns the identifier at a Starlark position
+func identAt(f *syntax.File, line, col int32) *syntax.Ident {
+	var found *syntax.Ident
+	syntax.Walk(f, func(n syntax.Node) bool {
+		if found != nil {
+			return false
+		}
+		if id, ok := n.(*syntax.Ident); ok {
+			start, end := id.Span()
+			if contains(start, end, line, col) {
+				found = id
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// loadModuleAt returns the load statement whose module string is at a Starlark
+// position
+func loadModuleAt(f *syntax.File, line, col int32) *syntax.LoadStmt {
+	for _, stmt := range f.Stmts {
+		if load, ok := stmt.(*syntax.LoadStmt); ok {
+			start, end := load.Module.Span()
+			if contains(start, end, line, col) {
+				return load
+			}
+		}
+	}
+	return nil
+}
+
+// stmtAt returns the top-level statement that spans a 1-based line
+func stmtAt(f *syntax.File, line int32) syntax.Stmt {
+	for _, stmt := range f.Stmts {
+		start, end := stmt.Span()
+		if start.Line <= line && line <= end.Line {
+			return stmt
+		}
+	}
+	return nil
+}
+
+// moduleLabel returns the module string of a load statement, as it is written
+func moduleLabel(load *syntax.LoadStmt) string {
+	module, _ := load.Module.Value.(string)
+	return module
+}
+
+// binding describes where a top-level name in a file comes from. If the name
+// is loaded, module and name are the label of the module that it is loaded
+// from and its name there.
+type binding struct {
+	ident  *syntax.Ident
+	module string
+	name   string
+}
+
+// topLevelBinding finds the statement that binds a top-level name in a file
+func topLevelBinding(f *syntax.File, name string) (binding, bool) {
+	for _, stmt := range f.Stmts {
+		switch stmt := stmt.(type) {
+		case *syntax.LoadStmt:
+			for i, local := range stmt.From {
+				if local.Name == name {
+					return binding{ident: local, module: moduleLabel(stmt), name: stmt.To[i].Name}, true
+				}
+			}
+		case *syntax.DefStmt:
+			if stmt.Name.Name == name {
+				return binding{ident: stmt.Name}, true
+			}
+		case *syntax.AssignStmt:
+			if id, ok := stmt.LHS.(*syntax.Ident); ok && id.Name == name {
+				return binding{ident: id}, true
+			}
+		}
+	}
+	return binding{}, false
+}
+
+// loadedNames returns the local names bound by every load statement in a file
+func loadedNames(f *syntax.File) []binding {
+	bindings := make([]binding, 0)
+	for _, stmt := range f.Stmts {
+		if load, ok := stmt.(*syntax.LoadStmt); ok {
+			for i, local := range load.From {
+				bindings = append(bindings, binding{ident: local, module: moduleLabel(load), name: load.To[i].Name})
+			}
+		}
+	}
+	return bindings
+}
+
+// completionContext describes what is being typed at the cursor
+type completionContext struct {
+	// set if the cursor is inside a string literal
+	inString bool
+	// the part of the string literal before the cursor
+	prefix string
+
+	// the function whose arguments the cursor is in, if any
+	call string
+	// the index of the argument that the cursor is in
+	arg int
+	// the name of the keyword argument that the cursor is in, if any
+	keyword string
+}
+
+type openCall struct {
+	name    string
+	arg     int
+	keyword string
+}
+
+// scanContext works out the completion context at a byte offset by scanning the
+// text before it. Unlike parsing, this works on the incomplete code that is
+// being typed.
+func scanContext(text string, offset int) completionContext {
+	calls := make([]openCall, 0)
+	lastIdent := ""
+	ctx := completionContext{}
+
+	i := 0
+	for i < offset {
+		c := text[i]
+		switch {
+		case c == '#':
+			for i < offset && text[i] != '\n' {
+				i++
+			}
+			continue
+
+		case c == '"' || c == '\'':
+			quote := string(c)
+			if strings.HasPrefix(text[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			start := i + len(quote)
+			end := start
+			for end < offset && !strings.HasPrefix(text[end:], quote) {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= offset {
+				ctx.inString = true
+				ctx.prefix = text[start:offset]
+				i = offset
+				continue
+			}
+			i = end + len(quote)
+			lastIdent = ""
+			continue
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9':
+			start := i
+			for i < offset && (text[i] == '_' || text[i] >= 'a' && text[i] <= 'z' || text[i] >= 'A' && text[i] <= 'Z' || text[i] >= '0' && text[i] <= '9') {
+				i++
+			}
+			lastIdent = text[start:i]
+			continue
+
+		case c == '(' || c == '[' || c == '{':
+			name := ""
+			if c == '(' {
+				name = lastIdent
+			}
+			calls = append(calls, openCall{name: name})
+
+		case c == ')' || c == ']' || c == '}':
+			if len(calls) > 0 {
+				calls = calls[:len(calls)-1]
+			}
+
+		case c == ',':
+			if len(calls) > 0 {
+				calls[len(calls)-1].arg++
+				calls[len(calls)-1].keyword = ""
+			}
+
+		case c == '=':
+			if len(calls) > 0 && lastIdent != "" && !strings.HasPrefix(text[i:], "==") {
+				calls[len(calls)-1].keyword = lastIdent
+			}
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		}
+		lastIdent = ""
+		i++
+	}
+
+	// The innermost call is the one being completed, but lists inside a
+	// call are part of its argument, like the list in files=[...]
+	for j := len(calls) - 1; j >= 0; j-- {
+		if calls[j].name != "" {
+			ctx.call = calls[j].name
+			ctx.arg = calls[j].arg
+			ctx.keyword = calls[j].keyword
+			break
+		}
+	}
+	return ctx
+}
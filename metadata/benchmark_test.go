@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkRepo writes a synthetic repo, and returns its root and every file in
+// it. The benchmarks use the repo sized by the -synthetic flags.
+func benchmarkRepo(b *testing.B, s syntheticRepo) (string, []string) {
+	b.Helper()
+	root := s.write(b)
+	repo, err := NewRepo(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	files, err := repo.Files()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return root, files
+}
+
+func BenchmarkNewEagerTree(b *testing.B) {
+	root, _ := benchmarkRepo(b, syntheticFlags)
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := NewEagerTree(root, WithConcurrency(concurrency)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetMergedValue(b *testing.B) {
+	root, files := benchmarkRepo(b, syntheticFlags)
+	tree, err := NewEagerTree(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, file := range files {
+			_, err := tree.GetMergedValue(file, "key0")
+			if _, ok := err.(NoMetadataFoundError); err != nil && !ok {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDump(b *testing.B) {
+	root, files := benchmarkRepo(b, syntheticFlags)
+	tree, err := NewEagerTree(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	service := NewService(tree, files)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := service.Dump(&DumpArgs{}, &MultiReply{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	s := syntheticFlags
+	s.BrokenDensity = 0.1
+	root, _ := benchmarkRepo(b, s)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewEagerTree(root, WithKeepGoing()); err != nil {
+			if _, ok := err.(ParseErrors); !ok {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package metadata
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+)
+
+// ChangedFile is a file that is affected by a change to a repo
+type ChangedFile struct {
+	// Repo-relative path of the file
+	Path string
+
+	// Whether the file itself was changed
+	Changed bool
+
+	// Whether the file was deleted by the change
+	Deleted bool
+
+	// The changed METADATA and .meta files that the file's metadata comes
+	// from, sorted
+	MetadataChangedBy []string
+}
+
+// AnalyzeChanges builds the tree for the repo at root, and returns every file
+// that was changed or whose metadata may have changed, given the repo-relative
+// paths of the files that changed. A file's metadata may have changed if a
+// METADATA file above it changed, or a .meta file that one of those METADATA
+// files loads.
+func AnalyzeChanges(root string, changed []string, opts ...Option) (*MetadataTree, []ChangedFile, error) {
+	return AnalyzeChangesContext(context.Background(), root, changed, opts...)
+}
+
+// AnalyzeChangesContext is AnalyzeChanges, but stops walking the repo and
+// parsing once ctx is done
+func AnalyzeChangesContext(ctx context.Context, root string, changed []string, opts ...Option) (*MetadataTree, []ChangedFile, error) {
+	o, err := loadOptions(root, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo := newRepo(root, o)
+
+	metadataFiles, err := repo.MetadataFilesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	parser := newParser(repo, o)
+	tree, err := buildTree(ctx, parser, metadataFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree.cache = o.cache
+	tree.stats = o.stats
+
+	changedSet := make(StringSet)
+	for _, path := range changed {
+		changedSet.Add(filepath.Clean(path))
+	}
+
+	// directory -> changed files that the metadata in it comes from
+	causes := make(map[string][]string)
+	for path := range changedSet {
+		if repo.IsMetadataFile(filepath.Base(path)) {
+			dir := dirOfRelativePath(path)
+			causes[dir] = append(causes[dir], path)
+		}
+	}
+	for _, file := range metadataFiles {
+		for _, dep := range parser.loads(file.RelativePath()) {
+			dep = filepath.FromSlash(dep)
+			if changedSet.Contains(dep) {
+				causes[file.Dir()] = append(causes[file.Dir()], dep)
+			}
+		}
+	}
+
+	files, err := repo.FilesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	existing := make(StringSet)
+	for _, file := range files {
+		existing.Add(file)
+	}
+	for path := range changedSet {
+		if !existing.Contains(path) {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+
+	result := make([]ChangedFile, 0)
+	for _, file := range files {
+		changedBy := make([]string, 0)
+		for dir := dirOfRelativePath(file); ; dir = dirOfRelativePath(dir) {
+			changedBy = appendUnique(changedBy, causes[dir]...)
+			if dir == "" {
+				break
+			}
+		}
+
+		if !changedSet.Contains(file) && len(changedBy) == 0 {
+			continue
+		}
+		sort.Strings(changedBy)
+		result = append(result, ChangedFile{
+			Path:              file,
+			Changed:           changedSet.Contains(file),
+			Deleted:           !existing.Contains(file),
+			MetadataChangedBy: changedBy,
+		})
+	}
+	return tree, result, nil
+}
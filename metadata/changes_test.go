@@ -0,0 +1,74 @@
+package metadata
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeChanges(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"owners.meta": ownersMeta,
+		"tier.meta":   "def tier(value):\n    metadata(key=\"tier\", value=value)\n",
+		"METADATA":    "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"one/METADATA": `load("//tier.meta", "tier")
+tier(1)
+`,
+		"one/a.txt": "",
+		"two/b.txt": "",
+		"two/c.txt": "",
+	})
+
+	_, files, err := AnalyzeChanges(root, []string{"tier.meta", "two/b.txt", "gone.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, []ChangedFile{
+		{Path: "gone.txt", Changed: true, Deleted: true, MetadataChangedBy: []string{}},
+		{Path: "one/METADATA", MetadataChangedBy: []string{"tier.meta"}},
+		{Path: "one/a.txt", MetadataChangedBy: []string{"tier.meta"}},
+		{Path: "tier.meta", Changed: true, MetadataChangedBy: []string{}},
+		{Path: "two/b.txt", Changed: true, MetadataChangedBy: []string{}},
+	}, files)
+
+	// A change to the root METADATA file affects everything
+	_, files, err = AnalyzeChanges(root, []string{"METADATA"})
+	require.NoError(t, err)
+	assert.Len(t, files, 7)
+	for _, file := range files {
+		assert.Equal(t, []string{"METADATA"}, file.MetadataChangedBy)
+	}
+}
+
+func TestGitChangedPaths(t *testing.T) {
+	root := t.TempDir()
+	run := func(args ...string) {
+		runGit(t, root, args...)
+	}
+	writeFiles(t, root, map[string]string{
+		"sub/METADATA": "metadata(key=\"tier\", value=1)\n",
+		"sub/a.txt":    "a",
+		"b.txt":        "b",
+	})
+	run("init", "-q")
+	run("add", "-A")
+	run("commit", "-q", "-m", "base")
+	writeFiles(t, root, map[string]string{
+		"sub/METADATA": "metadata(key=\"tier\", value=2)\n",
+		"b.txt":        "changed",
+	})
+	run("commit", "-q", "-am", "head")
+	writeFiles(t, root, map[string]string{"sub/new.txt": ""})
+
+	paths, err := GitChangedPaths(root, "HEAD~1", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b.txt", "sub/METADATA"}, paths)
+
+	// Paths are relative to a root in a subdirectory, and the working tree
+	// includes untracked files
+	paths, err = GitChangedPaths(root+"/sub", "HEAD~1", "")
+	require.NoError(t, err)
+	sort.Strings(paths)
+	assert.Equal(t, []string{"METADATA", "new.txt"}, paths)
+}
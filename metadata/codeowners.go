@@ -0,0 +1,446 @@
+package metadata
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// CodeownersRule is a line of a CODEOWNERS file: a gitignore-style pattern and
+// the owners of the files that it matches
+type CodeownersRule struct {
+	Pattern string
+	Owners  []string
+
+	// 1-based line number that the rule was parsed from, or 0
+	Line int
+
+	re *regexp.Regexp
+}
+
+// Matches reports whether the rule's pattern matches a repo-relative file path
+func (r *CodeownersRule) Matches(filePath string) bool {
+	return r.re.MatchString(filepath.ToSlash(filePath))
+}
+
+// Codeowners is a GitHub or GitLab CODEOWNERS file. When several rules match a
+// file, the last one wins.
+type Codeowners struct {
+	Rules []*CodeownersRule
+}
+
+// NewCodeownersRule compiles a rule
+func NewCodeownersRule(pattern string, owners []string) (*CodeownersRule, error) {
+	re, err := compileCodeownersPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &CodeownersRule{Pattern: pattern, Owners: owners, re: re}, nil
+}
+
+// ParseCodeowners reads a CODEOWNERS file. GitLab section headers are skipped.
+func ParseCodeowners(r io.Reader) (*Codeowners, error) {
+	c := &Codeowners{Rules: make([]*CodeownersRule, 0)}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := splitCodeownersLine(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+			continue
+		}
+
+		rule, err := NewCodeownersRule(fields[0], fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse CODEOWNERS line %d: %v", lineNumber, err)
+		}
+		rule.Line = lineNumber
+		c.Rules = append(c.Rules, rule)
+	}
+	return c, scanner.Err()
+}
+
+// splitCodeownersLine splits a line into whitespace-separated fields, dropping
+// comments. Backslashes escape spaces and '#'.
+func splitCodeownersLine(line string) []string {
+	fields := make([]string, 0)
+	var field strings.Builder
+	inField := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			field.WriteByte(c)
+			field.WriteByte(line[i+1])
+			inField = true
+			i++
+		case c == '#' && !inField:
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// Owners returns the owners of a repo-relative file path from the last rule
+// that matches it. Returns false if no rule matches.
+func (c *Codeowners) Owners(filePath string) ([]string, bool) {
+	for i := len(c.Rules) - 1; i >= 0; i-- {
+		if c.Rules[i].Matches(filePath) {
+			return c.Rules[i].Owners, true
+		}
+	}
+	return nil, false
+}
+
+// Write writes the rules in CODEOWNERS syntax, after a comment header if one is
+// given
+func (c *Codeowners) Write(w io.Writer, header string) error {
+	bw := bufio.NewWriter(w)
+	if header != "" {
+		for _, line := range strings.Split(strings.TrimRight(header, "\n"), "\n") {
+			fmt.Fprintf(bw, "# %s\n", line)
+		}
+		bw.WriteString("\n")
+	}
+	for _, rule := range c.Rules {
+		bw.WriteString(rule.Pattern)
+		for _, owner := range rule.Owners {
+			bw.WriteString(" ")
+			bw.WriteString(owner)
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// compileCodeownersPattern converts a gitignore-style pattern into a regex that
+// matches the files that it applies to
+func compileCodeownersPattern(pattern string) (*regexp.Regexp, error) {
+	p := pattern
+	if p == "" {
+		return nil, fmt.Errorf("Empty pattern")
+	}
+
+	anchored := strings.HasPrefix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	dirOnly := strings.HasSuffix(p, "/")
+	p = strings.TrimSuffix(p, "/")
+	if p == "" {
+		// "/" matches everything
+		return regexp.Compile("^.*$")
+	}
+
+	// Patterns without a separator match at any depth
+	anchored = anchored || strings.Contains(p, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	b.WriteString(gitPatternRegex(p))
+
+	lastSegment := p[strings.LastIndex(p, "/")+1:]
+	switch {
+	case dirOnly:
+		// Only directories match, which means every file below them
+		b.WriteString("/.*$")
+	case strings.Contains(lastSegment, "*") && lastSegment != "**":
+		// Like GitHub, "docs/*" matches the files in docs but not the
+		// files in its subdirectories
+		b.WriteString("$")
+	default:
+		// A pattern that matches a directory applies to every file below it
+		b.WriteString("(?:/.*)?$")
+	}
+	return regexp.Compile(b.String())
+}
+
+// gitPatternRegex converts a pattern in the syntax shared by .gitignore and
+// CODEOWNERS files, without its leading and trailing slashes, into a regex
+// that matches the same paths
+func gitPatternRegex(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(p[i])))
+		case strings.HasPrefix(p[i:], "**"):
+			atStart := i == 0 || p[i-1] == '/'
+			switch {
+			case atStart && strings.HasPrefix(p[i+2:], "/"):
+				// Zero or more directories
+				b.WriteString("(?:.*/)?")
+				i += 2
+			case atStart && i+2 == len(p):
+				b.WriteString(".*")
+				i++
+			default:
+				b.WriteString("[^/]*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// codeownersPath escapes a path so that it only matches itself, as far as
+// CODEOWNERS syntax allows. Characters that GitHub can't escape are replaced by
+// '?', which matches any single character.
+func codeownersPath(path string, keepStars bool) string {
+	var b strings.Builder
+	for i, c := range filepath.ToSlash(path) {
+		switch {
+		case c == '*' && keepStars:
+			b.WriteRune(c)
+		case c == ' ':
+			b.WriteString(`\ `)
+		case c == '*' || c == '?' || c == '[' || c == ']' || c == '\\' || (i == 0 && (c == '#' || c == '!')):
+			b.WriteRune('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// OwnersFromValue converts a metadata value into a list of owners. The value
+// must be a string, None, or a list, tuple or set of strings. Owners are
+// deduplicated, keeping the first occurrence.
+func OwnersFromValue(value starlark.Value) ([]string, error) {
+	if value == nil || value == starlark.None {
+		return nil, nil
+	}
+	if s, ok := value.(starlark.String); ok {
+		return []string{s.GoString()}, nil
+	}
+
+	items, ok := sequenceItems(value)
+	if !ok {
+		return nil, fmt.Errorf("expected a string or a list of strings, got %s", value.Type())
+	}
+
+	owners := make([]string, 0, len(items))
+	seen := make(StringSet)
+	for _, item := range items {
+		s, ok := item.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("expected a string or a list of strings, got %s in a %s", item.Type(), value.Type())
+		}
+		owner := s.GoString()
+		if strings.ContainsAny(owner, " \t\n") {
+			return nil, fmt.Errorf("owner '%s' contains whitespace", owner)
+		}
+		if !seen.Contains(owner) {
+			seen.Add(owner)
+			owners = append(owners, owner)
+		}
+	}
+	return owners, nil
+}
+
+// GenerateCodeowners builds a CODEOWNERS file that gives every one of the given
+// files the merged value of a key as its owners.
+//
+// Each directory with entries for the key becomes a rule for the whole
+// directory, followed by a rule for each file and glob that its entries are
+// limited to, so that deeper and more specific rules come later and win. Each
+// rule gets the owners shared by most of the files that it is the last match
+// for, and files whose owners differ from their rule get a rule of their own at
+// the end. Rules that are not the last match for any file, or that don't change
+// the owners of any file, are left out.
+func GenerateCodeowners(tree Tree, files []string, key string) (*Codeowners, error) {
+	return GenerateCodeownersContext(context.Background(), tree, files, key)
+}
+
+// GenerateCodeownersContext is GenerateCodeowners, but stops merging once ctx
+// is done
+func GenerateCodeownersContext(ctx context.Context, tree Tree, files []string, key string) (*Codeowners, error) {
+	candidates := make([]*CodeownersRule, 0)
+	seen := make(StringSet)
+	addCandidate := func(pattern string) error {
+		if seen.Contains(pattern) {
+			return nil
+		}
+		seen.Add(pattern)
+		rule, err := NewCodeownersRule(pattern, nil)
+		if err != nil {
+			return fmt.Errorf("Cannot translate '%s' into a CODEOWNERS pattern: %v", pattern, err)
+		}
+		candidates = append(candidates, rule)
+		return nil
+	}
+
+	err := tree.Walk(func(dirPath string, entries []Entry) error {
+		keyEntries := make([]Entry, 0)
+		for _, entry := range entries {
+			if entry.Key() == key {
+				keyEntries = append(keyEntries, entry)
+			}
+		}
+		if len(keyEntries) == 0 {
+			return nil
+		}
+
+		dirPattern := "*"
+		if dirPath != "" {
+			dirPattern = "/" + codeownersPath(dirPath, false) + "/"
+		}
+		if err := addCandidate(dirPattern); err != nil {
+			return err
+		}
+
+		for _, entry := range keyEntries {
+			for _, file := range entry.FileMatchSet().ExactMatches() {
+				if err := addCandidate("/" + codeownersPath(file, false)); err != nil {
+					return err
+				}
+			}
+			for _, glob := range entry.FileMatchSet().Globs() {
+				fullPattern := filepath.Join(dirPath, glob.Pattern())
+				if err := addCandidate("/" + codeownersPath(fullPattern, true)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The owners of every file, and the candidate that is its last match
+	owners := make(map[string][]string, len(files))
+	owned := make([][]string, len(candidates))
+	unmatched := make([]string, 0)
+	for _, file := range files {
+		value, err := tree.GetContext(ctx, file, key)
+		if _, ok := err.(NoMetadataFoundError); ok {
+			value = nil
+		} else if err != nil {
+			return nil, err
+		}
+		if owners[file], err = OwnersFromValue(value); err != nil {
+			return nil, fmt.Errorf("Cannot use '%s' metadata for '%s' as owners: %v", key, file, err)
+		}
+
+		last := -1
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if candidates[i].Matches(file) {
+				last = i
+				break
+			}
+		}
+		if last >= 0 {
+			owned[last] = append(owned[last], file)
+		} else if len(owners[file]) > 0 {
+			unmatched = append(unmatched, file)
+		}
+	}
+
+	c := &Codeowners{Rules: make([]*CodeownersRule, 0)}
+	for i, candidate := range candidates {
+		if len(owned[i]) == 0 {
+			continue
+		}
+
+		rule := *candidate
+		rule.Owners = mostCommonOwners(owned[i], owners)
+
+		// Leave out rules that give their files the owners that they would
+		// get from the rules before them anyway
+		redundant := true
+		for _, file := range owned[i] {
+			if !sameOwners(owners[file], rule.Owners) {
+				unmatched = append(unmatched, file)
+				continue
+			}
+			previous, _ := c.Owners(file)
+			if !sameOwners(previous, rule.Owners) {
+				redundant = false
+			}
+		}
+		if !redundant {
+			c.Rules = append(c.Rules, &rule)
+		}
+	}
+
+	sort.Strings(unmatched)
+	for _, file := range unmatched {
+		rule, err := NewCodeownersRule("/"+codeownersPath(file, false), owners[file])
+		if err != nil {
+			return nil, err
+		}
+		c.Rules = append(c.Rules, rule)
+	}
+	return c, nil
+}
+
+// mostCommonOwners returns the owners shared by the most files, preferring the
+// owners of earlier files in a tie
+func mostCommonOwners(files []string, owners map[string][]string) []string {
+	counts := make(map[string]int)
+	best := ""
+	var bestOwners []string
+	for _, file := range files {
+		k := strings.Join(owners[file], "\x00")
+		counts[k]++
+		if bestOwners == nil || counts[k] > counts[best] {
+			best = k
+			bestOwners = owners[file]
+			if bestOwners == nil {
+				bestOwners = []string{}
+			}
+		}
+	}
+	return bestOwners
+}
+
+func sameOwners(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
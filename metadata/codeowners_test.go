@@ -0,0 +1,141 @@
+package metadata
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeownersPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*", "a/b/c.txt", true},
+		{"*.js", "main.js", true},
+		{"*.js", "deep/dir/main.js", true},
+		{"*.js", "main.jsx", false},
+		{"/build/logs/", "build/logs/x.log", true},
+		{"/build/logs/", "build/logs", false},
+		{"/build/logs/", "other/build/logs/x.log", false},
+		{"docs/*", "docs/getting-started.md", true},
+		{"docs/*", "docs/build-app/troubleshooting.md", false},
+		{"apps/", "apps/main.go", true},
+		{"apps/", "deep/apps/main.go", true},
+		{"/docs", "docs/deep/file.md", true},
+		{"**/logs", "build/logs/x.log", true},
+		{"**/logs", "logs/x.log", true},
+		{"/a/**/b.txt", "a/b.txt", true},
+		{"/a/**/b.txt", "a/x/y/b.txt", true},
+		{"/a/**", "a/x/y/b.txt", true},
+		{"/a/**", "b/a.txt", false},
+		{"/file?.txt", "file1.txt", true},
+		{"/file[0-9].txt", "file1.txt", true},
+		{"/file[!0-9].txt", "file1.txt", false},
+		{`/with\ space.txt`, "with space.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+":"+tt.path, func(t *testing.T) {
+			rule, err := NewCodeownersRule(tt.pattern, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, rule.Matches(tt.path))
+		})
+	}
+}
+
+func TestParseCodeowners(t *testing.T) {
+	c, err := ParseCodeowners(strings.NewReader(`# comment
+*       @global-owner
+
+[Section]
+*.js    @js-owner # inline comment
+/docs/  docs@example.com @org/team
+/no/owners
+`))
+	require.NoError(t, err)
+	require.Len(t, c.Rules, 4)
+	assert.Equal(t, 5, c.Rules[1].Line)
+	assert.Equal(t, []string{"docs@example.com", "@org/team"}, c.Rules[2].Owners)
+
+	owners, ok := c.Owners("docs/main.js")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"docs@example.com", "@org/team"}, owners)
+
+	owners, ok = c.Owners("src/main.js")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"@js-owner"}, owners)
+
+	owners, ok = c.Owners("no/owners/file")
+	assert.True(t, ok)
+	assert.Empty(t, owners)
+}
+
+func TestGenerateCodeowners(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"owners.meta": ownersMeta,
+		"METADATA": `
+load("//owners.meta", "owners")
+owners(["@alice"])
+`,
+		"README.md": "",
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["@bob"], files=[glob("*.py")])
+owners(["@carol"], files=["special.txt"])
+`,
+		"one/main.py":        "",
+		"one/main.cc":        "",
+		"one/special.txt":    "",
+		"one/deep/lib.py":    "",
+		"two/METADATA":       `metadata(key="tier", value=2)`,
+		"two/main.py":        "",
+		"three/METADATA":     "load(\"//owners.meta\", \"owners\")\nowners([\"@alice\"])\n",
+		"three/file name.go": "",
+	})
+
+	tree, err := NewEagerTree(root)
+	require.NoError(t, err)
+	files, err := (&Repo{Root: root}).Files()
+	require.NoError(t, err)
+
+	c, err := GenerateCodeowners(tree, files, "owners")
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, c.Write(&b, "Generated"))
+	assert.Equal(t, `# Generated
+
+* @alice
+/one/*.py @bob @alice
+/one/special.txt @carol @alice
+`, b.String())
+
+	// Every file gets its merged owners
+	for _, file := range files {
+		value, err := tree.Get(file, "owners")
+		require.NoError(t, err)
+		want, err := OwnersFromValue(value)
+		require.NoError(t, err)
+
+		got, _ := c.Owners(file)
+		assert.Equal(t, want, got, file)
+	}
+}
+
+func TestGenerateCodeownersInvalidValue(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"METADATA":  `metadata(key="owners", value=1)`,
+		"README.md": "",
+	})
+
+	tree, err := NewEagerTree(root)
+	require.NoError(t, err)
+	_, err = GenerateCodeowners(tree, []string{"README.md"}, "owners")
+	assert.EqualError(t, err, "Cannot use 'owners' metadata for 'README.md' as owners: expected a string or a list of strings, got int")
+}
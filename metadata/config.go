@@ -0,0 +1,276 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// ConfigFilename is the name of the config file at the root of a repo, which
+// is read automatically by NewEagerTree, NewLiveTree and NewRepo. It is a
+// Starlark file that sets these globals, all of them optional:
+//
+//	# Names of METADATA files. A directory can only have one of them.
+//	metadata_filenames = ["METADATA", "METADATA.star"]
+//	# Directories searched for .meta files loaded without a leading "//"
+//	meta_roots = ["tools/meta"]
+//	# Other repos that modules can be loaded from with "@name//path"
+//	aliases = {"shared": "../shared-metadata"}
+//	# .meta files whose public globals are available in every METADATA file
+//	prelude = ["//owners.meta"]
+//	# Paths to skip, in .gitignore syntax
+//	ignore = ["third_party/", "*.generated"]
+//	# Output format of the meta command
+//	format = "yaml"
+//	# True for every check, or a list of: "declared_keys", "existing_files"
+//	strict = True
+//	# Limits for executing a module or calling a merge function
+//	max_execution_steps = 1000000
+//	timeout = "10s"
+//	# Where to keep caches, relative to the root of the repo
+//	cache_dir = ".cache/meta"
+const ConfigFilename = ".metaconfig"
+
+// Config is the settings of a repo from its ConfigFilename file
+type Config struct {
+	MetadataFilenames []string
+	MetaRoots         []string
+	Prelude           []string
+	Aliases           map[string]string
+	Ignore            []string
+	Format            string
+	Strict            Strictness
+	MaxExecutionSteps uint64
+	Timeout           time.Duration
+	CacheDir          string
+}
+
+// Strictness turns on checks that METADATA files don't need to pass by
+// default
+type Strictness struct {
+	// Keys can only be set by functions made with meta(), not by metadata()
+	DeclaredKeys bool
+
+	// Files listed by name in files=[...] have to exist
+	ExistingFiles bool
+}
+
+// LoadConfig reads the config file at the root of a filesystem. Returns nil
+// if there isn't one.
+func LoadConfig(fsys fs.FS) (*Config, error) {
+	contents, err := fs.ReadFile(fsys, ConfigFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseConfig(ConfigFilename, string(contents))
+}
+
+// ParseConfig parses the contents of a config file
+func ParseConfig(filename, contents string) (*Config, error) {
+	thread := &starlark.Thread{Name: filename}
+	globals, err := starlark.ExecFile(thread, filename, contents, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	names := make([]string, 0, len(globals))
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := globals[name]
+		switch name {
+		case "metadata_filenames":
+			err = configStrings(value, &c.MetadataFilenames)
+		case "meta_roots":
+			err = configStrings(value, &c.MetaRoots)
+		case "prelude":
+			err = configStrings(value, &c.Prelude)
+		case "aliases":
+			c.Aliases, err = configAliases(value)
+		case "ignore":
+			err = configStrings(value, &c.Ignore)
+		case "format":
+			err = configString(value, &c.Format)
+		case "cache_dir":
+			err = configString(value, &c.CacheDir)
+		case "max_execution_steps":
+			err = starlark.AsInt(value, &c.MaxExecutionSteps)
+		case "timeout":
+			c.Timeout, err = configDuration(value)
+		case "strict":
+			c.Strict, err = configStrictness(value)
+		default:
+			// Private globals can be used as helpers
+			if strings.HasPrefix(name, "_") {
+				continue
+			}
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot use '%s' in %s: %v", name, filename, err)
+		}
+	}
+
+	for _, name := range c.MetadataFilenames {
+		if name == "" || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("Cannot use '%s' in %s: '%s' is not a file name", "metadata_filenames", filename, name)
+		}
+	}
+	for i, root := range c.MetaRoots {
+		c.MetaRoots[i] = strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(root, "//")), "/")
+	}
+	return c, nil
+}
+
+func configString(value starlark.Value, target *string) error {
+	s, ok := starlark.AsString(value)
+	if !ok {
+		return fmt.Errorf("got %s, want string", value.Type())
+	}
+	*target = s
+	return nil
+}
+
+func configStrings(value starlark.Value, target *[]string) error {
+	if s, ok := starlark.AsString(value); ok {
+		*target = []string{s}
+		return nil
+	}
+
+	iterable, ok := value.(starlark.Iterable)
+	if !ok {
+		return fmt.Errorf("got %s, want string or list of strings", value.Type())
+	}
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	var item starlark.Value
+	for iter.Next(&item) {
+		s, ok := starlark.AsString(item)
+		if !ok {
+			return fmt.Errorf("got list containing %s, want list of strings", item.Type())
+		}
+		*target = append(*target, s)
+	}
+	return nil
+}
+
+func configAliases(value starlark.Value) (map[string]string, error) {
+	dict, ok := value.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("got %s, want dict", value.Type())
+	}
+	aliases := make(map[string]string, dict.Len())
+	for _, item := range dict.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok || name == "" || strings.ContainsAny(name, "@/") {
+			return nil, fmt.Errorf("%s is not a valid alias", item[0])
+		}
+		dir, ok := starlark.AsString(item[1])
+		if !ok {
+			return nil, fmt.Errorf("got %s for alias '%s', want string", item[1].Type(), name)
+		}
+		aliases[name] = dir
+	}
+	return aliases, nil
+}
+
+func configDuration(value starlark.Value) (time.Duration, error) {
+	var s string
+	if err := configString(value, &s); err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a duration like \"10s\"", s)
+	}
+	return d, nil
+}
+
+func configStrictness(value starlark.Value) (Strictness, error) {
+	if b, ok := value.(starlark.Bool); ok {
+		return Strictness{DeclaredKeys: bool(b), ExistingFiles: bool(b)}, nil
+	}
+
+	var checks []string
+	if err := configStrings(value, &checks); err != nil {
+		return Strictness{}, fmt.Errorf("got %s, want bool or list of strings", value.Type())
+	}
+	s := Strictness{}
+	for _, check := range checks {
+		switch check {
+		case "declared_keys":
+			s.DeclaredKeys = true
+		case "existing_files":
+			s.ExistingFiles = true
+		default:
+			return Strictness{}, fmt.Errorf("unknown check '%s', expected one of: declared_keys, existing_files", check)
+		}
+	}
+	return s, nil
+}
+
+// Options returns the options that apply the config
+func (c *Config) Options() []Option {
+	opts := make([]Option, 0)
+	if len(c.MetadataFilenames) > 0 {
+		opts = append(opts, WithMetadataFilenames(c.MetadataFilenames...))
+	}
+	if len(c.MetaRoots) > 0 {
+		opts = append(opts, WithMetaRoots(c.MetaRoots...))
+	}
+	if len(c.Prelude) > 0 {
+		opts = append(opts, WithPrelude(c.Prelude...))
+	}
+	if len(c.Aliases) > 0 {
+		opts = append(opts, WithAliases(c.Aliases))
+	}
+	if len(c.Ignore) > 0 {
+		opts = append(opts, WithIgnore(c.Ignore...))
+	}
+	if c.MaxExecutionSteps > 0 {
+		opts = append(opts, WithMaxExecutionSteps(c.MaxExecutionSteps))
+	}
+	if c.Timeout > 0 {
+		opts = append(opts, WithTimeout(c.Timeout))
+	}
+	if c.CacheDir != "" {
+		opts = append(opts, WithCacheDir(c.CacheDir))
+	}
+	if c.Strict != (Strictness{}) {
+		opts = append(opts, WithStrictness(c.Strict))
+	}
+	return opts
+}
+
+// loadOptions applies the options for a repo at root, after the ones from its
+// config file unless WithoutConfig is given
+func loadOptions(root string, opts []Option) (options, error) {
+	o := newOptions(opts)
+	if o.noConfig {
+		return o, nil
+	}
+
+	fsys := o.fs
+	if fsys == nil {
+		fsys = os.DirFS(root)
+	}
+	config, err := LoadConfig(fsys)
+	if err != nil || config == nil {
+		return o, err
+	}
+	return newOptions(append(config.Options(), opts...)), nil
+}
@@ -0,0 +1,121 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(ConfigFilename, `
+_roots = ["//tools/meta/", "shared"]
+
+metadata_filenames = ["METADATA", "METADATA.star"]
+meta_roots = _roots
+prelude = ["//owners.meta"]
+aliases = {"shared": "../shared"}
+ignore = "third_party/"
+format = "yaml"
+strict = ["existing_files"]
+cache_dir = ".cache/meta"
+`)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{
+		MetadataFilenames: []string{"METADATA", "METADATA.star"},
+		MetaRoots:         []string{"tools/meta", "shared"},
+		Prelude:           []string{"//owners.meta"},
+		Aliases:           map[string]string{"shared": "../shared"},
+		Ignore:            []string{"third_party/"},
+		Format:            "yaml",
+		Strict:            Strictness{ExistingFiles: true},
+		CacheDir:          ".cache/meta",
+	}, config)
+
+	config, err = ParseConfig(ConfigFilename, "strict = True\n")
+	require.NoError(t, err)
+	assert.Equal(t, Strictness{DeclaredKeys: true, ExistingFiles: true}, config.Strict)
+
+	_, err = ParseConfig(ConfigFilename, "metadata_filename = \"META\"\n")
+	assert.EqualError(t, err, "Cannot use 'metadata_filename' in .metaconfig: unknown setting")
+
+	_, err = ParseConfig(ConfigFilename, "aliases = {\"@shared\": \"../shared\"}\n")
+	assert.EqualError(t, err, "Cannot use 'aliases' in .metaconfig: \"@shared\" is not a valid alias")
+
+	_, err = ParseConfig(ConfigFilename, "format = 1\n")
+	assert.EqualError(t, err, "Cannot use 'format' in .metaconfig: got int, want string")
+
+	_, err = ParseConfig(ConfigFilename, "strict = [\"everything\"]\n")
+	assert.EqualError(t, err, "Cannot use 'strict' in .metaconfig: unknown check 'everything', expected one of: declared_keys, existing_files")
+
+	_, err = ParseConfig(ConfigFilename, "metadata_filenames = [\"a/METADATA\"]\n")
+	assert.EqualError(t, err, "Cannot use 'metadata_filenames' in .metaconfig: 'a/METADATA' is not a file name")
+}
+
+func TestConfigDiscovery(t *testing.T) {
+	files := map[string]string{
+		ConfigFilename: `
+metadata_filenames = ["METADATA", "METADATA.star"]
+meta_roots = ["tools/meta"]
+ignore = ["vendor/"]
+`,
+		"tools/meta/owners.meta": ownersMeta,
+		"METADATA":               "load(\"owners.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"one/METADATA.star":      "load(\"owners.meta\", \"owners\")\nowners([\"bob\"], files=[\"a.txt\"])\n",
+		"one/a.txt":              "a",
+		"vendor/METADATA":        "this is not starlark",
+	}
+
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	value, err := tree.Get("one/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+
+	repo, err := NewRepo("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	assert.True(t, repo.IsMetadataFile("METADATA.star"))
+	assert.Equal(t, "one/METADATA.star", repo.metadataFileIn("one"))
+	assert.Equal(t, "METADATA", repo.metadataFileIn(""))
+
+	// Without the config, load() needs "//" and vendor/ isn't skipped
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithoutConfig())
+	assert.Error(t, err)
+
+	// Explicit options win over the config
+	tree, err = NewEagerTree("", WithFS(NewMapFS(files)), WithMetadataFilename("METADATA.star"))
+	require.NoError(t, err)
+	_, err = tree.Get("a.txt", "owners")
+	assert.IsType(t, NoMetadataFoundError{}, err)
+
+	files["one/METADATA"] = "load(\"owners.meta\", \"owners\")\nowners([\"carol\"])\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	assert.EqualError(t, err, "Cannot use both METADATA and METADATA.star in one: a directory can only have one METADATA file")
+
+	_, err = NewEagerTree("", WithFS(NewMapFS(map[string]string{ConfigFilename: "formt = \"json\"\n"})))
+	assert.EqualError(t, err, "Cannot use 'formt' in .metaconfig: unknown setting")
+}
+
+func TestStrictness(t *testing.T) {
+	files := map[string]string{
+		"owners.meta": ownersMeta,
+		"METADATA":    "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"], files=[\"a.txt\"])\n",
+		"a.txt":       "a",
+	}
+
+	_, err := NewEagerTree("", WithFS(NewMapFS(files)), WithStrictness(Strictness{DeclaredKeys: true, ExistingFiles: true}))
+	require.NoError(t, err)
+
+	files["METADATA"] = "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"], files=[\"b.txt\"])\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithStrictness(Strictness{ExistingFiles: true}))
+	assert.EqualError(t, err, "Cannot use files=[...]: b.txt does not exist")
+
+	files["METADATA"] = "metadata(\"team\", \"infra\")\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithStrictness(Strictness{ExistingFiles: true}))
+	require.NoError(t, err)
+	files[ConfigFilename] = "strict = [\"declared_keys\"]\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	assert.EqualError(t, err, "Cannot set 'team' with metadata(): keys have to be declared with meta() in strict mode")
+}
@@ -0,0 +1,348 @@
+package metadata
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// Unmarshaler is implemented by types that know how to decode themselves from
+// a starlark value
+type Unmarshaler interface {
+	UnmarshalStarlark(v starlark.Value) error
+}
+
+// DecodeError is returned by Decode when a starlark value cannot be stored in
+// the Go value it is being decoded into
+type DecodeError struct {
+	// Path to the value that failed to decode, like ".owners[2].name". Empty
+	// if the top level value failed to decode.
+	Path  string
+	Value starlark.Value
+	Type  reflect.Type
+	Msg   string
+}
+
+func (e *DecodeError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "value"
+	}
+	msg := fmt.Sprintf("Cannot decode starlark %s into Go %s at %s", e.Value.Type(), e.Type, path)
+	if e.Msg != "" {
+		msg += ": " + e.Msg
+	}
+	return msg
+}
+
+var (
+	unmarshalerType   = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	starlarkValueType = reflect.TypeOf((*starlark.Value)(nil)).Elem()
+	bigIntType        = reflect.TypeOf(big.Int{})
+)
+
+// Decode stores a starlark value in the Go value pointed to by target, in the
+// same way that encoding/json decodes JSON.
+//
+// Dicts and values with attributes (like structs) decode into Go structs by
+// matching keys to field names. The field name can be changed with a `meta`
+// struct tag, and a tag of "-" skips the field. Keys without a matching field
+// are ignored. Lists, tuples and sets decode into slices and arrays, and None
+// decodes into the zero value. Decoding into a starlark.Value stores the value
+// as-is, and decoding into an empty interface stores the result of
+// ValueToGoType.
+func Decode(value starlark.Value, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Decode target must be a non-nil pointer, got %T", target)
+	}
+	return decodeValue(value, rv.Elem(), "")
+}
+
+func decodeValue(value starlark.Value, rv reflect.Value, path string) error {
+	if rv.CanAddr() && rv.Addr().Type().Implements(unmarshalerType) {
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		if err := rv.Addr().Interface().(Unmarshaler).UnmarshalStarlark(value); err != nil {
+			return &DecodeError{path, value, rv.Type(), err.Error()}
+		}
+		return nil
+	}
+
+	if rv.Type() == starlarkValueType {
+		rv.Set(reflect.ValueOf(&value).Elem())
+		return nil
+	}
+
+	if value == starlark.None {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	if rv.Type() == bigIntType {
+		i, ok := value.(starlark.Int)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		rv.Set(reflect.ValueOf(i.BigInt()).Elem())
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return decodeValue(value, rv.Elem(), path)
+
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return &DecodeError{path, value, rv.Type(), "only empty interfaces are supported"}
+		}
+		goValue, err := ValueToGoType(value)
+		if err != nil {
+			return &DecodeError{path, value, rv.Type(), err.Error()}
+		}
+		if goValue == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(goValue))
+		}
+		return nil
+
+	case reflect.Bool:
+		b, ok := value.(starlark.Bool)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		rv.SetBool(bool(b))
+		return nil
+
+	case reflect.String:
+		s, ok := starlark.AsString(value)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		rv.SetString(s)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := value.(starlark.Int)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		i64, ok := i.Int64()
+		if !ok || rv.OverflowInt(i64) {
+			return &DecodeError{path, value, rv.Type(), fmt.Sprintf("%s overflows %s", i, rv.Type())}
+		}
+		rv.SetInt(i64)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := value.(starlark.Int)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		u64, ok := i.Uint64()
+		if !ok || rv.OverflowUint(u64) {
+			return &DecodeError{path, value, rv.Type(), fmt.Sprintf("%s overflows %s", i, rv.Type())}
+		}
+		rv.SetUint(u64)
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v := value.(type) {
+		case starlark.Float:
+			f = float64(v)
+		case starlark.Int:
+			f = float64(v.Float())
+		default:
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		if rv.OverflowFloat(f) && !math.IsInf(f, 0) {
+			return &DecodeError{path, value, rv.Type(), fmt.Sprintf("%v overflows %s", f, rv.Type())}
+		}
+		rv.SetFloat(f)
+		return nil
+
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if b, ok := value.(starlark.Bytes); ok {
+				rv.SetBytes([]byte(b))
+				return nil
+			}
+		}
+		items, ok := sequenceItems(value)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+
+	case reflect.Array:
+		items, ok := sequenceItems(value)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		if len(items) != rv.Len() {
+			return &DecodeError{path, value, rv.Type(), fmt.Sprintf("expected %d items, got %d", rv.Len(), len(items))}
+		}
+		for i, item := range items {
+			if err := decodeValue(item, rv.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		dict, ok := value.(starlark.IterableMapping)
+		if !ok {
+			return &DecodeError{path, value, rv.Type(), ""}
+		}
+		m := reflect.MakeMap(rv.Type())
+		for _, item := range dict.Items() {
+			k := reflect.New(rv.Type().Key()).Elem()
+			if err := decodeValue(item[0], k, fmt.Sprintf("%s[%s]", path, item[0])); err != nil {
+				return err
+			}
+			v := reflect.New(rv.Type().Elem()).Elem()
+			if err := decodeValue(item[1], v, fmt.Sprintf("%s[%s]", path, item[0])); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, v)
+		}
+		rv.Set(m)
+		return nil
+
+	case reflect.Struct:
+		return decodeStruct(value, rv, path)
+	}
+
+	return &DecodeError{path, value, rv.Type(), "unsupported Go type"}
+}
+
+func decodeStruct(value starlark.Value, rv reflect.Value, path string) error {
+	var lookup func(name string) (starlark.Value, bool, error)
+	var names []string
+
+	switch v := value.(type) {
+	case starlark.IterableMapping:
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return &DecodeError{path, value, rv.Type(), fmt.Sprintf("dict key %s is not a string", item[0])}
+			}
+			names = append(names, string(key))
+		}
+		lookup = func(name string) (starlark.Value, bool, error) {
+			return v.Get(starlark.String(name))
+		}
+	case starlark.HasAttrs:
+		names = v.AttrNames()
+		lookup = func(name string) (starlark.Value, bool, error) {
+			attr, err := v.Attr(name)
+			return attr, attr != nil, err
+		}
+	default:
+		return &DecodeError{path, value, rv.Type(), ""}
+	}
+
+	fields := structFields(rv.Type())
+	for _, name := range names {
+		index, ok := fields[name]
+		if !ok {
+			index, ok = fields[strings.ToLower(name)]
+		}
+		if !ok {
+			continue
+		}
+
+		fieldValue, found, err := lookup(name)
+		if err != nil {
+			return &DecodeError{path, value, rv.Type(), err.Error()}
+		}
+		if !found {
+			continue
+		}
+		if err := decodeValue(fieldValue, rv.FieldByIndex(index), path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structFields maps the names that a struct's fields can be decoded from to
+// the index of that field. Fields without a tag can also be matched case
+// insensitively through their lowercased name.
+func structFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("meta")
+		if tag == "-" {
+			continue
+		}
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			tag = tag[:comma]
+		}
+
+		flatten := f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct
+		if f.PkgPath != "" && !flatten {
+			// Unexported, and can't be set. The exported fields of an
+			// unexported embedded struct still can be.
+			continue
+		}
+
+		if flatten {
+			for name, index := range structFields(f.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = append([]int{i}, index...)
+				}
+			}
+			continue
+		}
+
+		if tag != "" {
+			fields[tag] = []int{i}
+		} else {
+			fields[f.Name] = []int{i}
+			if _, ok := fields[strings.ToLower(f.Name)]; !ok {
+				fields[strings.ToLower(f.Name)] = []int{i}
+			}
+		}
+	}
+	return fields
+}
+
+func sequenceItems(value starlark.Value) ([]starlark.Value, bool) {
+	iterable, ok := value.(starlark.Iterable)
+	if !ok {
+		return nil, false
+	}
+	switch value.(type) {
+	case *starlark.List, starlark.Tuple, *starlark.Set:
+	default:
+		return nil, false
+	}
+
+	items := make([]starlark.Value, 0)
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		items = append(items, item)
+	}
+	return items, true
+}
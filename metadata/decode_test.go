@@ -0,0 +1,201 @@
+package metadata
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+type decodeService struct {
+	Name    string
+	Tier    int
+	Owners  []string
+	Oncall  *string
+	Renamed string `meta:"other_name"`
+	Skipped string `meta:"-"`
+}
+
+type decodeTier int
+
+type decodeBase struct {
+	Tier int
+}
+
+type decodeEmbedded struct {
+	decodeTier
+	*decodeService
+	decodeBase
+	Name string
+}
+
+type upperString string
+
+func (u *upperString) UnmarshalStarlark(v starlark.Value) error {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return assert.AnError
+	}
+	*u = upperString("!" + s)
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	makeDict := func(kvs ...starlark.Value) *starlark.Dict {
+		d := starlark.NewDict(len(kvs) / 2)
+		for i := 0; i < len(kvs); i += 2 {
+			require.NoError(t, d.SetKey(kvs[i], kvs[i+1]))
+		}
+		return d
+	}
+	list := func(vals ...starlark.Value) *starlark.List {
+		return starlark.NewList(vals)
+	}
+
+	t.Run("scalars", func(t *testing.T) {
+		var i int
+		require.NoError(t, Decode(starlark.MakeInt(42), &i))
+		assert.Equal(t, 42, i)
+
+		var u uint8
+		require.NoError(t, Decode(starlark.MakeInt(200), &u))
+		assert.Equal(t, uint8(200), u)
+
+		var f float64
+		require.NoError(t, Decode(starlark.MakeInt(3), &f))
+		assert.Equal(t, 3.0, f)
+
+		var s string
+		require.NoError(t, Decode(starlark.String("abc"), &s))
+		assert.Equal(t, "abc", s)
+
+		var b bool
+		require.NoError(t, Decode(starlark.True, &b))
+		assert.True(t, b)
+
+		var big big.Int
+		require.NoError(t, Decode(starlark.MakeInt64(1<<62).Mul(starlark.MakeInt(4)), &big))
+		assert.Equal(t, "18446744073709551616", big.String())
+	})
+
+	t.Run("struct from dict", func(t *testing.T) {
+		var svc decodeService
+		svc.Skipped = "untouched"
+		err := Decode(makeDict(
+			starlark.String("name"), starlark.String("api"),
+			starlark.String("tier"), starlark.MakeInt(1),
+			starlark.String("owners"), list(starlark.String("alice")),
+			starlark.String("oncall"), starlark.String("bob"),
+			starlark.String("other_name"), starlark.String("renamed"),
+			starlark.String("Skipped"), starlark.String("nope"),
+			starlark.String("unknown"), starlark.MakeInt(1),
+		), &svc)
+		require.NoError(t, err)
+		oncall := "bob"
+		assert.Equal(t, decodeService{
+			Name:    "api",
+			Tier:    1,
+			Owners:  []string{"alice"},
+			Oncall:  &oncall,
+			Renamed: "renamed",
+			Skipped: "untouched",
+		}, svc)
+	})
+
+	t.Run("struct from starlark struct", func(t *testing.T) {
+		var svc decodeService
+		s := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name": starlark.String("api"),
+			"tier": starlark.MakeInt(2),
+		})
+		require.NoError(t, Decode(s, &svc))
+		assert.Equal(t, decodeService{Name: "api", Tier: 2}, svc)
+	})
+
+	t.Run("embedded unexported fields", func(t *testing.T) {
+		// Only the exported fields of unexported embedded structs can be set
+		var e decodeEmbedded
+		require.NoError(t, Decode(makeDict(
+			starlark.String("name"), starlark.String("api"),
+			starlark.String("tier"), starlark.MakeInt(3),
+			starlark.String("decodeTier"), starlark.MakeInt(4),
+			starlark.String("owners"), list(starlark.String("alice")),
+		), &e))
+		assert.Equal(t, decodeEmbedded{decodeBase: decodeBase{Tier: 3}, Name: "api"}, e)
+	})
+
+	t.Run("maps, slices and arrays", func(t *testing.T) {
+		var m map[string][]int
+		require.NoError(t, Decode(makeDict(
+			starlark.String("a"), starlark.Tuple{starlark.MakeInt(1), starlark.MakeInt(2)},
+		), &m))
+		assert.Equal(t, map[string][]int{"a": {1, 2}}, m)
+
+		var a [2]string
+		require.NoError(t, Decode(list(starlark.String("x"), starlark.String("y")), &a))
+		assert.Equal(t, [2]string{"x", "y"}, a)
+		assert.Error(t, Decode(list(starlark.String("x")), &a))
+	})
+
+	t.Run("none, interfaces and starlark values", func(t *testing.T) {
+		p := new(int)
+		require.NoError(t, Decode(starlark.None, &p))
+		assert.Nil(t, p)
+
+		var v starlark.Value
+		l := list(starlark.MakeInt(1))
+		require.NoError(t, Decode(l, &v))
+		assert.Same(t, l, v)
+
+		var i interface{}
+		require.NoError(t, Decode(l, &i))
+		assert.Equal(t, []interface{}{int64(1)}, i)
+	})
+
+	t.Run("unmarshaler", func(t *testing.T) {
+		var u []upperString
+		require.NoError(t, Decode(list(starlark.String("a")), &u))
+		assert.Equal(t, []upperString{"!a"}, u)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var svc decodeService
+		err := Decode(makeDict(
+			starlark.String("owners"), list(starlark.String("alice"), starlark.MakeInt(5)),
+		), &svc)
+		require.Error(t, err)
+		assert.Equal(t, "Cannot decode starlark int into Go string at .owners[1]", err.Error())
+
+		var small int8
+		err = Decode(starlark.MakeInt(1000), &small)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "overflows int8")
+
+		assert.Error(t, Decode(starlark.MakeInt(1), small))
+		assert.Error(t, Decode(starlark.MakeInt(-1), new(uint)))
+	})
+}
+
+func TestGetInto(t *testing.T) {
+	tree, err := NewEagerTree("../test_data/decode")
+	require.NoError(t, err)
+
+	var svc decodeService
+	require.NoError(t, tree.GetInto("main.go", "service", &svc))
+	assert.Equal(t, decodeService{
+		Name:   "api",
+		Tier:   1,
+		Owners: []string{"alice", "bob"},
+	}, svc)
+
+	var wrong []string
+	err = tree.GetInto("main.go", "service", &wrong)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot decode 'service' metadata for 'main.go'")
+
+	err = tree.GetInto("main.go", "missing", &wrong)
+	assert.IsType(t, NoMetadataFoundError{}, err)
+}
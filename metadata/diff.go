@@ -0,0 +1,161 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// ChangeKind is how the value of a metadata key for a file changed
+type ChangeKind string
+
+const (
+	ValueAdded   ChangeKind = "added"
+	ValueRemoved ChangeKind = "removed"
+	ValueChanged ChangeKind = "changed"
+)
+
+// ValueDiff is a change to the merged value of a metadata key for a file. Old
+// is nil for added values and New is nil for removed ones.
+type ValueDiff struct {
+	Path string
+	Key  string
+	Kind ChangeKind
+	Old  starlark.Value
+	New  starlark.Value
+}
+
+// DiffTrees compares the merged values of every file between two trees, and
+// returns the values that differ, sorted by file and key. oldFiles and
+// newFiles are the files that exist in each tree: every value of a file that
+// was added is reported as added, and every value of a file that was deleted
+// as removed. If keys is nil, every key is compared.
+func DiffTrees(old, new Tree, oldFiles, newFiles []string, keys []string) ([]ValueDiff, error) {
+	return DiffTreesContext(context.Background(), old, new, oldFiles, newFiles, keys)
+}
+
+// DiffTreesContext is DiffTrees, but stops merging once ctx is done
+func DiffTreesContext(ctx context.Context, old, new Tree, oldFiles, newFiles []string, keys []string) ([]ValueDiff, error) {
+	inOld := make(StringSet)
+	for _, file := range oldFiles {
+		inOld.Add(file)
+	}
+	inNew := make(StringSet)
+	for _, file := range newFiles {
+		inNew.Add(file)
+	}
+
+	sorted := append(append([]string{}, oldFiles...), newFiles...)
+	sort.Strings(sorted)
+
+	diffs := make([]ValueDiff, 0)
+	for i, file := range sorted {
+		if i > 0 && sorted[i-1] == file {
+			continue
+		}
+
+		// A tree only has metadata for the files that exist in it
+		oldValues := map[string]starlark.Value{}
+		if inOld.Contains(file) {
+			values, err := old.GetManyContext(ctx, file, keys)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot get old metadata for '%s': %w", file, err)
+			}
+			oldValues = values
+		}
+		newValues := map[string]starlark.Value{}
+		if inNew.Contains(file) {
+			values, err := new.GetManyContext(ctx, file, keys)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot get new metadata for '%s': %w", file, err)
+			}
+			newValues = values
+		}
+
+		fileKeys := make([]string, 0, len(oldValues)+len(newValues))
+		for key := range oldValues {
+			fileKeys = append(fileKeys, key)
+		}
+		for key := range newValues {
+			if _, ok := oldValues[key]; !ok {
+				fileKeys = append(fileKeys, key)
+			}
+		}
+		sort.Strings(fileKeys)
+
+		for _, key := range fileKeys {
+			oldValue, inOld := oldValues[key]
+			newValue, inNew := newValues[key]
+			switch {
+			case !inOld:
+				diffs = append(diffs, ValueDiff{Path: file, Key: key, Kind: ValueAdded, New: newValue})
+			case !inNew:
+				diffs = append(diffs, ValueDiff{Path: file, Key: key, Kind: ValueRemoved, Old: oldValue})
+			case !valuesEqual(oldValue, newValue):
+				diffs = append(diffs, ValueDiff{Path: file, Key: key, Kind: ValueChanged, Old: oldValue, New: newValue})
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// valuesEqual compares values from different trees. Values that can't be
+// compared, like functions, are compared by how they print.
+func valuesEqual(a, b starlark.Value) bool {
+	equal, err := starlark.Equal(a, b)
+	if err != nil {
+		return a.String() == b.String()
+	}
+	return equal
+}
+
+// WriteDiffMarkdown writes a report of changed values as a Markdown table, for
+// posting in code review
+func WriteDiffMarkdown(w io.Writer, diffs []ValueDiff) error {
+	if len(diffs) == 0 {
+		_, err := fmt.Fprintln(w, "No metadata values changed.")
+		return err
+	}
+
+	files := make(StringSet)
+	for _, diff := range diffs {
+		files.Add(diff.Path)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d metadata values changed in %d files.\n\n", len(diffs), len(files))
+	b.WriteString("| File | Key | Change | Before | After |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, diff := range diffs {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n",
+			markdownCode(diff.Path), markdownCode(diff.Key), diff.Kind,
+			markdownValue(diff.Old), markdownValue(diff.New))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func markdownValue(v starlark.Value) string {
+	if v == nil {
+		return ""
+	}
+	j, err := JsonEncoder{NonFinite: NonFiniteString}.Marshal(v)
+	if err != nil {
+		return markdownCode(v.String())
+	}
+	return markdownCode(j)
+}
+
+// markdownCode formats text as inline code that is safe to put in a table cell
+func markdownCode(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	s = strings.ReplaceAll(s, "\n", " ")
+	if strings.Contains(s, "`") {
+		return "`` " + s + " ``"
+	}
+	return "`" + s + "`"
+}
@@ -0,0 +1,57 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+func TestDiffTrees(t *testing.T) {
+	oldRoot, newRoot := t.TempDir(), t.TempDir()
+	writeFiles(t, oldRoot, map[string]string{
+		"METADATA":     "metadata(key=\"team\", value=\"x\")\n",
+		"one/METADATA": "metadata(key=\"tier\", value=1)\n",
+	})
+	writeFiles(t, newRoot, map[string]string{
+		"METADATA":     "metadata(key=\"lang\", value=\"go\")\n",
+		"one/METADATA": "metadata(key=\"tier\", value=1)\nmetadata(key=\"team\", value=\"x\")\n",
+		"two/METADATA": "metadata(key=\"tier\", value=2)\n",
+	})
+	oldTree, err := NewEagerTree(oldRoot)
+	require.NoError(t, err)
+	newTree, err := NewEagerTree(newRoot)
+	require.NoError(t, err)
+
+	// deleted.txt only exists in the old tree and added.txt only in the new
+	// one, so all of their values were removed or added
+	oldFiles := []string{"two/b.txt", "one/a.txt", "deleted.txt"}
+	newFiles := []string{"one/a.txt", "two/b.txt", "added.txt"}
+	diffs, err := DiffTrees(oldTree, newTree, oldFiles, newFiles, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []ValueDiff{
+		{Path: "added.txt", Key: "lang", Kind: ValueAdded, New: starlark.String("go")},
+		{Path: "deleted.txt", Key: "team", Kind: ValueRemoved, Old: starlark.String("x")},
+		{Path: "one/a.txt", Key: "lang", Kind: ValueAdded, New: starlark.String("go")},
+		{Path: "two/b.txt", Key: "lang", Kind: ValueAdded, New: starlark.String("go")},
+		{Path: "two/b.txt", Key: "team", Kind: ValueRemoved, Old: starlark.String("x")},
+		{Path: "two/b.txt", Key: "tier", Kind: ValueAdded, New: starlark.MakeInt(2)},
+	}, diffs)
+
+	diffs, err = DiffTrees(oldTree, newTree, []string{"two/b.txt"}, []string{"two/b.txt"}, []string{"tier"})
+	require.NoError(t, err)
+	require.Len(t, diffs, 1)
+
+	var b bytes.Buffer
+	require.NoError(t, WriteDiffMarkdown(&b, diffs))
+	assert.Equal(t, "1 metadata values changed in 1 files.\n\n"+
+		"| File | Key | Change | Before | After |\n"+
+		"| --- | --- | --- | --- | --- |\n"+
+		"| `two/b.txt` | `tier` | added |  | `2` |\n", b.String())
+
+	b.Reset()
+	require.NoError(t, WriteDiffMarkdown(&b, nil))
+	assert.Equal(t, "No metadata values changed.\n", b.String())
+}
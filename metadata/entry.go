@@ -1,6 +1,12 @@
 package metadata
 
-import "go.starlark.net/starlark"
+import (
+	"context"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
 
 type StringSet map[string]struct{}
 
@@ -36,14 +42,43 @@ func (f FileMatchSet) IsEmpty() bool {
 	return len(f.exactMatches) == 0 && len(f.patternMatches) == 0
 }
 
-type VerticalMergeFunc func(upper, lower starlark.Value) (starlark.Value, error)
-type HorizontalMergeFunc func(left, right starlark.Value) (starlark.Value, error)
+// ExactMatches returns the repo-relative paths of the files that were listed
+// by name, in sorted order.
+func (f FileMatchSet) ExactMatches() []string {
+	matches := make([]string, 0, len(f.exactMatches))
+	for m := range f.exactMatches {
+		matches = append(matches, m)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// Globs returns the glob patterns in the order they were listed
+func (f FileMatchSet) Globs() []*Glob {
+	globs := make([]*Glob, len(f.patternMatches))
+	copy(globs, f.patternMatches)
+	return globs
+}
+
+// VerticalMergeFunc merges the value of a key from a METADATA file into the
+// value from a METADATA file below it. Merging stops once ctx is done.
+type VerticalMergeFunc func(ctx context.Context, upper, lower starlark.Value) (starlark.Value, error)
+
+// HorizontalMergeFunc merges two values of a key from the same METADATA file.
+// Merging stops once ctx is done.
+type HorizontalMergeFunc func(ctx context.Context, left, right starlark.Value) (starlark.Value, error)
 
 // TODO: add "applies to file" function
 type Entry struct {
 	key   string
 	value starlark.Value
 
+	// repo-relative path of the METADATA file that defined this entry
+	file string
+
+	// where in the METADATA file the entry was defined
+	pos syntax.Position
+
 	// files that this metadata entry applies to. If empty, apply to all files
 	// this contains the full path relative to the root of the repo of any files
 	// that match
@@ -52,6 +87,40 @@ type Entry struct {
 	mergeHorizontally HorizontalMergeFunc
 }
 
+// Key returns the metadata key that this entry sets
+func (e *Entry) Key() string {
+	return e.key
+}
+
+// Value returns the value of this entry as it was written in the METADATA
+// file, before any merging has been done
+func (e *Entry) Value() starlark.Value {
+	return e.value
+}
+
+// FileMatchSet returns the set of files that this entry is limited to. An
+// empty set means that the entry applies to all files.
+func (e *Entry) FileMatchSet() *FileMatchSet {
+	return e.fileMatchSet
+}
+
+// File returns the repo-relative path of the METADATA file that defined this
+// entry
+func (e *Entry) File() string {
+	return e.file
+}
+
+// Position returns where in its METADATA file this entry was defined
+func (e *Entry) Position() syntax.Position {
+	return e.pos
+}
+
+// AppliesTo reports whether this entry applies to the given repo-relative
+// file path
+func (e *Entry) AppliesTo(filePath string) bool {
+	return e.isAppliedToFile(filePath)
+}
+
 func (e *Entry) isAppliedToFile(filePath string) bool {
 	return e.fileMatchSet.IsEmpty() || e.fileMatchSet.Matches(filePath)
 }
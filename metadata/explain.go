@@ -0,0 +1,107 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// Explanation shows how the merged value of a metadata key for a file was
+// built up from the METADATA files above it
+type Explanation struct {
+	File string
+	Key  string
+
+	// Levels has one item for each METADATA file with entries that apply to
+	// the file, from the root of the repo down
+	Levels []ExplainLevel
+
+	// Value is the final merged value, or nil if no entries apply
+	Value starlark.Value
+}
+
+type ExplainLevel struct {
+	// MetadataFile is the repo-relative path of the METADATA file
+	MetadataFile string
+
+	// Entries are the entries in the METADATA file that apply to the file
+	Entries []Entry
+
+	// Value is the result of horizontally merging Entries
+	Value starlark.Value
+
+	// Merged is the result of vertically merging Value with the values of
+	// the levels above it
+	Merged starlark.Value
+}
+
+// Explain returns how the merged value of a metadata key for a file is made.
+// If no entries apply to the file, the explanation has no levels and a nil
+// value.
+func (m *MetadataTree) Explain(filePath string, key string) (*Explanation, error) {
+	return m.ExplainContext(context.Background(), filePath, key)
+}
+
+// ExplainContext is Explain, but stops merging once ctx is done
+func (m *MetadataTree) ExplainContext(ctx context.Context, filePath string, key string) (*Explanation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot explain '%s' metadata for '%s': %w", key, filePath, err)
+	}
+	if err := m.checkTainted(filePath); err != nil {
+		return nil, err
+	}
+	explanation := &Explanation{
+		File:   filePath,
+		Key:    key,
+		Levels: make([]ExplainLevel, 0),
+	}
+
+	var mergeVertically VerticalMergeFunc
+	stack := make([]starlark.Value, 0)
+	files := make([]string, 0)
+	currentTree := m
+	for _, dirPart := range strings.Split(filePath, string(filepath.Separator)) {
+		if entries, ok := currentTree.entryMap[key]; ok {
+			value, first, err := m.resolveSiblingEntries(ctx, entries, filePath)
+			if err != nil {
+				return nil, err
+			}
+			if first != nil {
+				level := ExplainLevel{
+					MetadataFile: first.file,
+					Value:        value,
+				}
+				for _, entry := range entries {
+					if entry.isAppliedToFile(filePath) {
+						level.Entries = append(level.Entries, entry)
+					}
+				}
+
+				if mergeVertically == nil {
+					mergeVertically = first.mergeVertically
+				}
+				stack = append(stack, value)
+				files = append(files, first.file)
+				level.Merged, err = mergeVerticalStack(ctx, stack, files, mergeVertically)
+				if err != nil {
+					return nil, err
+				}
+				explanation.Levels = append(explanation.Levels, level)
+			}
+		}
+
+		var nextSubtreeExists bool
+		currentTree, nextSubtreeExists = currentTree.subTrees[dirPart]
+		if !nextSubtreeExists {
+			break
+		}
+	}
+
+	if len(explanation.Levels) > 0 {
+		explanation.Value = explanation.Levels[len(explanation.Levels)-1].Merged
+	}
+	return explanation, nil
+}
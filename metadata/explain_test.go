@@ -0,0 +1,38 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	tree, err := NewEagerTree("../test_data/horizontal_and_vertical_merge")
+	require.NoError(t, err)
+
+	explanation, err := tree.Explain("one/main.py", "owners")
+	require.NoError(t, err)
+	require.Len(t, explanation.Levels, 2)
+
+	root := explanation.Levels[0]
+	assert.Equal(t, "METADATA", root.MetadataFile)
+	assert.Len(t, root.Entries, 2)
+	assert.Equal(t, `["alice", "bob"]`, root.Value.String())
+	assert.Equal(t, `["alice", "bob"]`, root.Merged.String())
+
+	one := explanation.Levels[1]
+	assert.Equal(t, "one/METADATA", one.MetadataFile)
+	assert.Len(t, one.Entries, 1)
+	assert.Equal(t, `["carol"]`, one.Value.String())
+	assert.Equal(t, `["carol", "alice", "bob"]`, one.Merged.String())
+
+	merged, err := tree.GetMergedValue("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, merged.String(), explanation.Value.String())
+
+	explanation, err = tree.Explain("main.py", "missing")
+	require.NoError(t, err)
+	assert.Empty(t, explanation.Levels)
+	assert.Nil(t, explanation.Value)
+}
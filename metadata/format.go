@@ -0,0 +1,646 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"gopkg.in/yaml.v3"
+)
+
+// Encoder writes metadata values in an output format
+type Encoder interface {
+	// EncodeValue writes a single value
+	EncodeValue(w io.Writer, v starlark.Value) error
+
+	// EncodeFileMap writes the value of each file, sorted by file path
+	EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error
+}
+
+var encoders = map[string]Encoder{
+	"json":  JsonEncoder{},
+	"jsonl": JsonLinesEncoder{},
+	"yaml":  YamlEncoder{},
+	"toml":  TomlEncoder{},
+	"csv":   CsvEncoder{Comma: ','},
+	"tsv":   CsvEncoder{Comma: '\t'},
+	"table": TableEncoder{},
+}
+
+// RegisterEncoder makes an encoder available by name through EncoderFor,
+// replacing any encoder already registered with that name. It is not safe to
+// call concurrently with EncoderFor, so it should be called from init.
+func RegisterEncoder(name string, e Encoder) {
+	encoders[name] = e
+}
+
+// EncoderFor returns the encoder registered for a format name
+func EncoderFor(name string) (Encoder, error) {
+	e, ok := encoders[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown output format '%s', expected one of: %s", name, strings.Join(EncoderNames(), ", "))
+	}
+	return e, nil
+}
+
+// EncoderNames returns the names of every registered encoder, sorted
+func EncoderNames() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e JsonEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	return e.Encode(w, v)
+}
+
+func (e JsonEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	return e.Encode(w, FileMapToValue(fileMap))
+}
+
+// JsonLinesEncoder writes one JSON value per line. Lists, tuples and sets are
+// written one item per line, and file maps are written as one
+// {"file": ..., "value": ...} object per line.
+type JsonLinesEncoder struct {
+	NonFinite NonFinitePolicy
+}
+
+func (e JsonLinesEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	enc := JsonEncoder{NonFinite: e.NonFinite}
+	items, ok := sequenceItems(v)
+	if !ok {
+		return enc.Encode(w, v)
+	}
+	for _, item := range items {
+		if err := enc.Encode(w, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e JsonLinesEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	enc := JsonEncoder{NonFinite: e.NonFinite}
+	for _, item := range FileMapToValue(fileMap).Items() {
+		line := starlark.NewDict(2)
+		_ = line.SetKey(starlark.String("file"), item[0])
+		_ = line.SetKey(starlark.String("value"), item[1])
+		if err := enc.Encode(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// YamlEncoder writes values as a YAML document. Dicts and structs keep their
+// order.
+type YamlEncoder struct{}
+
+func (e YamlEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	node, err := valueToYamlNode(v)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (e YamlEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	return e.EncodeValue(w, FileMapToValue(fileMap))
+}
+
+func valueToYamlNode(v starlark.Value) (*yaml.Node, error) {
+	scalar := func(tag, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+	}
+
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return scalar("!!null", "null"), nil
+	case starlark.Bool:
+		return scalar("!!bool", strconv.FormatBool(bool(v))), nil
+	case starlark.Int:
+		return scalar("!!int", v.String()), nil
+	case starlark.Float:
+		f := float64(v)
+		switch {
+		case math.IsNaN(f):
+			return scalar("!!float", ".nan"), nil
+		case math.IsInf(f, 1):
+			return scalar("!!float", ".inf"), nil
+		case math.IsInf(f, -1):
+			return scalar("!!float", "-.inf"), nil
+		}
+		return scalar("!!float", formatFloat(f)), nil
+	case starlark.String:
+		return scalar("!!str", string(v)), nil
+	case starlark.Bytes:
+		return scalar("!!binary", base64.StdEncoding.EncodeToString([]byte(v))), nil
+	case *StarlarkGlob:
+		return scalar("!!str", v.impl.pattern), nil
+	}
+
+	items, err := mappingItems(v)
+	if err != nil {
+		return nil, err
+	}
+	if items != nil {
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, item := range items {
+			valueNode, err := valueToYamlNode(item.value)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot convert value of %s to yaml: %v", item.key, err)
+			}
+			node.Content = append(node.Content, scalar("!!str", item.key), valueNode)
+		}
+		return node, nil
+	}
+
+	if seq, ok := sequenceItems(v); ok {
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range seq {
+			itemNode, err := valueToYamlNode(item)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, itemNode)
+		}
+		return node, nil
+	}
+
+	return nil, fmt.Errorf("Do not know how to convert %s to yaml", v.Type())
+}
+
+type mappingItem struct {
+	key   string
+	value starlark.Value
+}
+
+// mappingItems returns the items of a dict or struct, with dict keys converted
+// to strings the same way as JsonEncoder. Returns nil if v is neither.
+func mappingItems(v starlark.Value) ([]mappingItem, error) {
+	switch v := v.(type) {
+	case *starlark.Dict:
+		items := make([]mappingItem, 0, v.Len())
+		for _, item := range v.Items() {
+			key, err := JsonEncoder{NonFinite: NonFiniteString}.dictKey(item[0])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, mappingItem{key, item[1]})
+		}
+		return items, nil
+	case *starlarkstruct.Struct:
+		items := make([]mappingItem, 0)
+		for _, name := range v.AttrNames() {
+			attr, err := v.Attr(name)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, mappingItem{name, attr})
+		}
+		return items, nil
+	}
+	return nil, nil
+}
+
+// TomlEncoder writes values as a TOML document. TOML documents must be tables,
+// so values that aren't dicts are written under the key "value". TOML has no
+// null, so None values in tables are left out and None values in arrays are an
+// error.
+type TomlEncoder struct{}
+
+func (e TomlEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	items, err := mappingItems(v)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []mappingItem{{"value", v}}
+	}
+	return writeTomlTable(&tomlWriter{w: w}, nil, items)
+}
+
+func (e TomlEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	return e.EncodeValue(w, FileMapToValue(fileMap))
+}
+
+// tomlWriter keeps track of whether anything has been written, so that the
+// first table header isn't preceded by a blank line
+type tomlWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (t *tomlWriter) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.w.Write(p)
+}
+
+func writeTomlTable(w *tomlWriter, path []string, items []mappingItem) error {
+	// Plain keys have to come before any sub-tables, or they would become
+	// part of the sub-table
+	subTables := make([]mappingItem, 0)
+	for _, item := range items {
+		if item.value == starlark.None {
+			continue
+		}
+		if _, ok := item.value.(*starlark.Dict); ok {
+			subTables = append(subTables, item)
+			continue
+		}
+		if _, ok := item.value.(*starlarkstruct.Struct); ok {
+			subTables = append(subTables, item)
+			continue
+		}
+
+		value, err := tomlValue(item.value)
+		if err != nil {
+			return fmt.Errorf("Cannot convert value of %s to toml: %v", item.key, err)
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", tomlKey(item.key), value); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range subTables {
+		tablePath := append(append([]string{}, path...), tomlKey(table.key))
+		items, err := mappingItems(table.value)
+		if err != nil {
+			return err
+		}
+		if w.wrote {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "[%s]\n", strings.Join(tablePath, ".")); err != nil {
+			return err
+		}
+		if err := writeTomlTable(w, tablePath, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var bareTomlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(key string) string {
+	if bareTomlKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlString(s string) string {
+	b := strings.Builder{}
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tomlValue(v starlark.Value) (string, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return "", fmt.Errorf("toml has no null value")
+	case starlark.Bool:
+		return strconv.FormatBool(bool(v)), nil
+	case starlark.Int:
+		if _, ok := v.Int64(); !ok {
+			return "", fmt.Errorf("%s does not fit in a 64 bit toml integer", v)
+		}
+		return v.String(), nil
+	case starlark.Float:
+		f := float64(v)
+		switch {
+		case math.IsNaN(f):
+			return "nan", nil
+		case math.IsInf(f, 1):
+			return "inf", nil
+		case math.IsInf(f, -1):
+			return "-inf", nil
+		}
+		return formatFloat(f), nil
+	case starlark.String:
+		return tomlString(string(v)), nil
+	case starlark.Bytes:
+		return tomlString(base64.StdEncoding.EncodeToString([]byte(v))), nil
+	case *StarlarkGlob:
+		return tomlString(v.impl.pattern), nil
+	}
+
+	items, err := mappingItems(v)
+	if err != nil {
+		return "", err
+	}
+	if items != nil {
+		parts := make([]string, 0, len(items))
+		for _, item := range items {
+			if item.value == starlark.None {
+				continue
+			}
+			value, err := tomlValue(item.value)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, tomlKey(item.key)+" = "+value)
+		}
+		if len(parts) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	}
+
+	if seq, ok := sequenceItems(v); ok {
+		parts := make([]string, 0, len(seq))
+		for _, item := range seq {
+			value, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, value)
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	}
+
+	return "", fmt.Errorf("Do not know how to convert %s to toml", v.Type())
+}
+
+// CsvEncoder writes flat values as comma (or Comma) separated rows. Lists of
+// dicts are written as one row per dict with a header of their keys, file maps
+// are written as file,value rows (or with a column per key if every value is a
+// dict), and other lists are written one item per row. Values nested inside a
+// cell are an error.
+type CsvEncoder struct {
+	Comma rune
+}
+
+func (e CsvEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	header, rows, err := tabulate(v)
+	if err != nil {
+		return err
+	}
+	return e.write(w, header, rows)
+}
+
+func (e CsvEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	header, rows, err := tabulateFileMap(fileMap)
+	if err != nil {
+		return err
+	}
+	return e.write(w, header, rows)
+}
+
+func (e CsvEncoder) write(w io.Writer, header []string, rows [][]starlark.Value) error {
+	cw := csv.NewWriter(w)
+	if e.Comma != 0 {
+		cw.Comma = e.Comma
+	}
+
+	if header != nil {
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			s, ok := scalarString(cell)
+			if !ok {
+				return fmt.Errorf("Cannot write %s value %s as a csv cell, only flat values are supported", cell.Type(), cell)
+			}
+			record[i] = s
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// TableEncoder writes values as a human readable table with aligned columns.
+// Lists of scalars inside a cell are joined with commas, and other nested values
+// are written as JSON.
+type TableEncoder struct{}
+
+func (e TableEncoder) EncodeValue(w io.Writer, v starlark.Value) error {
+	header, rows, err := tabulate(v)
+	if err != nil {
+		return err
+	}
+	return e.write(w, header, rows)
+}
+
+func (e TableEncoder) EncodeFileMap(w io.Writer, fileMap map[string]starlark.Value) error {
+	header, rows, err := tabulateFileMap(fileMap)
+	if err != nil {
+		return err
+	}
+	return e.write(w, header, rows)
+}
+
+func (e TableEncoder) write(w io.Writer, header []string, rows [][]starlark.Value) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if header != nil {
+		upper := make([]string, len(header))
+		for i, h := range header {
+			upper[i] = strings.ToUpper(h)
+		}
+		fmt.Fprintln(tw, strings.Join(upper, "\t"))
+	}
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = humanString(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// tabulate splits a value into rows for the csv and table encoders. A nil
+// header means the rows are unnamed values.
+func tabulate(v starlark.Value) ([]string, [][]starlark.Value, error) {
+	items, err := mappingItems(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	if items != nil {
+		rows := make([][]starlark.Value, 0, len(items))
+		for _, item := range items {
+			rows = append(rows, []starlark.Value{starlark.String(item.key), item.value})
+		}
+		return []string{"key", "value"}, rows, nil
+	}
+
+	seq, ok := sequenceItems(v)
+	if !ok {
+		return nil, [][]starlark.Value{{v}}, nil
+	}
+
+	records := make([][]mappingItem, 0, len(seq))
+	for _, item := range seq {
+		record, err := mappingItems(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		if record == nil {
+			records = nil
+			break
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		rows := make([][]starlark.Value, 0, len(seq))
+		for _, item := range seq {
+			rows = append(rows, []starlark.Value{item})
+		}
+		return nil, rows, nil
+	}
+
+	// The columns are every key used by any record, in the order they are
+	// first seen
+	header := make([]string, 0)
+	columns := make(map[string]int)
+	for _, record := range records {
+		for _, item := range record {
+			if _, ok := columns[item.key]; !ok {
+				columns[item.key] = len(header)
+				header = append(header, item.key)
+			}
+		}
+	}
+
+	rows := make([][]starlark.Value, 0, len(records))
+	for _, record := range records {
+		row := make([]starlark.Value, len(header))
+		for i := range row {
+			row[i] = starlark.None
+		}
+		for _, item := range record {
+			row[columns[item.key]] = item.value
+		}
+		rows = append(rows, row)
+	}
+	return header, rows, nil
+}
+
+// tabulateFileMap splits a file map into file,value rows. If every value is a
+// dict, like the result of a multi-key query, the keys of the dicts become
+// columns instead.
+func tabulateFileMap(fileMap map[string]starlark.Value) ([]string, [][]starlark.Value, error) {
+	items := FileMapToValue(fileMap).Items()
+
+	records := make([]starlark.Value, 0, len(items))
+	for _, item := range items {
+		record := starlark.NewDict(0)
+		_ = record.SetKey(starlark.String("file"), item[0])
+
+		fields, err := mappingItems(item[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		if fields == nil {
+			records = nil
+			break
+		}
+		for _, field := range fields {
+			_ = record.SetKey(starlark.String(field.key), field.value)
+		}
+		records = append(records, record)
+	}
+	if len(records) > 0 {
+		return tabulate(starlark.NewList(records))
+	}
+
+	rows := make([][]starlark.Value, 0, len(items))
+	for _, item := range items {
+		rows = append(rows, []starlark.Value{item[0], item[1]})
+	}
+	return []string{"file", "value"}, rows, nil
+}
+
+// scalarString returns the text of a value that fits in a single cell
+func scalarString(v starlark.Value) (string, bool) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return "", true
+	case starlark.String:
+		return string(v), true
+	case starlark.Bytes:
+		return base64.StdEncoding.EncodeToString([]byte(v)), true
+	case starlark.Float:
+		return formatFloat(float64(v)), true
+	case *StarlarkGlob:
+		return v.impl.pattern, true
+	case starlark.Bool, starlark.Int:
+		return v.String(), true
+	}
+	return "", false
+}
+
+func humanString(v starlark.Value) string {
+	if s, ok := scalarString(v); ok {
+		return s
+	}
+
+	if seq, ok := sequenceItems(v); ok {
+		parts := make([]string, 0, len(seq))
+		for _, item := range seq {
+			s, ok := scalarString(item)
+			if !ok {
+				parts = nil
+				break
+			}
+			parts = append(parts, s)
+		}
+		if parts != nil {
+			return strings.Join(parts, ", ")
+		}
+	}
+
+	j, err := JsonEncoder{NonFinite: NonFiniteString}.Marshal(v)
+	if err != nil {
+		return v.String()
+	}
+	return j
+}
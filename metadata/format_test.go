@@ -0,0 +1,130 @@
+package metadata
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+func TestEncoders(t *testing.T) {
+	owners := starlark.NewList([]starlark.Value{starlark.String("alice"), starlark.String("bob")})
+	service := starlark.NewDict(0)
+	require.NoError(t, service.SetKey(starlark.String("name"), starlark.String("api")))
+	require.NoError(t, service.SetKey(starlark.String("tier"), starlark.MakeInt(1)))
+	require.NoError(t, service.SetKey(starlark.String("oncall"), starlark.None))
+
+	fileMap := map[string]starlark.Value{
+		"b/main.go": starlark.MakeInt(90),
+		"a.txt":     starlark.None,
+	}
+
+	tests := []struct {
+		format   string
+		value    starlark.Value
+		expected string
+	}{
+		{"json", service, `{"name":"api","tier":1,"oncall":null}` + "\n"},
+		{"jsonl", owners, "\"alice\"\n\"bob\"\n"},
+		{"yaml", service, "name: api\ntier: 1\noncall: null\n"},
+		{"yaml", starlark.Float(math.Inf(1)), ".inf\n"},
+		{"toml", service, "name = \"api\"\ntier = 1\n"},
+		{"toml", owners, "value = [\"alice\", \"bob\"]\n"},
+		{"csv", starlark.MakeInt(5), "5\n"},
+		{"csv", owners, "alice\nbob\n"},
+		{"csv", starlark.NewList([]starlark.Value{service, service}), "name,tier,oncall\napi,1,\napi,1,\n"},
+		{"tsv", service, "key\tvalue\nname\tapi\ntier\t1\noncall\t\n"},
+		{"table", service, "KEY     VALUE\nname    api\ntier    1\noncall  \n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+" "+tt.value.String(), func(t *testing.T) {
+			encoder, err := EncoderFor(tt.format)
+			require.NoError(t, err)
+
+			var b bytes.Buffer
+			require.NoError(t, encoder.EncodeValue(&b, tt.value))
+			assert.Equal(t, tt.expected, b.String())
+		})
+	}
+
+	fileMapTests := []struct {
+		format   string
+		expected string
+	}{
+		{"json", `{"a.txt":null,"b/main.go":90}` + "\n"},
+		{"jsonl", `{"file":"a.txt","value":null}` + "\n" + `{"file":"b/main.go","value":90}` + "\n"},
+		{"yaml", "a.txt: null\nb/main.go: 90\n"},
+		{"toml", "\"b/main.go\" = 90\n"},
+		{"csv", "file,value\na.txt,\nb/main.go,90\n"},
+		{"table", "FILE       VALUE\na.txt      \nb/main.go  90\n"},
+	}
+	for _, tt := range fileMapTests {
+		t.Run(tt.format+" file map", func(t *testing.T) {
+			encoder, err := EncoderFor(tt.format)
+			require.NoError(t, err)
+
+			var b bytes.Buffer
+			require.NoError(t, encoder.EncodeFileMap(&b, fileMap))
+			assert.Equal(t, tt.expected, b.String())
+		})
+	}
+}
+
+func TestTomlEncoderTables(t *testing.T) {
+	service := starlark.NewDict(0)
+	require.NoError(t, service.SetKey(starlark.String("name"), starlark.String("api \"v2\"")))
+	require.NoError(t, service.SetKey(starlark.String("owners"), starlark.NewList([]starlark.Value{starlark.String("alice")})))
+
+	var b bytes.Buffer
+	err := TomlEncoder{}.EncodeFileMap(&b, map[string]starlark.Value{
+		"main.go": service,
+		"other":   starlark.MakeInt(1),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "other = 1\n\n[\"main.go\"]\nname = \"api \\\"v2\\\"\"\nowners = [\"alice\"]\n", b.String())
+
+	// Nothing comes before the first table
+	b.Reset()
+	err = TomlEncoder{}.EncodeFileMap(&b, map[string]starlark.Value{"main.go": service})
+	require.NoError(t, err)
+	assert.Equal(t, "[\"main.go\"]\nname = \"api \\\"v2\\\"\"\nowners = [\"alice\"]\n", b.String())
+
+	b.Reset()
+	err = TomlEncoder{}.EncodeValue(&b, starlark.NewList([]starlark.Value{starlark.None}))
+	assert.Error(t, err)
+}
+
+func TestEncodeFileMapOfDicts(t *testing.T) {
+	row := func(owners string, tier int) starlark.Value {
+		d := starlark.NewDict(2)
+		require.NoError(t, d.SetKey(starlark.String("owners"), starlark.String(owners)))
+		if tier > 0 {
+			require.NoError(t, d.SetKey(starlark.String("tier"), starlark.MakeInt(tier)))
+		}
+		return d
+	}
+	fileMap := map[string]starlark.Value{
+		"a.txt": row("alice", 1),
+		"b.txt": row("bob", 0),
+	}
+
+	var b bytes.Buffer
+	require.NoError(t, CsvEncoder{}.EncodeFileMap(&b, fileMap))
+	assert.Equal(t, "file,owners,tier\na.txt,alice,1\nb.txt,bob,\n", b.String())
+
+	b.Reset()
+	require.NoError(t, TomlEncoder{}.EncodeFileMap(&b, fileMap))
+	assert.Equal(t, "[\"a.txt\"]\nowners = \"alice\"\ntier = 1\n\n[\"b.txt\"]\nowners = \"bob\"\n", b.String())
+}
+
+func TestEncoderErrors(t *testing.T) {
+	_, err := EncoderFor("xml")
+	assert.Error(t, err)
+
+	nested := starlark.NewList([]starlark.Value{starlark.NewList(nil)})
+	var b bytes.Buffer
+	assert.Error(t, CsvEncoder{}.EncodeValue(&b, nested))
+}
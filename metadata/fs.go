@@ -0,0 +1,96 @@
+package metadata
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Filesystems that a Repo can be read from, with WithFS or Repo.FS. Besides
+// these, os.DirFS reads a directory on disk, which is what a Repo without an
+// FS uses, and NewGitFS reads a revision of a git repository.
+
+// NewMapFS returns a filesystem with the given contents for each file, keyed by
+// slash-separated path. It is meant for tests that shouldn't touch the disk.
+func NewMapFS(files map[string]string) fs.FS {
+	m := newMemFS()
+	for name, contents := range files {
+		data := []byte(contents)
+		m.addFile(path.Clean(name), 0644, int64(len(data)), func() ([]byte, error) {
+			return data, nil
+		})
+	}
+	return m
+}
+
+// NewArchiveFS returns a filesystem with the files in a .zip, .tar, .tar.gz or
+// .tgz archive. Use fs.Sub if the repo is in a directory of the archive.
+func NewArchiveFS(archivePath string) (fs.FS, error) {
+	data, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(archivePath, ".zip"):
+		return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	case strings.HasSuffix(archivePath, ".tar.gz") || strings.HasSuffix(archivePath, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read %s: %v", archivePath, err)
+		}
+		return NewTarFS(gz)
+	case strings.HasSuffix(archivePath, ".tar"):
+		return NewTarFS(bytes.NewReader(data))
+	}
+	return nil, fmt.Errorf("Cannot read %s: unknown archive format, expected .zip, .tar, .tar.gz or .tgz", archivePath)
+}
+
+// NewTarFS returns a filesystem with the files in an uncompressed tar stream,
+// which is read completely into memory
+func NewTarFS(r io.Reader) (fs.FS, error) {
+	m := newMemFS()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read tar archive: %v", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" {
+			continue
+		}
+
+		var data []byte
+		var mode fs.FileMode
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if data, err = ioutil.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("Cannot read '%s' from tar archive: %v", header.Name, err)
+			}
+			mode = fs.FileMode(header.Mode) & fs.ModePerm
+		case tar.TypeSymlink:
+			data = []byte(header.Linkname)
+			mode = fs.ModeSymlink | 0777
+		default:
+			// Directories are created for the files in them
+			continue
+		}
+
+		contents := data
+		m.addFile(name, mode, int64(len(contents)), func() ([]byte, error) {
+			return contents, nil
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package metadata
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var fsTestFiles = map[string]string{
+	"owners.meta":  ownersMeta,
+	"METADATA":     "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\n",
+	"one/METADATA": "load(\"//owners.meta\", \"owners\")\nowners([\"bob\"])\n",
+	"one/a.txt":    "a",
+}
+
+func TestMapFS(t *testing.T) {
+	fsys := NewMapFS(fsTestFiles)
+	require.NoError(t, fstest.TestFS(fsys, "owners.meta", "METADATA", "one/METADATA", "one/a.txt"))
+
+	repo := Repo{Root: "/nonexistent", MetadataFilename: "METADATA", FS: fsys}
+	files, err := repo.Files()
+	require.NoError(t, err)
+	sort.Strings(files)
+	assert.Equal(t, []string{"METADATA", "one/METADATA", "one/a.txt", "owners.meta"}, files)
+
+	tree, err := NewEagerTree("/nonexistent", WithFS(fsys))
+	require.NoError(t, err)
+	value, err := tree.Get("one/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+}
+
+func TestArchiveFS(t *testing.T) {
+	dir := t.TempDir()
+
+	tarPath := filepath.Join(dir, "repo.tar.gz")
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, contents := range fsTestFiles {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "repo/" + name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+		_, err := io.WriteString(tw, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+
+	zipPath := filepath.Join(dir, "repo.zip")
+	f, err = os.Create(zipPath)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for name, contents := range fsTestFiles {
+		w, err := zw.Create("repo/" + name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	for _, path := range []string{tarPath, zipPath} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			archive, err := NewArchiveFS(path)
+			require.NoError(t, err)
+			require.NoError(t, fstest.TestFS(archive, "repo/METADATA", "repo/one/a.txt"))
+
+			fsys, err := fs.Sub(archive, "repo")
+			require.NoError(t, err)
+			tree, err := NewEagerTree("", WithFS(fsys))
+			require.NoError(t, err)
+			value, err := tree.Get("one/a.txt", "owners")
+			require.NoError(t, err)
+			assert.Equal(t, `["bob", "alice"]`, value.String())
+		})
+	}
+
+	rarPath := filepath.Join(dir, "repo.rar")
+	require.NoError(t, ioutil.WriteFile(rarPath, nil, 0644))
+	_, err = NewArchiveFS(rarPath)
+	assert.EqualError(t, err, "Cannot read "+rarPath+": unknown archive format, expected .zip, .tar, .tar.gz or .tgz")
+}
@@ -0,0 +1,58 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs a git command in dir and returns its stdout
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot run 'git %s': %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// splitNul splits the NUL-terminated output of a git command with -z
+func splitNul(out []byte) []string {
+	paths := make([]string, 0)
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path != "" {
+			paths = append(paths, filepath.FromSlash(path))
+		}
+	}
+	return paths
+}
+
+// GitChangedPaths returns the paths under root, relative to it, that differ
+// between two revisions of the git repository that root is in. If head is
+// empty, base is compared to the working tree, including untracked files that
+// are not ignored.
+func GitChangedPaths(root, base, head string) ([]string, error) {
+	args := []string{"diff", "--name-only", "--no-renames", "--relative", "-z", base}
+	if head != "" {
+		args = append(args, head)
+	}
+	out, err := git(root, args...)
+	if err != nil {
+		return nil, err
+	}
+	paths := splitNul(out)
+
+	if head == "" {
+		out, err := git(root, "ls-files", "--others", "--exclude-standard", "-z")
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, splitNul(out)...)
+	}
+	return paths, nil
+}
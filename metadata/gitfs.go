@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GitFS is a filesystem with the files under a directory of a local git
+// repository as they are at a revision. Files are read straight from the git
+// object store, so nothing is checked out. Close must be called when done
+// with it.
+type GitFS struct {
+	*memFS
+	root string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+var _ fs.ReadDirFS = (*GitFS)(nil)
+var _ fs.ReadFileFS = (*GitFS)(nil)
+var _ fs.StatFS = (*GitFS)(nil)
+
+// NewGitFS returns a filesystem with the files under root, which must be in a
+// git repository, as they are at rev
+func NewGitFS(root, rev string) (*GitFS, error) {
+	out, err := git(root, "rev-parse", "--show-toplevel", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(out), "\n")
+	toplevel, prefix := lines[0], lines[1]
+
+	// Like most git commands, ls-tree only lists the current directory when
+	// run in a subdirectory, so it is run from the top instead
+	out, err = git(toplevel, "ls-tree", "-r", "-z", "--long", rev+":"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GitFS{memFS: newMemFS(), root: root}
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("Cannot parse 'git ls-tree' output: %q", line)
+		}
+		fields := strings.Fields(line[:tab])
+		name := line[tab+1:]
+		if len(fields) != 4 || fields[1] != "blob" {
+			// Submodules are left out
+			continue
+		}
+
+		mode := fs.FileMode(0644)
+		switch fields[0] {
+		case "100755":
+			mode = 0755
+		case "120000":
+			mode = fs.ModeSymlink | 0777
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		object := fields[2]
+		g.addFile(name, mode, size, func() ([]byte, error) {
+			return g.readObject(object)
+		})
+	}
+	return g, nil
+}
+
+// readObject reads a blob through a long-running 'git cat-file --batch', so
+// that reading many files doesn't start a process for each one
+func (g *GitFS) readObject(object string) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cmd == nil {
+		cmd := exec.Command("git", "cat-file", "--batch")
+		cmd.Dir = g.root
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Cannot run 'git cat-file': %v", err)
+		}
+		g.cmd, g.stdin, g.stdout = cmd, stdin, bufio.NewReader(stdout)
+	}
+
+	if _, err := fmt.Fprintln(g.stdin, object); err != nil {
+		return nil, err
+	}
+	header, err := g.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Cannot read git object %s: %s", object, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// The contents are followed by a newline
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(g.stdout, data); err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+// Close stops the git process used to read files
+func (g *GitFS) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cmd == nil {
+		return nil
+	}
+	g.stdin.Close()
+	err := g.cmd.Wait()
+	g.cmd = nil
+	return err
+}
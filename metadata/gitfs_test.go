@@ -0,0 +1,59 @@
+package metadata
+
+import (
+	"io/fs"
+	"os/exec"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runGit runs git in root, skipping the test if git isn't installed
+func runGit(t *testing.T, root string, args ...string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	_, err := git(root, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	require.NoError(t, err)
+}
+
+func TestGitFS(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"sub/METADATA":     "metadata(key=\"tier\", value=1)\n",
+		"sub/deep/a.txt":   "a",
+		"sub/deep/b.txt":   "b",
+		"outside/METADATA": "metadata(key=\"tier\", value=3)\n",
+	})
+	runGit(t, root, "init", "-q")
+	runGit(t, root, "add", "-A")
+	runGit(t, root, "commit", "-q", "-m", "first")
+	writeFiles(t, root, map[string]string{"sub/METADATA": "metadata(key=\"tier\", value=2)\n"})
+
+	gitFS, err := NewGitFS(root+"/sub", "HEAD")
+	require.NoError(t, err)
+	defer gitFS.Close()
+
+	require.NoError(t, fstest.TestFS(gitFS, "METADATA", "deep/a.txt", "deep/b.txt"))
+
+	contents, err := fs.ReadFile(gitFS, "deep/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(contents))
+
+	entries, err := fs.ReadDir(gitFS, "deep")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "b.txt", entries[1].Name())
+
+	_, err = gitFS.Open("outside/METADATA")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// The tree comes from the commit, not the working tree
+	tree, err := NewEagerTree(root+"/sub", WithFS(gitFS))
+	require.NoError(t, err)
+	value, err := tree.Get("deep/a.txt", "tier")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value.String())
+}
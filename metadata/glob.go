@@ -17,6 +17,12 @@ func (g Glob) Match(str string) bool {
 	return g.re.MatchString(str)
 }
 
+// Pattern returns the pattern as it was written, relative to the directory of
+// the file that defined it
+func (g Glob) Pattern() string {
+	return g.pattern
+}
+
 func NewGlob(pattern string) (*Glob, error) {
 	return NewGlobRelativeTo(pattern, "")
 }
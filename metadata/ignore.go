@@ -0,0 +1,119 @@
+package metadata
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The file at the root of a repo that lists paths to skip, in .gitignore
+// syntax. Unlike .gitignore files, it applies even with Repo.NoGitignore and
+// Repo.TrackedOnly.
+const metaignoreFilename = ".metaignore"
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreFile is the list of patterns in a .gitignore file, which apply to
+// paths relative to the directory it is in
+type ignoreFile struct {
+	dir      string
+	patterns []ignorePattern
+}
+
+// parseIgnoreFile parses the patterns of a file in .gitignore syntax, in a
+// slash-separated directory of the repo
+func parseIgnoreFile(dir, contents string) (*ignoreFile, error) {
+	return newIgnoreFile(dir, strings.Split(contents, "\n"))
+}
+
+func newIgnoreFile(dir string, lines []string) (*ignoreFile, error) {
+	f := &ignoreFile{dir: dir}
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are ignored unless they are escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+
+		pattern.dirOnly = strings.HasSuffix(line, "/")
+		p := strings.TrimSuffix(line, "/")
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			continue
+		}
+
+		prefix := ""
+		if !anchored {
+			// Patterns without a separator match at any depth
+			prefix = "(?:.*/)?"
+		}
+		re, err := regexp.Compile("^" + prefix + gitPatternRegex(p) + "$")
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse ignore pattern '%s': %v", line, err)
+		}
+		pattern.re = re
+		f.patterns = append(f.patterns, pattern)
+	}
+	return f, nil
+}
+
+// match reports whether a slash-separated repo-relative path is ignored by
+// the file, and whether any pattern in the file matched it at all. The last
+// pattern that matches wins.
+func (f *ignoreFile) match(p string, isDir bool) (ignored bool, matched bool) {
+	rel := p
+	if f.dir != "" {
+		if !strings.HasPrefix(p, f.dir+"/") {
+			return false, false
+		}
+		rel = p[len(f.dir)+1:]
+	}
+
+	for i := len(f.patterns) - 1; i >= 0; i-- {
+		pattern := f.patterns[i]
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(rel) {
+			return !pattern.negate, true
+		}
+	}
+	return false, false
+}
+
+// ignoreStack is every ignore file that applies to a directory, with the
+// deepest last. Deeper files take precedence.
+type ignoreStack []*ignoreFile
+
+func (s ignoreStack) ignored(p string, isDir bool) bool {
+	for i := len(s) - 1; i >= 0; i-- {
+		if ignored, matched := s[i].match(p, isDir); matched {
+			return ignored
+		}
+	}
+	return false
+}
+
+// push returns the stack with another file on top, without changing s
+func (s ignoreStack) push(f *ignoreFile) ignoreStack {
+	pushed := make(ignoreStack, len(s), len(s)+1)
+	copy(pushed, s)
+	return append(pushed, f)
+}
@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreFile(t *testing.T) {
+	f, err := parseIgnoreFile("sub", `# comment
+*.log
+!keep.log
+build/
+/anchored
+docs/*.md
+trailing\ 
+`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+		matched bool
+	}{
+		{"sub/x.log", false, true, true},
+		{"sub/deep/x.log", false, true, true},
+		{"sub/keep.log", false, false, true},
+		{"x.log", false, false, false},
+		{"sub/build", true, true, true},
+		{"sub/deep/build", true, true, true},
+		{"sub/build", false, false, false},
+		{"sub/anchored", false, true, true},
+		{"sub/deep/anchored", false, false, false},
+		{"sub/docs/a.md", false, true, true},
+		{"sub/deep/docs/a.md", false, false, false},
+		{"sub/trailing ", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ignored, matched := f.match(tt.path, tt.isDir)
+			assert.Equal(t, tt.ignored, ignored)
+			assert.Equal(t, tt.matched, matched)
+		})
+	}
+}
+
+func TestIgnoreStack(t *testing.T) {
+	root, err := parseIgnoreFile("", "*.txt\n")
+	require.NoError(t, err)
+	sub, err := parseIgnoreFile("sub", "!important.txt\n")
+	require.NoError(t, err)
+
+	stack := ignoreStack{}.push(root).push(sub)
+	assert.True(t, stack.ignored("a.txt", false))
+	assert.True(t, stack.ignored("sub/a.txt", false))
+	assert.False(t, stack.ignored("sub/important.txt", false))
+	assert.True(t, stack.ignored("important.txt", false))
+}
@@ -1,87 +1,400 @@
 package metadata
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
 
 	jsoniter "github.com/json-iterator/go"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 )
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-func FileMapToJson(fileMap map[string]starlark.Value) (string, error) {
-	genericMap := make(map[string]interface{})
-	for file, starlarkValue := range fileMap {
-		goValue, err := ValueToGoType(starlarkValue)
+// NonFinitePolicy decides how NaN and infinite floats are written to JSON,
+// which has no way to represent them
+type NonFinitePolicy int
+
+const (
+	// NonFiniteError fails the encoding
+	NonFiniteError NonFinitePolicy = iota
+	// NonFiniteNull writes null
+	NonFiniteNull
+	// NonFiniteString writes the strings "NaN", "+Inf" and "-Inf"
+	NonFiniteString
+)
+
+// JsonEncoder converts starlark values to JSON.
+//
+// None, bools, ints of any size, floats, strings, lists and dicts with string
+// keys round trip through JsonToValue unchanged. Tuples and sets are written as
+// arrays, structs as objects of their fields, globs as their pattern and bytes
+// as base64 strings, so they come back as lists, dicts and strings. Dict keys
+// that aren't strings are written as the JSON encoding of the key, so the key
+// 1 becomes "1", and a dict with both 1 and "1" as keys can't be encoded. Dicts
+// and structs keep their order.
+type JsonEncoder struct {
+	NonFinite NonFinitePolicy
+}
+
+// Marshal returns the JSON encoding of v
+func (e JsonEncoder) Marshal(v starlark.Value) (string, error) {
+	stream := json.BorrowStream(nil)
+	defer json.ReturnStream(stream)
+
+	if err := e.writeValue(stream, v); err != nil {
+		return "", err
+	}
+	return string(stream.Buffer()), nil
+}
+
+// Encode writes the JSON encoding of v to w, followed by a newline
+func (e JsonEncoder) Encode(w io.Writer, v starlark.Value) error {
+	j, err := e.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, j)
+	return err
+}
+
+func (e JsonEncoder) writeValue(stream *jsoniter.Stream, v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		stream.WriteNil()
+	case starlark.Bool:
+		stream.WriteBool(bool(v))
+	case starlark.Int:
+		stream.WriteRaw(v.String())
+	case starlark.Float:
+		return e.writeFloat(stream, float64(v))
+	case starlark.String:
+		stream.WriteString(string(v))
+	case starlark.Bytes:
+		stream.WriteString(base64.StdEncoding.EncodeToString([]byte(v)))
+	case *StarlarkGlob:
+		stream.WriteString(v.impl.pattern)
+	case *starlark.Dict:
+		keys, err := e.dictKeys(v)
+		if err != nil {
+			return fmt.Errorf("Cannot convert dict %v to json: %v", v, err)
+		}
+		stream.WriteObjectStart()
+		for i, item := range v.Items() {
+			if i > 0 {
+				stream.WriteMore()
+			}
+			stream.WriteObjectField(keys[i])
+			if err := e.writeValue(stream, item[1]); err != nil {
+				return fmt.Errorf("Cannot convert value %v in dict %v to json: %v", item[1], v, err)
+			}
+		}
+		stream.WriteObjectEnd()
+	case *starlarkstruct.Struct:
+		stream.WriteObjectStart()
+		for i, name := range v.AttrNames() {
+			if i > 0 {
+				stream.WriteMore()
+			}
+			attr, err := v.Attr(name)
+			if err != nil {
+				return err
+			}
+			stream.WriteObjectField(name)
+			if err := e.writeValue(stream, attr); err != nil {
+				return fmt.Errorf("Cannot convert field %s of %v to json: %v", name, v, err)
+			}
+		}
+		stream.WriteObjectEnd()
+	case starlark.Iterable:
+		switch v.(type) {
+		case *starlark.List, starlark.Tuple, *starlark.Set:
+		default:
+			return fmt.Errorf("Do not know how to convert %s to json", v.Type())
+		}
+		stream.WriteArrayStart()
+		iter := v.Iterate()
+		defer iter.Done()
+		var item starlark.Value
+		for i := 0; iter.Next(&item); i++ {
+			if i > 0 {
+				stream.WriteMore()
+			}
+			if err := e.writeValue(stream, item); err != nil {
+				return fmt.Errorf("Cannot convert item %v of %v to json: %v", item, v, err)
+			}
+		}
+		stream.WriteArrayEnd()
+	default:
+		return fmt.Errorf("Do not know how to convert %s to json", v.Type())
+	}
+	return nil
+}
+
+func (e JsonEncoder) writeFloat(stream *jsoniter.Stream, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		switch e.NonFinite {
+		case NonFiniteNull:
+			stream.WriteNil()
+		case NonFiniteString:
+			stream.WriteString(nonFiniteString(f))
+		default:
+			return fmt.Errorf("Cannot convert %s to json", nonFiniteString(f))
+		}
+		return nil
+	}
+	stream.WriteRaw(formatFloat(f))
+	return nil
+}
+
+func (e JsonEncoder) dictKey(k starlark.Value) (string, error) {
+	if s, ok := k.(starlark.String); ok {
+		return string(s), nil
+	}
+	return e.Marshal(k)
+}
+
+// dictKeys returns the JSON object keys of a dict, in order. It fails if two
+// keys are written the same way, like 1 and "1", rather than silently writing
+// an object with a duplicate key.
+func (e JsonEncoder) dictKeys(d *starlark.Dict) ([]string, error) {
+	keys := make([]string, 0, d.Len())
+	seen := make(map[string]starlark.Value, d.Len())
+	for _, item := range d.Items() {
+		key, err := e.dictKey(item[0])
 		if err != nil {
-			return "", fmt.Errorf("Cannot convert entry for file '%s' to go type: %v", file, err)
+			return nil, fmt.Errorf("Cannot convert key %v: %v", item[0], err)
+		}
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("keys %v and %v are both written as %s", other, item[0], strconv.Quote(key))
 		}
-		genericMap[file] = goValue
+		seen[key] = item[0]
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// formatFloat writes a float so that it is read back as a float rather than an
+// int
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func nonFiniteString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return "NaN"
 	}
+}
 
-	b, err := json.Marshal(genericMap)
-	return string(b), err
+// FileMapToValue converts a map of file path to value into a dict, sorted by
+// file path
+func FileMapToValue(fileMap map[string]starlark.Value) *starlark.Dict {
+	files := make([]string, 0, len(fileMap))
+	for file := range fileMap {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	dict := starlark.NewDict(len(files))
+	for _, file := range files {
+		// String keys are always hashable, so this can't fail
+		_ = dict.SetKey(starlark.String(file), fileMap[file])
+	}
+	return dict
+}
+
+func FileMapToJson(fileMap map[string]starlark.Value) (string, error) {
+	return JsonEncoder{}.Marshal(FileMapToValue(fileMap))
 }
 
 func ValueToJson(starlarkVal starlark.Value) (string, error) {
-	goVal, err := ValueToGoType(starlarkVal)
+	return JsonEncoder{}.Marshal(starlarkVal)
+}
+
+// JsonToValue converts JSON into a starlark value. Objects become dicts in the
+// order their keys were written, arrays become lists, and numbers become ints
+// unless they have a fraction or exponent.
+func JsonToValue(s string) (starlark.Value, error) {
+	iter := json.BorrowIterator([]byte(s))
+	defer json.ReturnIterator(iter)
+
+	v, err := readJsonValue(iter)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, fmt.Errorf("Invalid json: %v", iter.Error)
+	}
+	// Anything other than whitespace after the value is an error. Reaching the
+	// end of the input sets io.EOF.
+	if iter.WhatIsNext() != jsoniter.InvalidValue || iter.Error != io.EOF {
+		return nil, fmt.Errorf("Invalid json: unexpected data after value")
+	}
+	return v, nil
+}
+
+func readJsonValue(iter *jsoniter.Iterator) (starlark.Value, error) {
+	switch iter.WhatIsNext() {
+	case jsoniter.NilValue:
+		iter.ReadNil()
+		return starlark.None, iterError(iter)
+	case jsoniter.BoolValue:
+		b := iter.ReadBool()
+		return starlark.Bool(b), iterError(iter)
+	case jsoniter.StringValue:
+		str := iter.ReadString()
+		return starlark.String(str), iterError(iter)
+	case jsoniter.NumberValue:
+		n := iter.ReadNumber()
+		if err := iterError(iter); err != nil {
+			return nil, err
+		}
+		return parseJsonNumber(string(n))
+	case jsoniter.ArrayValue:
+		items := make([]starlark.Value, 0)
+		var err error
+		iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+			var item starlark.Value
+			item, err = readJsonValue(iter)
+			items = append(items, item)
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return starlark.NewList(items), iterError(iter)
+	case jsoniter.ObjectValue:
+		dict := starlark.NewDict(0)
+		var err error
+		iter.ReadObjectCB(func(iter *jsoniter.Iterator, key string) bool {
+			var item starlark.Value
+			item, err = readJsonValue(iter)
+			if err == nil {
+				err = dict.SetKey(starlark.String(key), item)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dict, iterError(iter)
+	}
+
+	if err := iterError(iter); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("Invalid json: expected a value")
+}
+
+func iterError(iter *jsoniter.Iterator) error {
+	if iter.Error != nil && iter.Error != io.EOF {
+		return fmt.Errorf("Invalid json: %v", iter.Error)
 	}
-	b, err := json.Marshal(goVal)
-	return string(b), err
+	return nil
 }
 
+func parseJsonNumber(n string) (starlark.Value, error) {
+	if n == "" {
+		return nil, fmt.Errorf("Invalid json number")
+	}
+	if strings.ContainsAny(n, ".eE") {
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid json number %s: %v", n, err)
+		}
+		return starlark.Float(f), nil
+	}
+
+	i, ok := new(big.Int).SetString(n, 10)
+	if !ok {
+		return nil, fmt.Errorf("Invalid json number %s", n)
+	}
+	return starlark.MakeBigInt(i), nil
+}
+
+// ValueToGoType converts a starlark value into the Go types that
+// encoding/json uses: nil, bool, int64 (or *big.Int if it doesn't fit),
+// float64, string, []interface{} and map[string]interface{}. Values are
+// converted the same way as JsonEncoder.
 func ValueToGoType(v starlark.Value) (interface{}, error) {
-	switch v.Type() {
-	case "NoneType":
+	switch v := v.(type) {
+	case starlark.NoneType:
 		return nil, nil
-	case "string", "bool", "float":
-		return v, nil
-	case "int":
-		i, ok := v.(starlark.Int).Int64()
-		if !ok {
-			return nil, fmt.Errorf("Cannot cast %v to int64", v)
-		}
-		return i, nil
-	case "set", "list", "tuple":
-		seq := v.(starlark.Sequence)
-		vals := make([]interface{}, seq.Len())
-		iter := seq.Iterate()
-		defer iter.Done()
-		var item starlark.Value
-		for i := 0; iter.Next(&item); i++ {
-			goVal, err := ValueToGoType(item)
-			if err != nil {
-				return nil, fmt.Errorf("Cannot convert item %v of %v into golang value: %v", item, seq, err)
-			}
-			vals[i] = goVal
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bytes:
+		return base64.StdEncoding.EncodeToString([]byte(v)), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
 		}
-		return vals, nil
-	case "dict":
-		dict := v.(*starlark.Dict)
-		goMap := make(map[interface{}]interface{}, dict.Len())
-		for _, key := range dict.Keys() {
-			goKey, err := ValueToGoType(key)
+		return v.BigInt(), nil
+	case *StarlarkGlob:
+		return v.impl.pattern, nil
+	case *starlark.Dict:
+		keys, err := JsonEncoder{NonFinite: NonFiniteString}.dictKeys(v)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot convert dict %v to golang value: %v", v, err)
+		}
+		goMap := make(map[string]interface{}, v.Len())
+		for i, item := range v.Items() {
+			key := keys[i]
+			goVal, err := ValueToGoType(item[1])
 			if err != nil {
-				return nil, fmt.Errorf("Cannot convert key %v of dict %v to golang value: %v", key, dict, err)
+				return nil, fmt.Errorf("Cannot convert value %v in dict %v to golang value: %v", item[1], v, err)
 			}
 
-			val, _, err := dict.Get(key)
+			goMap[key] = goVal
+		}
+		return goMap, nil
+	case *starlarkstruct.Struct:
+		goMap := make(map[string]interface{})
+		for _, name := range v.AttrNames() {
+			attr, err := v.Attr(name)
 			if err != nil {
-				return nil, fmt.Errorf("Cannot get value for key %v from dict %v: %v", key, dict, err)
+				return nil, err
 			}
-
-			goVal, err := ValueToGoType(val)
+			goVal, err := ValueToGoType(attr)
 			if err != nil {
-				return nil, fmt.Errorf("Cannot convert value %v in dict %v to golang value: %v", val, dict, err)
+				return nil, fmt.Errorf("Cannot convert field %s of %v to golang value: %v", name, v, err)
 			}
-
-			goMap[goKey] = goVal
+			goMap[name] = goVal
 		}
-
 		return goMap, nil
+	case *starlark.List, starlark.Tuple, *starlark.Set:
+		seq := v.(starlark.Iterable)
+		vals := make([]interface{}, 0)
+		iter := seq.Iterate()
+		defer iter.Done()
+		var item starlark.Value
+		for iter.Next(&item) {
+			goVal, err := ValueToGoType(item)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot convert item %v of %v into golang value: %v", item, seq, err)
+			}
+			vals = append(vals, goVal)
+		}
+		return vals, nil
 	default:
-		return "", fmt.Errorf("Do not know how to convert %v", v)
+		return nil, fmt.Errorf("Do not know how to convert %v", v)
 	}
 }
@@ -1,11 +1,13 @@
 package metadata
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 )
 
 func TestValueToJson(t *testing.T) {
@@ -59,7 +61,33 @@ func TestValueToJson(t *testing.T) {
 				starlark.Bool(false),
 				starlark.String("abcd"),
 				starlark.MakeInt(42)), `[false,"abcd",42]`, false},
-		// TODO: Add test cases.
+		{"big int", starlark.MakeInt64(1 << 62).Mul(starlark.MakeInt(1000)), "4611686018427387904000", false},
+		{"whole float", starlark.Float(2), "2.0", false},
+		{"NaN", starlark.Float(math.NaN()), "", true},
+		{"html string", starlark.String("<a&b>"), `"<a&b>"`, false},
+		{"bytes", starlark.Bytes("hi"), `"aGk="`, false},
+		{"glob", func() starlark.Value {
+			g, err := NewGlob("**/*.py")
+			require.NoError(t, err)
+			return &StarlarkGlob{g}
+		}(), `"**/*.py"`, false},
+		{"struct", starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"b": starlark.MakeInt(1),
+			"a": starlark.String("x"),
+		}), `{"a":"x","b":1}`, false},
+		{"non-string dict keys", func() starlark.Value {
+			s := starlark.NewDict(0)
+			require.NoError(t, s.SetKey(starlark.MakeInt(1), starlark.True))
+			require.NoError(t, s.SetKey(makeTuple(starlark.String("a"), starlark.None), starlark.False))
+			return s
+		}(), `{"1":true,"[\"a\",null]":false}`, false},
+		{"colliding dict keys", func() starlark.Value {
+			s := starlark.NewDict(0)
+			require.NoError(t, s.SetKey(starlark.MakeInt(1), starlark.String("a")))
+			require.NoError(t, s.SetKey(starlark.String("1"), starlark.String("b")))
+			return s
+		}(), "", true},
+		{"unsupported type", starlark.NewBuiltin("f", nil), "", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -72,3 +100,90 @@ func TestValueToJson(t *testing.T) {
 		})
 	}
 }
+
+func TestJsonEncoderNonFinite(t *testing.T) {
+	list := starlark.NewList([]starlark.Value{
+		starlark.Float(math.NaN()),
+		starlark.Float(math.Inf(1)),
+		starlark.Float(math.Inf(-1)),
+	})
+
+	got, err := JsonEncoder{NonFinite: NonFiniteNull}.Marshal(list)
+	require.NoError(t, err)
+	assert.Equal(t, "[null,null,null]", got)
+
+	got, err = JsonEncoder{NonFinite: NonFiniteString}.Marshal(list)
+	require.NoError(t, err)
+	assert.Equal(t, `["NaN","+Inf","-Inf"]`, got)
+}
+
+func TestFileMapToJson(t *testing.T) {
+	dict := starlark.NewDict(0)
+	require.NoError(t, dict.SetKey(starlark.String("owners"), starlark.NewList([]starlark.Value{starlark.String("alice")})))
+
+	got, err := FileMapToJson(map[string]starlark.Value{
+		"b.txt": starlark.None,
+		"a.txt": dict,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"a.txt":{"owners":["alice"]},"b.txt":null}`, got)
+}
+
+func TestJsonToValue(t *testing.T) {
+	roundTrip := []string{
+		"null",
+		"true",
+		"-12",
+		"4611686018427387904000",
+		"1.5",
+		"2.0",
+		"1e+100",
+		`"abc"`,
+		"[]",
+		"{}",
+		`[1,"two",[3.0],{"four":null}]`,
+		`{"z":1,"a":{"":[true,false]}}`,
+	}
+	for _, j := range roundTrip {
+		t.Run(j, func(t *testing.T) {
+			value, err := JsonToValue(j)
+			require.NoError(t, err)
+			got, err := ValueToJson(value)
+			require.NoError(t, err)
+			assert.Equal(t, j, got)
+		})
+	}
+
+	value, err := JsonToValue(" { \"a\" : [ 1 , 2.5 ] } ")
+	require.NoError(t, err)
+	dict := value.(*starlark.Dict)
+	a, _, err := dict.Get(starlark.String("a"))
+	require.NoError(t, err)
+	assert.Equal(t, starlark.MakeInt(1), a.(*starlark.List).Index(0))
+	assert.Equal(t, starlark.Float(2.5), a.(*starlark.List).Index(1))
+
+	invalid := []string{"", "nul", "[1,", `{"a"}`, "1 2", "[1]x", "tru"}
+	for _, j := range invalid {
+		t.Run("invalid "+j, func(t *testing.T) {
+			_, err := JsonToValue(j)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValueToGoType(t *testing.T) {
+	dict := starlark.NewDict(0)
+	require.NoError(t, dict.SetKey(starlark.String("name"), starlark.String("api")))
+	require.NoError(t, dict.SetKey(starlark.MakeInt(2), starlark.Tuple{starlark.Float(1.5)}))
+
+	got, err := ValueToGoType(dict)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name": "api",
+		"2":    []interface{}{1.5},
+	}, got)
+
+	require.NoError(t, dict.SetKey(starlark.String("2"), starlark.None))
+	_, err = ValueToGoType(dict)
+	assert.EqualError(t, err, `Cannot convert dict {"name": "api", 2: (1.5,), "2": None} to golang value: keys 2 and "2" are both written as "2"`)
+}
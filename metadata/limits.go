@@ -0,0 +1,90 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// limits bound how much work a single execution of Starlark code can do, like
+// executing a module or calling a merge function
+type limits struct {
+	maxSteps uint64
+	timeout  time.Duration
+}
+
+// newThread returns a thread that is cancelled once it runs out of steps or
+// time, or ctx is done. The returned function must be called when the thread
+// is no longer used.
+func (l limits) newThread(ctx context.Context, name string) (*starlark.Thread, func()) {
+	thread := &starlark.Thread{Name: name}
+	if l.maxSteps > 0 {
+		thread.SetMaxExecutionSteps(l.maxSteps)
+	}
+
+	parent, cancel := ctx, func() {}
+	if l.timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, l.timeout)
+	}
+	if ctx.Done() == nil {
+		return thread, cancel
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				thread.Cancel(parent.Err().Error())
+			} else {
+				thread.Cancel(fmt.Sprintf("timed out after %v", l.timeout))
+			}
+		case <-done:
+		}
+	}()
+	return thread, func() {
+		close(done)
+		cancel()
+	}
+}
+
+// describeCallable names a Starlark function and where it is defined, for
+// errors
+func describeCallable(fn starlark.Callable) string {
+	if f, ok := fn.(*starlark.Function); ok {
+		return fmt.Sprintf("%s (%s)", f.Name(), f.Position())
+	}
+	return fn.Name()
+}
+
+// cancelledError is an error from work that stopped because its context is
+// done. errors.Is matches it with the error of the context, while errors.As
+// still finds the errors that it wraps.
+type cancelledError struct {
+	err    error
+	ctxErr error
+}
+
+func (e *cancelledError) Error() string {
+	return errorMessage(e.err)
+}
+
+func (e *cancelledError) Unwrap() error {
+	return e.err
+}
+
+func (e *cancelledError) Is(target error) bool {
+	return target == e.ctxErr
+}
+
+// checkCancelled returns err, wrapped so that it matches ctx.Err() if ctx is
+// done, since Starlark code that is cancelled fails with an error of its own
+func checkCancelled(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return &cancelledError{err: err, ctxErr: ctx.Err()}
+}
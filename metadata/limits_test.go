@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const slowMeta = `
+def _slow_merge(left, right):
+    n = 0
+    for i in range(1000000000):
+        n += 1
+    return left + right
+
+slow = meta(key="slow", horizontal_merge=_slow_merge, vertical_merge=_slow_merge)
+`
+
+var slowFiles = map[string]string{
+	"slow.meta":    slowMeta,
+	"METADATA":     "load(\"//slow.meta\", \"slow\")\nslow([\"a\"])\n",
+	"one/METADATA": "load(\"//slow.meta\", \"slow\")\nslow([\"b\"])\n",
+	"one/a.txt":    "a",
+}
+
+func TestMaxExecutionSteps(t *testing.T) {
+	tree, err := NewEagerTree("", WithFS(NewMapFS(slowFiles)), WithMaxExecutionSteps(10000))
+	require.NoError(t, err)
+	_, err = tree.Get("one/a.txt", "slow")
+	assert.EqualError(t, err, `Could not vertically merge 'slow' upper(["a"]) from METADATA and lower(["b"]) from one/METADATA `+
+		"with _slow_merge (slow.meta:2:1): slow.meta:4:5: Starlark computation cancelled: too many steps")
+
+	siblings := map[string]string{
+		"slow.meta":    slowMeta,
+		"one/METADATA": "load(\"//slow.meta\", \"slow\")\nslow([\"a\"])\nslow([\"b\"])\n",
+		"one/a.txt":    "a",
+	}
+	tree, err = NewEagerTree("", WithFS(NewMapFS(siblings)), WithMaxExecutionSteps(10000))
+	require.NoError(t, err)
+	_, err = tree.Get("one/a.txt", "slow")
+	assert.EqualError(t, err, `Could not horizontally merge 'slow' left(["a"]) and right(["b"]) in one/METADATA `+
+		"with _slow_merge (slow.meta:2:1): slow.meta:4:5: Starlark computation cancelled: too many steps")
+
+	files := map[string]string{
+		"loop.meta": "def count():\n    n = 0\n    for i in range(1000000000):\n        n += 1\n    return n\n\nn = count()\n",
+		"METADATA":  "load(\"//loop.meta\", \"n\")\n",
+	}
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithMaxExecutionSteps(10000), WithKeepGoing())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "METADATA:1:1: cannot load //loop.meta: loop.meta:4:11: Starlark computation cancelled: too many steps")
+
+	// The limit can be set by the config file
+	files[ConfigFilename] = "max_execution_steps = 10000\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	assert.Error(t, err)
+}
+
+func TestTimeout(t *testing.T) {
+	tree, err := NewEagerTree("", WithFS(NewMapFS(slowFiles)), WithTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	_, err = tree.Get("one/a.txt", "slow")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "with _slow_merge (slow.meta:2:1)")
+	assert.Contains(t, err.Error(), "Starlark computation cancelled: timed out after 10ms")
+
+	tree, err = NewEagerTree("", WithFS(NewMapFS(slowFiles)))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = tree.GetManyContext(ctx, "one/a.txt", []string{"slow"})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Contains(t, err.Error(), "with _slow_merge (slow.meta:2:1)")
+	assert.Contains(t, err.Error(), "Starlark computation cancelled: context canceled")
+}
+
+func TestContextCancelled(t *testing.T) {
+	files := map[string]string{
+		"loop.meta":    "def count():\n    n = 0\n    for i in range(1000000000):\n        n += 1\n    return n\n\nn = count()\n",
+		"METADATA":     "load(\"//loop.meta\", \"n\")\n",
+		"one/METADATA": "",
+		"two/METADATA": "",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	for _, opts := range [][]Option{{}, {WithKeepGoing()}, {WithConcurrency(4), WithKeepGoing()}} {
+		_, err := NewEagerTreeContext(ctx, "", append(opts, WithFS(NewMapFS(files)))...)
+		assert.True(t, errors.Is(err, context.Canceled), err)
+	}
+
+	// Once ctx is done, nothing is walked, parsed or merged
+	repo, err := NewRepo("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	_, err = repo.FilesContext(ctx)
+	assert.EqualError(t, err, "Cannot walk : context canceled")
+
+	tree, err := NewEagerTree("", WithFS(NewMapFS(slowFiles)))
+	require.NoError(t, err)
+	_, err = tree.GetContext(ctx, "one/a.txt", "slow")
+	assert.EqualError(t, err, "Cannot get metadata for 'one/a.txt': context canceled")
+	_, err = tree.ExplainContext(ctx, "one/a.txt", "slow")
+	assert.True(t, errors.Is(err, context.Canceled))
+	_, err = DiffTreesContext(ctx, tree, tree, []string{"one/a.txt"}, []string{"one/a.txt"}, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,246 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// LiveTree is a Tree that can be updated in place as METADATA and .meta files
+// change, without reparsing the files that didn't change. It is safe to query a
+// LiveTree while it is being reloaded.
+type LiveTree struct {
+	// Held for reading by every query that can use the cache, so that the
+	// tree can be swapped and the cache invalidated without a query putting a
+	// stale value back into the cache.
+	mu   sync.RWMutex
+	tree *MetadataTree
+
+	// Serializes reloads, which share the parser's state
+	reloadMu sync.Mutex
+	parser   *Parser
+	repo     *Repo
+
+	// Paths from a failed reload that have to be reparsed by the next one
+	pending []string
+}
+
+var _ Tree = (*LiveTree)(nil)
+
+// NewLiveTree parses every METADATA file under root and builds a tree out of
+// them that can be reloaded later
+func NewLiveTree(root string, opts ...Option) (*LiveTree, error) {
+	return NewLiveTreeContext(context.Background(), root, opts...)
+}
+
+// NewLiveTreeContext is NewLiveTree, but stops walking the repo and parsing
+// once ctx is done
+func NewLiveTreeContext(ctx context.Context, root string, opts ...Option) (*LiveTree, error) {
+	o, err := loadOptions(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	r := newRepo(root, o)
+
+	files, err := r.MetadataFilesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := newParser(r, o)
+	tree, err := buildTree(ctx, parser, files)
+	if tree == nil {
+		return nil, err
+	}
+
+	tree.cache = o.cache
+	tree.stats = o.stats
+	return &LiveTree{
+		tree:   tree,
+		parser: parser,
+		repo:   r,
+	}, err
+}
+
+// Current returns the tree as it is right now. The returned tree is never
+// changed by later reloads.
+func (t *LiveTree) Current() *MetadataTree {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree
+}
+
+// Root returns the root directory of the repo
+func (t *LiveTree) Root() string {
+	return t.repo.Root
+}
+
+// SetOverlay makes the tree use the given contents for a repo-relative path
+// instead of what is on disk, like the unsaved contents of a file in an editor.
+// The path has to be reloaded for the overlay to take effect.
+func (t *LiveTree) SetOverlay(path, contents string) {
+	t.parser.setOverlay(path, contents)
+}
+
+// RemoveOverlay makes the tree go back to using the contents on disk for a
+// repo-relative path. The path has to be reloaded for this to take effect.
+func (t *LiveTree) RemoveOverlay(path string) {
+	t.parser.removeOverlay(path)
+}
+
+// Module returns the globals of a METADATA or .meta file, loading it if it
+// hasn't been loaded yet
+func (t *LiveTree) Module(path string) (starlark.StringDict, error) {
+	return t.ModuleContext(context.Background(), path)
+}
+
+// ModuleContext is Module, but stops executing the module once ctx is done
+func (t *LiveTree) ModuleContext(ctx context.Context, path string) (starlark.StringDict, error) {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+	return t.parser.load(ctx, path)
+}
+
+// ResolveModule returns the path of the module that the file at a repo-relative
+// path loads with load(module)
+func (t *LiveTree) ResolveModule(from, module string) (string, error) {
+	return t.parser.resolveModule(from, module)
+}
+
+// IsRelevant reports whether a change to a repo-relative path could change the
+// tree, because it is a METADATA file, a .meta file, or a file that has been
+// loaded by one
+func (t *LiveTree) IsRelevant(path string) bool {
+	if t.repo.IsMetadataFile(filepath.Base(path)) || strings.HasSuffix(path, ".meta") {
+		return true
+	}
+	return t.parser.modules.has(path)
+}
+
+// Reload reparses the given repo-relative paths, and every METADATA file that
+// transitively loads one of them, then swaps the reparsed directories into the
+// tree and invalidates their cached values. Paths of METADATA files that no
+// longer exist are removed from the tree. If reparsing fails, the tree is left
+// as it was and the paths are reparsed again by the next reload. With
+// WithKeepGoing, the files that parsed are swapped in anyway, the directories of
+// the ones that failed are tainted, and a ParseErrors is returned.
+func (t *LiveTree) Reload(paths []string) error {
+	return t.ReloadContext(context.Background(), paths)
+}
+
+// ReloadContext is Reload, but stops reparsing once ctx is done, in which case
+// the tree is left as it was
+func (t *LiveTree) ReloadContext(ctx context.Context, paths []string) error {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+
+	affected := t.parser.invalidate(append(t.pending, paths...))
+	t.pending = nil
+
+	results := make(map[string]*ParseResult)
+	var errs ParseErrors
+	for _, path := range affected {
+		if !t.repo.IsMetadataFile(filepath.Base(path)) {
+			continue
+		}
+
+		fullPath := filepath.Join(t.repo.Root, path)
+		if _, err := fs.Stat(t.repo.fsys(), filepath.ToSlash(path)); errors.Is(err, fs.ErrNotExist) && !t.parser.hasOverlay(path) {
+			results[dirOfRelativePath(path)] = nil
+			continue
+		}
+
+		file, err := t.repo.newFile(fullPath)
+		if err != nil {
+			t.pending = affected
+			return err
+		}
+		result, err := t.parser.ParseOneContext(ctx, file)
+		if err != nil {
+			if !t.parser.keepGoing || ctx.Err() != nil {
+				t.parser.invalidate(affected)
+				t.pending = affected
+				return err
+			}
+			errs = append(errs, newParseError(file.pathRelativeToRoot, err))
+			continue
+		}
+		results[dirOfRelativePath(path)] = &result
+	}
+
+	if len(results) == 0 && len(errs) == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tree = t.tree.replace(results, errs)
+	if t.tree.cache != nil {
+		for dir := range results {
+			t.tree.cache.Invalidate(dir)
+		}
+		for _, err := range errs {
+			t.tree.cache.Invalidate(dirOfRelativePath(err.File))
+		}
+	}
+	return errs.orNil()
+}
+
+func (t *LiveTree) Get(filePath, key string) (starlark.Value, error) {
+	return t.GetContext(context.Background(), filePath, key)
+}
+
+func (t *LiveTree) GetContext(ctx context.Context, filePath, key string) (starlark.Value, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree.GetContext(ctx, filePath, key)
+}
+
+func (t *LiveTree) GetMany(filePath string, keys []string) (map[string]starlark.Value, error) {
+	return t.GetManyContext(context.Background(), filePath, keys)
+}
+
+func (t *LiveTree) GetManyContext(ctx context.Context, filePath string, keys []string) (map[string]starlark.Value, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree.GetManyContext(ctx, filePath, keys)
+}
+
+func (t *LiveTree) GetInto(filePath, key string, target interface{}) error {
+	return t.GetIntoContext(context.Background(), filePath, key, target)
+}
+
+func (t *LiveTree) GetIntoContext(ctx context.Context, filePath, key string, target interface{}) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tree.GetIntoContext(ctx, filePath, key, target)
+}
+
+func (t *LiveTree) GetClosest(filePath, key string) (starlark.Value, error) {
+	return t.Current().GetClosest(filePath, key)
+}
+
+func (t *LiveTree) Explain(filePath, key string) (*Explanation, error) {
+	return t.Current().Explain(filePath, key)
+}
+
+func (t *LiveTree) ExplainContext(ctx context.Context, filePath, key string) (*Explanation, error) {
+	return t.Current().ExplainContext(ctx, filePath, key)
+}
+
+func (t *LiveTree) Entries(dirPath string) []Entry {
+	return t.Current().Entries(dirPath)
+}
+
+func (t *LiveTree) Keys() []string {
+	return t.Current().Keys()
+}
+
+func (t *LiveTree) Walk(fn WalkFunc) error {
+	return t.Current().Walk(fn)
+}
@@ -0,0 +1,356 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+const ownersMeta = `
+def _owners_horizontal_merge_impl(left, right):
+    return left + right
+
+def _owners_vertical_merge_impl(upper, lower):
+    return lower + upper
+
+owners = meta(
+    key="owners",
+    horizontal_merge=_owners_horizontal_merge_impl,
+    vertical_merge=_owners_vertical_merge_impl,
+)
+`
+
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	for path, contents := range files {
+		fullPath := filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+		require.NoError(t, ioutil.WriteFile(fullPath, []byte(contents), 0644))
+	}
+}
+
+func newLiveTestRepo(t *testing.T) string {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"owners.meta": ownersMeta,
+		"METADATA": `
+load("//owners.meta", "owners")
+owners(["alice"])
+metadata(key="tier", value=1)
+`,
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["bob"])
+`,
+		"two/METADATA": `
+metadata(key="team", value="two")
+`,
+	})
+	return root
+}
+
+func TestLiveTreeReload(t *testing.T) {
+	root := newLiveTestRepo(t)
+	cache := NewMemoryCache()
+	tree, err := NewLiveTree(root, WithCache(cache))
+	require.NoError(t, err)
+
+	value, err := tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+	before := tree.Current()
+
+	// Only one/METADATA changed
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["carol"])
+`,
+	})
+	require.NoError(t, tree.Reload([]string{"one/METADATA"}))
+
+	value, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["carol", "alice"]`, value.String())
+
+	// Directories that weren't reparsed are shared with the old tree, which
+	// is left as it was
+	after := tree.Current()
+	assert.Same(t, before.subTrees["two"], after.subTrees["two"])
+	entries := before.Entries("one")
+	require.Len(t, entries, 1)
+	assert.Equal(t, `["bob"]`, entries[0].Value().String())
+}
+
+func TestLiveTreeReloadLoadedModule(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root, WithCache(NewMemoryCache()))
+	require.NoError(t, err)
+
+	value, err := tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+
+	// Every METADATA file that loads owners.meta is reparsed
+	writeFiles(t, root, map[string]string{
+		"owners.meta": `
+owners = meta(
+    key="owners",
+    horizontal_merge=lambda left, right: left + right,
+    vertical_merge=lambda upper, lower: upper + lower,
+)
+`,
+	})
+	require.NoError(t, tree.Reload([]string{"owners.meta"}))
+
+	value, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["alice", "bob"]`, value.String())
+
+	value, err = tree.Get("two/main.py", "team")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.String("two"), value)
+}
+
+func TestLiveTreeReloadAddAndRemove(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root)
+	require.NoError(t, err)
+
+	writeFiles(t, root, map[string]string{
+		"three/deep/METADATA": `
+metadata(key="team", value="three")
+`,
+	})
+	require.NoError(t, os.Remove(filepath.Join(root, "two", "METADATA")))
+	require.NoError(t, tree.Reload([]string{"three/deep/METADATA", "two/METADATA"}))
+
+	value, err := tree.Get("three/deep/main.py", "team")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.String("three"), value)
+
+	_, err = tree.Get("two/main.py", "team")
+	assert.IsType(t, NoMetadataFoundError{}, err)
+}
+
+func TestLiveTreeReloadFS(t *testing.T) {
+	// Nothing is on disk, so files only exist in the FS
+	tree, err := NewLiveTree(t.TempDir(), WithFS(NewMapFS(map[string]string{
+		"METADATA":     "metadata(key=\"tier\", value=1)\n",
+		"two/METADATA": "metadata(key=\"team\", value=\"two\")\n",
+	})))
+	require.NoError(t, err)
+
+	require.NoError(t, tree.Reload([]string{"two/METADATA", "three/METADATA"}))
+	value, err := tree.Get("two/main.py", "team")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.String("two"), value)
+}
+
+func TestLiveTreeReloadError(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root)
+	require.NoError(t, err)
+
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": `this is not starlark`,
+	})
+	assert.Error(t, tree.Reload([]string{"one/METADATA"}))
+
+	// The tree is left as it was
+	value, err := tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+
+	// Fixing the file reloads it, even without being told about it again
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["carol"])
+`,
+	})
+	require.NoError(t, tree.Reload(nil))
+
+	value, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["carol", "alice"]`, value.String())
+}
+
+func TestLiveTreeReloadKeepGoing(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root, WithKeepGoing(), WithCache(NewMemoryCache()))
+	require.NoError(t, err)
+	_, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": `this is not starlark`,
+		"two/METADATA": `metadata(key="team", value="three")`,
+	})
+	err = tree.Reload([]string{"one/METADATA", "two/METADATA"})
+	require.IsType(t, ParseErrors{}, err)
+	require.Len(t, err.(ParseErrors), 1)
+	assert.Equal(t, filepath.Join("one", "METADATA"), err.(ParseErrors)[0].File)
+
+	// The broken directory is tainted, even though its value was cached, and
+	// the file that parsed is swapped in
+	_, err = tree.Get("one/main.py", "owners")
+	assert.IsType(t, TaintedError{}, err)
+	value, err := tree.Get("two/main.py", "team")
+	require.NoError(t, err)
+	assert.Equal(t, `"three"`, value.String())
+
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["carol"])
+`,
+	})
+	require.NoError(t, tree.Reload([]string{"one/METADATA"}))
+	value, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["carol", "alice"]`, value.String())
+}
+
+func TestWatcher(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root, WithCache(NewMemoryCache()))
+	require.NoError(t, err)
+
+	watcher, err := Watch(tree)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	waitFor := func(path, key, expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			value, err := tree.Get(path, key)
+			if err == nil && value.String() == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s of %s to be %s, got %v (%v)", key, path, expected, value, err)
+			}
+			select {
+			case err := <-watcher.Errors():
+				// A file may have been read while it was half written
+				t.Logf("Error from watcher: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	waitFor("one/main.py", "owners", `["bob", "alice"]`)
+
+	writeFiles(t, root, map[string]string{
+		"owners.meta": ownersMeta + "\nunused = 1\n",
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["carol"])
+`,
+	})
+	waitFor("one/main.py", "owners", `["carol", "alice"]`)
+
+	// New directories are watched too
+	writeFiles(t, root, map[string]string{
+		"new/dir/METADATA": `
+metadata(key="team", value="new")
+`,
+	})
+	waitFor("new/dir/main.py", "team", `"new"`)
+}
+
+func TestWatcherSkipsIgnoredPaths(t *testing.T) {
+	root := newLiveTestRepo(t)
+	writeFiles(t, root, map[string]string{
+		".gitignore":     "build/\n",
+		".metaignore":    "vendor/\n",
+		"build/keep.txt": "",
+	})
+	tree, err := NewLiveTree(root, WithIgnore("tmp/"))
+	require.NoError(t, err)
+
+	watcher, err := Watch(tree)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	for _, dir := range []string{"build", "vendor", "tmp"} {
+		writeFiles(t, root, map[string]string{
+			dir + "/METADATA": "this is not starlark",
+		})
+	}
+	writeFiles(t, root, map[string]string{
+		"two/METADATA": `
+metadata(key="team", value="changed")
+`,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		value, err := tree.Get("two/main.py", "team")
+		if err == nil && value.String() == `"changed"` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the change to two/METADATA, got %v (%v)", value, err)
+		}
+		select {
+		case err := <-watcher.Errors():
+			t.Fatalf("Ignored METADATA file was reloaded: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestLiveTreeOverlay(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root, WithOverlay(map[string]string{
+		"one/METADATA": `
+load("//owners.meta", "owners")
+owners(["dave"])
+`,
+	}))
+	require.NoError(t, err)
+
+	value, err := tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["dave", "alice"]`, value.String())
+
+	tree.RemoveOverlay("one/METADATA")
+	require.NoError(t, tree.Reload([]string{"one/METADATA"}))
+	value, err = tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+
+	// Overlays can add files that don't exist on disk
+	tree.SetOverlay("three/METADATA", `metadata(key="team", value="three")`)
+	require.NoError(t, tree.Reload([]string{"three/METADATA"}))
+	value, err = tree.Get("three/main.py", "team")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.String("three"), value)
+}
+
+func TestEntryPositions(t *testing.T) {
+	root := newLiveTestRepo(t)
+	tree, err := NewLiveTree(root)
+	require.NoError(t, err)
+
+	entries := tree.Entries("")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "METADATA:3:7", entries[0].Position().String())
+	assert.Equal(t, "METADATA:4:9", entries[1].Position().String())
+
+	globals, err := tree.Module("owners.meta")
+	require.NoError(t, err)
+	m, ok := globals["owners"].(*StarlarkMeta)
+	require.True(t, ok)
+	assert.Equal(t, "owners", m.Key())
+	assert.Equal(t, "_owners_vertical_merge_impl", m.VerticalMerge().Name())
+	assert.Equal(t, "_owners_horizontal_merge_impl", m.HorizontalMerge().Name())
+	assert.Equal(t, "owners.meta:8:14", m.Position().String())
+}
@@ -0,0 +1,38 @@
+package metadata
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelTrace is the level of the most detailed events, below slog.LevelDebug.
+// There is one for every directory read, METADATA file parsed, module loaded
+// from the cache, glob compiled and merge function called, most with how long
+// they took.
+const LevelTrace = slog.LevelDebug - 4
+
+// Logger receives events from walking repos, parsing METADATA files and
+// merging values. A *slog.Logger can be used as is.
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+// logger sends events to a Logger, if there is one
+type logger struct {
+	Logger Logger
+}
+
+func (l logger) log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	if l.Logger != nil && l.Logger.Enabled(ctx, level) {
+		l.Logger.Log(ctx, level, msg, args...)
+	}
+}
+
+func (l logger) trace(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, LevelTrace, msg, args...)
+}
+
+func (l logger) debug(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, slog.LevelDebug, msg, args...)
+}
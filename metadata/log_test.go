@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLogger keeps every event at or above a level
+type recordingLogger struct {
+	mu     sync.Mutex
+	level  slog.Level
+	events []string
+}
+
+func (l *recordingLogger) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= l.level
+}
+
+func (l *recordingLogger) Log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "duration" {
+			if _, ok := args[i+1].(time.Duration); !ok {
+				event += " duration=?"
+			}
+			continue
+		}
+		event += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.events = append(l.events, event)
+}
+
+func TestLogger(t *testing.T) {
+	files := map[string]string{
+		"owners.meta":  ownersMeta,
+		"METADATA":     "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\nowners([\"bob\"], files=[glob(\"*.txt\")])\n",
+		"a.txt":        "a",
+		"one/METADATA": "load(\"//owners.meta\", \"owners\")\nowners([\"carol\"])\n",
+		"one/a.txt":    "a",
+	}
+
+	log := &recordingLogger{level: LevelTrace}
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)), WithLogger(log))
+	require.NoError(t, err)
+	_, err = tree.Get("one/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"read directory dir=. entries=4",
+		"read directory dir=one entries=2",
+		"walked repo root=",
+		"executed module module=owners.meta",
+		"compiled glob file=METADATA pattern=*.txt",
+		"executed module module=METADATA",
+		"parsed METADATA file file=METADATA",
+		"loaded module from cache module=owners.meta from=one/METADATA",
+		"executed module module=one/METADATA",
+		"parsed METADATA file file=one/METADATA",
+		"parsed METADATA files files=2 concurrency=1",
+		"merged vertically key=owners function=_owners_vertical_merge_impl (owners.meta:5:1)",
+	}, log.events)
+
+	// Only the summaries are logged at debug level
+	log = &recordingLogger{level: slog.LevelDebug}
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithLogger(log))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"walked repo root=", "parsed METADATA files files=2 concurrency=1"}, log.events)
+}
@@ -0,0 +1,169 @@
+package metadata
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memNode is a file or directory in a memFS. The contents of files are only
+// read when they are opened.
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	size     int64
+	children map[string]*memNode
+	contents func() ([]byte, error)
+}
+
+func (n *memNode) Name() string               { return n.name }
+func (n *memNode) Size() int64                { return n.size }
+func (n *memNode) Mode() fs.FileMode          { return n.mode }
+func (n *memNode) ModTime() time.Time         { return time.Time{} }
+func (n *memNode) IsDir() bool                { return n.mode.IsDir() }
+func (n *memNode) Sys() interface{}           { return nil }
+func (n *memNode) Type() fs.FileMode          { return n.mode.Type() }
+func (n *memNode) Info() (fs.FileInfo, error) { return n, nil }
+
+func (n *memNode) sortedChildren() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// memFS is a read-only filesystem held in memory, that filesystems which
+// aren't directories on disk are built on
+type memFS struct {
+	root *memNode
+}
+
+func newMemFS() *memFS {
+	return &memFS{root: &memNode{name: ".", mode: fs.ModeDir | 0755, children: make(map[string]*memNode)}}
+}
+
+// addFile adds a file at a slash-separated path, creating its parent
+// directories
+func (m *memFS) addFile(name string, mode fs.FileMode, size int64, contents func() ([]byte, error)) {
+	parts := strings.Split(name, "/")
+	dir := m.root
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := dir.children[part]
+		if !ok || !child.IsDir() {
+			child = &memNode{name: part, mode: fs.ModeDir | 0755, children: make(map[string]*memNode)}
+			dir.children[part] = child
+		}
+		dir = child
+	}
+	base := parts[len(parts)-1]
+	dir.children[base] = &memNode{name: base, mode: mode, size: size, contents: contents}
+}
+
+func (m *memFS) lookup(op, name string) (*memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	node := m.root
+	if name == "." {
+		return node, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		child, ok := node.children[part]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	node, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		return &memDir{node: node, entries: node.sortedChildren()}, nil
+	}
+
+	data, err := node.contents()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &memFile{node: node, Reader: bytes.NewReader(data)}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	return m.lookup("stat", name)
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := m.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.sortedChildren(), nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	node, err := m.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := node.contents()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	// Callers own the result, so they mustn't be able to change the file
+	return append([]byte(nil), data...), nil
+}
+
+type memFile struct {
+	node *memNode
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memDir struct {
+	node    *memNode
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,272 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const loaderLocalKey = "metadata.loader"
+
+// loader tracks the module that a single top-level parse is waiting on, so
+// that load cycles can be detected across goroutines instead of deadlocking.
+// There is one loader per call to Parser.ParseOne, shared by every thread that
+// the parse starts through load().
+type loader struct {
+	// cancels the execution of modules
+	ctx context.Context
+
+	// guarded by moduleCache.mu
+	waitsFor *moduleEntry
+	// the load() that is waiting
+	waitsForLoad loadFrame
+	// the modules being executed, outermost first
+	stack []loadFrame
+}
+
+// loaderContext returns the context of the parse that a thread is part of
+func loaderContext(thread *starlark.Thread) context.Context {
+	if l, ok := thread.Local(loaderLocalKey).(*loader); ok {
+		return l.ctx
+	}
+	return context.Background()
+}
+
+// loadFrame is a module being loaded, and the load() that loaded it
+type loadFrame struct {
+	path string
+	pos  syntax.Position
+}
+
+type moduleEntry struct {
+	// guarded by moduleCache.mu
+	owner *loader
+
+	path string
+
+	globals starlark.StringDict
+	err     error
+	ready   chan struct{}
+}
+
+// moduleCache holds the result of executing each loaded module so that a
+// module is only executed once, no matter how many files load it. It also
+// keeps track of which modules load each other, so that everything that
+// depends on a changed module can be thrown away.
+type moduleCache struct {
+	mu      sync.Mutex
+	modules map[string]*moduleEntry
+
+	// module path -> paths of the modules that it loads
+	deps map[string]StringSet
+}
+
+func newModuleCache() *moduleCache {
+	return &moduleCache{
+		modules: make(map[string]*moduleEntry),
+		deps:    make(map[string]StringSet),
+	}
+}
+
+func (c *moduleCache) addDep(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.deps[from]; !ok {
+		c.deps[from] = make(StringSet)
+	}
+	c.deps[from].Add(to)
+}
+
+// has reports whether a module has been loaded, or is being loaded
+func (c *moduleCache) has(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.modules[path]
+	return ok
+}
+
+// invalidate removes the given modules, and every module that transitively
+// loads one of them, from the cache. Returns the paths of every module that
+// was removed or given. Must not be called while modules are being loaded.
+func (c *moduleCache) invalidate(paths []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dependents := make(map[string][]string)
+	for from, tos := range c.deps {
+		for to := range tos {
+			dependents[to] = append(dependents[to], from)
+		}
+	}
+
+	affected := make(StringSet)
+	queue := append([]string{}, paths...)
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if affected.Contains(path) {
+			continue
+		}
+		affected.Add(path)
+		queue = append(queue, dependents[path]...)
+	}
+
+	result := make([]string, 0, len(affected))
+	for path := range affected {
+		delete(c.modules, path)
+		delete(c.deps, path)
+		result = append(result, path)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// get returns the globals of a module, executing it if no one has started to.
+// The frame is the module and where it is loaded from.
+func (c *moduleCache) get(l *loader, frame loadFrame, exec func() (starlark.StringDict, error)) (starlark.StringDict, error) {
+	path := frame.path
+	c.mu.Lock()
+	e, ok := c.modules[path]
+	if ok {
+		// Someone has already started loading this module. Wait for them to
+		// finish, unless doing so would wait on ourselves.
+		if isCycle(e, l) {
+			err := newLoadCycleError(e, l, frame)
+			c.mu.Unlock()
+			return nil, err
+		}
+		l.waitsFor = e
+		l.waitsForLoad = frame
+		c.mu.Unlock()
+
+		<-e.ready
+
+		c.mu.Lock()
+		l.waitsFor = nil
+		c.mu.Unlock()
+		return e.globals, e.err
+	}
+
+	e = &moduleEntry{
+		owner: l,
+		path:  path,
+		ready: make(chan struct{}),
+	}
+	c.modules[path] = e
+	l.stack = append(l.stack, frame)
+	c.mu.Unlock()
+
+	e.globals, e.err = exec()
+
+	c.mu.Lock()
+	e.owner = nil
+	l.stack = l.stack[:len(l.stack)-1]
+	// A module that was cancelled has to be executed again by the next parse
+	if l.ctx.Err() != nil && c.modules[path] == e {
+		delete(c.modules, path)
+	}
+	c.mu.Unlock()
+	close(e.ready)
+
+	return e.globals, e.err
+}
+
+// isCycle follows the chain of loaders waiting on each other, starting with the
+// owner of e, and reports whether it leads back to l. Must be called with
+// moduleCache.mu held.
+func isCycle(e *moduleEntry, l *loader) bool {
+	for e != nil {
+		if e.owner == nil {
+			return false
+		}
+		if e.owner == l {
+			return true
+		}
+		e = e.owner.waitsFor
+	}
+	return false
+}
+
+// LoadCycleError is returned when modules load each other in a cycle
+type LoadCycleError struct {
+	// The modules in the cycle, in the order that they load each other. The
+	// first module is repeated at the end.
+	Modules []string
+
+	// Where each module loads the next one
+	Loads []syntax.Position
+}
+
+func (e *LoadCycleError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cycle detected in load graph: %s", strings.Join(e.Modules, " -> "))
+	for i, pos := range e.Loads {
+		fmt.Fprintf(&b, "\n    %s: loads %s", pos, e.Modules[i+1])
+	}
+	return b.String()
+}
+
+// newLoadCycleError follows the chain of loaders waiting on each other, like
+// isCycle, to find every module in the cycle that frame would close. Must be
+// called with moduleCache.mu held.
+func newLoadCycleError(e *moduleEntry, l *loader, frame loadFrame) *LoadCycleError {
+	cycle := make([]loadFrame, 0)
+	for {
+		owner := e.owner
+		i := len(owner.stack) - 1
+		for i > 0 && owner.stack[i].path != e.path {
+			i--
+		}
+		if len(cycle) == 0 {
+			cycle = append(cycle, owner.stack[i])
+		}
+		cycle = append(cycle, owner.stack[i+1:]...)
+		if owner == l {
+			break
+		}
+		cycle = append(cycle, owner.waitsForLoad)
+		e = owner.waitsFor
+	}
+	cycle = append(cycle, frame)
+
+	err := &LoadCycleError{}
+	for i, f := range cycle {
+		err.Modules = append(err.Modules, f.path)
+		if i > 0 {
+			err.Loads = append(err.Loads, f.pos)
+		}
+	}
+	return err
+}
+
+// transitiveDeps returns the paths of every module that a module loads,
+// directly or through other modules, sorted
+func (c *moduleCache) transitiveDeps(path string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(StringSet)
+	queue := []string{path}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for to := range c.deps[from] {
+			if !seen.Contains(to) {
+				seen.Add(to)
+				queue = append(queue, to)
+			}
+		}
+	}
+
+	result := make([]string, 0, len(seen))
+	for dep := range seen {
+		result = append(result, dep)
+	}
+	sort.Strings(result)
+	return result
+}
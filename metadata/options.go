@@ -0,0 +1,315 @@
+package metadata
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const defaultMetadataFilename = "METADATA"
+
+// Option configures how a MetadataTree is built. Options are passed to
+// NewEagerTree and NewParser. Options given explicitly take precedence over
+// the ones from the ConfigFilename file of the repo.
+type Option func(*options)
+
+type options struct {
+	metadataFilename string
+	altFilenames     []string
+	predeclared      starlark.StringDict
+	cache            Cache
+	concurrency      int
+	overlay          map[string]string
+	fs               fs.FS
+	ignore           []string
+	noGitignore      bool
+	trackedOnly      bool
+	symlinks         SymlinkMode
+	metaRoots        []string
+	prelude          []string
+	aliases          map[string]string
+	strictness       Strictness
+	noConfig         bool
+	keepGoing        bool
+	maxSteps         uint64
+	timeout          time.Duration
+	logger           Logger
+	stats            *Stats
+	cacheDir         string
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		metadataFilename: defaultMetadataFilename,
+		predeclared:      starlark.StringDict{},
+		concurrency:      1,
+		overlay:          make(map[string]string),
+		aliases:          make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMetadataFilename sets the name of the files that metadata entries are
+// read from. Defaults to "METADATA".
+func WithMetadataFilename(name string) Option {
+	return func(o *options) {
+		o.metadataFilename = name
+		o.altFilenames = nil
+	}
+}
+
+// WithMetadataFilenames sets the names of the files that metadata entries are
+// read from. New files are created with the first name, and a directory can
+// only have one of them.
+func WithMetadataFilenames(names ...string) Option {
+	return func(o *options) {
+		if len(names) == 0 {
+			return
+		}
+		o.metadataFilename = names[0]
+		o.altFilenames = append([]string{}, names[1:]...)
+	}
+}
+
+// WithPredeclared adds builtins to the environment of every METADATA and
+// .meta file. The builtins that this package provides (meta, metadata and
+// glob) cannot be overridden.
+func WithPredeclared(predeclared starlark.StringDict) Option {
+	return func(o *options) {
+		for name, value := range predeclared {
+			o.predeclared[name] = value
+		}
+	}
+}
+
+// WithCache sets the cache used to memoize merged values. By default, merged
+// values are not cached.
+func WithCache(cache Cache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithCacheDir keeps compiled METADATA and .meta files in a directory, so
+// that files that haven't changed since they were last read, by any process,
+// don't have to be parsed and compiled again. A relative directory is relative
+// to the root of the repo. By default, nothing is kept on disk.
+func WithCacheDir(dir string) Option {
+	return func(o *options) {
+		o.cacheDir = dir
+	}
+}
+
+// WithConcurrency sets how many METADATA files are parsed at once. Values less
+// than one are treated as one.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.concurrency = n
+	}
+}
+
+// WithOverlay makes the parser read the given contents instead of what is on
+// disk for some files, keyed by repo-relative path, like the unsaved contents of
+// files open in an editor
+func WithOverlay(overlay map[string]string) Option {
+	return func(o *options) {
+		for path, contents := range overlay {
+			o.overlay[path] = contents
+		}
+	}
+}
+
+// WithFS reads the repo from a filesystem instead of from the directory at its
+// root, like a GitFS for a past revision
+func WithFS(fsys fs.FS) Option {
+	return func(o *options) {
+		o.fs = fsys
+	}
+}
+
+// WithIgnore skips paths matching patterns in .gitignore syntax when walking
+// the repo, on top of the ones in its .metaignore file
+func WithIgnore(patterns ...string) Option {
+	return func(o *options) {
+		o.ignore = append(o.ignore, patterns...)
+	}
+}
+
+// WithoutGitignore walks paths even if .gitignore files or .git/info/exclude
+// ignore them
+func WithoutGitignore() Option {
+	return func(o *options) {
+		o.noGitignore = true
+	}
+}
+
+// WithTrackedOnly only walks the files in the git index of the repo. Repos
+// read from an FS given with WithFS can't be limited to tracked files, unless
+// it is a GitFS, whose files are all tracked.
+func WithTrackedOnly() Option {
+	return func(o *options) {
+		o.trackedOnly = true
+	}
+}
+
+// WithSymlinks sets what to do with symbolic links when walking the repo. By
+// default, they are skipped.
+func WithSymlinks(mode SymlinkMode) Option {
+	return func(o *options) {
+		o.symlinks = mode
+	}
+}
+
+// WithMetaRoots sets the repo-relative directories that .meta files are
+// searched for in when they are loaded without a leading "//", in order
+func WithMetaRoots(roots ...string) Option {
+	return func(o *options) {
+		o.metaRoots = append(o.metaRoots, roots...)
+	}
+}
+
+// WithPrelude loads modules into every METADATA file, as if each of them
+// started by loading every public global of the modules. Later modules take
+// precedence over earlier ones, and globals of METADATA files take precedence
+// over all of them.
+func WithPrelude(modules ...string) Option {
+	return func(o *options) {
+		o.prelude = append(o.prelude, modules...)
+	}
+}
+
+// WithAliases maps names to the directories of other repos, so that modules
+// in them can be loaded with "@name//path". Relative directories are relative
+// to the root of the repo.
+func WithAliases(aliases map[string]string) Option {
+	return func(o *options) {
+		for name, dir := range aliases {
+			o.aliases[name] = dir
+		}
+	}
+}
+
+// WithStrictness turns on checks that METADATA files don't need to pass by
+// default
+func WithStrictness(s Strictness) Option {
+	return func(o *options) {
+		o.strictness = s
+	}
+}
+
+// WithKeepGoing parses every METADATA file even if some of them fail to parse,
+// and builds the tree out of the ones that parsed. The tree is then returned
+// along with a ParseErrors error, and getting metadata for files under a
+// METADATA file that failed returns a TaintedError.
+func WithKeepGoing() Option {
+	return func(o *options) {
+		o.keepGoing = true
+	}
+}
+
+// WithMaxExecutionSteps limits how many steps executing a module or calling a
+// merge function can take, to stop runaway loops. Zero means no limit, which
+// is the default.
+func WithMaxExecutionSteps(n uint64) Option {
+	return func(o *options) {
+		o.maxSteps = n
+	}
+}
+
+// WithTimeout limits how long executing a module or calling a merge function
+// can take. Zero means no limit, which is the default.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithLogger sends events from walking the repo, parsing and merging to l.
+// Most of them are at LevelTrace.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithStats records how long parsing and merging take, and how well the
+// caches work, in s
+func WithStats(s *Stats) Option {
+	return func(o *options) {
+		o.stats = s
+	}
+}
+
+// WithoutConfig ignores the ConfigFilename file at the root of the repo
+func WithoutConfig() Option {
+	return func(o *options) {
+		o.noConfig = true
+	}
+}
+
+// Cache memoizes the merged value of a metadata key for a file. Implementations
+// must be safe for concurrent use.
+type Cache interface {
+	Get(filePath, key string) (starlark.Value, bool)
+	Put(filePath, key string, value starlark.Value)
+
+	// Invalidate removes the values of every file in a directory and its
+	// subdirectories. The root of the repo is "".
+	Invalidate(dirPath string)
+}
+
+type cacheKey struct {
+	filePath string
+	key      string
+}
+
+// MemoryCache is a Cache that keeps every merged value in memory
+type MemoryCache struct {
+	mu     sync.RWMutex
+	values map[cacheKey]starlark.Value
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		values: make(map[cacheKey]starlark.Value),
+	}
+}
+
+func (c *MemoryCache) Get(filePath, key string) (starlark.Value, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.values[cacheKey{filePath, key}]
+	return v, ok
+}
+
+func (c *MemoryCache) Put(filePath, key string, value starlark.Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[cacheKey{filePath, key}] = value
+}
+
+func (c *MemoryCache) Invalidate(dirPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dirPath == "" {
+		c.values = make(map[cacheKey]starlark.Value)
+		return
+	}
+
+	prefix := dirPath + string(filepath.Separator)
+	for k := range c.values {
+		if strings.HasPrefix(k.filePath, prefix) {
+			delete(c.values, k)
+		}
+	}
+}
@@ -0,0 +1,778 @@
+package metadata
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// ImportOptions configures how owners are imported into METADATA files
+type ImportOptions struct {
+	// Metadata key to put owners in. Defaults to "owners".
+	Key string
+
+	// Repo-relative path of the .meta file that defines the owners function.
+	// Defaults to "owners.meta".
+	MetaPath string
+}
+
+func (o ImportOptions) withDefaults() ImportOptions {
+	if o.Key == "" {
+		o.Key = "owners"
+	}
+	if o.MetaPath == "" {
+		o.MetaPath = "owners.meta"
+	}
+	return o
+}
+
+// ImportProblem is a construct in an owners file that could not be translated
+// into metadata
+type ImportProblem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p ImportProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// OwnersImport is the result of translating owners files into METADATA files
+type OwnersImport struct {
+	// Repo-relative path to the full contents that should be written there.
+	// Existing METADATA files have the imported owners appended to them.
+	Files map[string]string
+
+	// Constructs that could not be translated. The files they apply to are
+	// given explicit entries instead, as long as their owners are known.
+	Problems []ImportProblem
+
+	// Files that had to be given explicit entries to keep their owners,
+	// because their owners could not be expressed per directory
+	ExplicitFiles []string
+
+	// Files whose owners in the imported tree still differ from the original
+	// owners files. Empty unless something went wrong.
+	Mismatches []string
+}
+
+// importEntry is a call to the owners function in a METADATA file. If exact
+// and globs are empty, it applies to the whole directory.
+type importEntry struct {
+	owners []string
+	exact  []string
+	globs  []string
+}
+
+// ownersImporter builds up the METADATA files for an import
+type ownersImporter struct {
+	repo  *Repo
+	opts  ImportOptions
+	files []string
+
+	// directory -> entries in it, in order
+	entries map[string][]importEntry
+	// the owners that every file should end up with
+	expected map[string][]string
+
+	problems []ImportProblem
+}
+
+func newOwnersImporter(repo *Repo, opts ImportOptions) (*ownersImporter, error) {
+	files, err := repo.Files()
+	if err != nil {
+		return nil, err
+	}
+	return &ownersImporter{
+		repo:     repo,
+		opts:     opts.withDefaults(),
+		files:    files,
+		entries:  make(map[string][]importEntry),
+		expected: make(map[string][]string),
+	}, nil
+}
+
+func (imp *ownersImporter) problem(file string, line int, format string, args ...interface{}) {
+	imp.problems = append(imp.problems, ImportProblem{file, line, fmt.Sprintf(format, args...)})
+}
+
+// ImportCodeowners translates a GitHub or GitLab CODEOWNERS file at a
+// repo-relative path into METADATA files. Since CODEOWNERS rules apply to the
+// whole repo and METADATA files apply per directory, rules are placed in the
+// directory that they are anchored to, and copied into deeper directories that
+// they would otherwise be overridden by.
+func ImportCodeowners(repo *Repo, path string, opts ImportOptions) (*OwnersImport, error) {
+	imp, err := newOwnersImporter(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := repo.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	codeowners, err := ParseCodeowners(strings.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range imp.files {
+		imp.expected[file], _ = codeowners.Owners(file)
+	}
+
+	dirs := make(StringSet)
+	for _, file := range imp.files {
+		for dir := dirOfRelativePath(file); dir != ""; dir = dirOfRelativePath(dir) {
+			dirs.Add(dir)
+		}
+	}
+
+	hosts := make(StringSet)
+	for _, rule := range codeowners.Rules {
+		dir, entry, err := translateCodeownersPattern(rule.Pattern, dirs)
+		if err != nil {
+			imp.problem(path, rule.Line, "Cannot translate pattern '%s': %v", rule.Pattern, err)
+			continue
+		}
+		entry.owners = rule.Owners
+		imp.entries[dir] = append(imp.entries[dir], entry)
+
+		// Entries in deeper directories win over this one, even though this
+		// rule comes later, so it has to be repeated in them
+		copied, ok := entry.scopedCopy()
+		for host := range hosts {
+			if ok && host != dir && isSubdir(dir, host) {
+				imp.entries[host] = append(imp.entries[host], copied)
+			}
+		}
+		hosts.Add(dir)
+	}
+
+	return imp.finish()
+}
+
+// translateCodeownersPattern converts a CODEOWNERS pattern into an entry in the
+// directory that it is anchored to
+func translateCodeownersPattern(pattern string, dirs StringSet) (string, importEntry, error) {
+	if strings.HasPrefix(pattern, "!") {
+		return "", importEntry{}, fmt.Errorf("negated patterns are not supported")
+	}
+
+	// Unescape, and make sure that nothing is left that globs can't express
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			b.WriteByte(pattern[i])
+			continue
+		}
+		if c == '?' || c == '[' {
+			return "", importEntry{}, fmt.Errorf("'?' and character classes are not supported by glob()")
+		}
+		b.WriteByte(c)
+	}
+	p := b.String()
+
+	anchored := strings.HasPrefix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	dirOnly := strings.HasSuffix(p, "/")
+	p = strings.TrimSuffix(p, "/")
+	if p == "" || p == "**" || (p == "*" && !anchored) {
+		return "", importEntry{}, nil
+	}
+
+	segments := strings.Split(p, "/")
+	lastHasStar := strings.Contains(segments[len(segments)-1], "*")
+	if !anchored && len(segments) == 1 {
+		// Matches at any depth
+		return "", importEntry{globs: globVariants("**/"+p, dirOnly, lastHasStar)}, nil
+	}
+
+	literal := 0
+	for literal < len(segments) && !strings.Contains(segments[literal], "*") {
+		literal++
+	}
+	if literal == len(segments) {
+		if dirOnly || dirs.Contains(p) {
+			return p, importEntry{}, nil
+		}
+		return dirOfRelativePath(p), importEntry{exact: []string{filepath.Base(p)}}, nil
+	}
+
+	dir := strings.Join(segments[:literal], "/")
+	rest := strings.Join(segments[literal:], "/")
+	globs := globVariants(rest, dirOnly, lastHasStar)
+	for _, glob := range globs {
+		if _, err := NewGlob(glob); err != nil {
+			return "", importEntry{}, err
+		}
+	}
+	return filepath.FromSlash(dir), importEntry{globs: globs}, nil
+}
+
+// globVariants returns the globs that match the same files as a CODEOWNERS
+// pattern relative to its directory. In CODEOWNERS, "**/" matches zero or more
+// directories, but in a glob it matches at least one, so each one is also
+// tried without it. Patterns that match a directory also match everything
+// below it, unless their last segment has a '*'.
+func globVariants(pattern string, dirOnly, lastHasStar bool) []string {
+	variants := []string{pattern}
+	for {
+		expanded := make([]string, 0)
+		for _, v := range variants {
+			i := strings.Index(v, "**/")
+			if i >= 0 && (i == 0 || v[i-1] == '/') {
+				expanded = append(expanded, v[:i]+v[i+3:])
+			}
+		}
+		added := false
+		for _, v := range expanded {
+			if !containsString(variants, v) {
+				variants = append(variants, v)
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	globs := make([]string, 0, len(variants)*2)
+	for _, v := range variants {
+		if !dirOnly {
+			globs = append(globs, v)
+		}
+		if dirOnly || !lastHasStar {
+			globs = append(globs, v+"/**")
+		}
+	}
+	return globs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedCopy returns a copy of an entry that matches the same files when it is
+// put in a subdirectory, if there is one
+func (e importEntry) scopedCopy() (importEntry, bool) {
+	if len(e.exact) == 0 && len(e.globs) == 0 {
+		return e, true
+	}
+
+	globs := make([]string, 0)
+	for _, glob := range e.globs {
+		if strings.HasPrefix(glob, "**/") {
+			globs = append(globs, glob, glob[3:])
+		}
+	}
+	if len(globs) == 0 {
+		return importEntry{}, false
+	}
+	return importEntry{owners: e.owners, globs: globs}, true
+}
+
+func isSubdir(dir, sub string) bool {
+	return dir == "" || strings.HasPrefix(sub, dir+string(filepath.Separator))
+}
+
+// chromiumOwners is a parsed Chromium OWNERS file
+type chromiumOwners struct {
+	path     string
+	owners   []string
+	noparent bool
+	perFile  []chromiumPerFile
+}
+
+type chromiumPerFile struct {
+	globs    []string
+	owners   []string
+	noparent bool
+}
+
+// ImportChromiumOwners translates every Chromium OWNERS file in the repo into
+// METADATA files. Owners are inherited from parent directories unless an
+// OWNERS file has "set noparent", and "per-file" rules add owners for the files
+// in a directory that match a glob. The imported METADATA files have the
+// effective owners of each directory written out in full.
+func ImportChromiumOwners(repo *Repo, opts ImportOptions) (*OwnersImport, error) {
+	imp, err := newOwnersImporter(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ownersFiles := make(map[string]*chromiumOwners)
+	for _, file := range imp.files {
+		if filepath.Base(file) != "OWNERS" {
+			continue
+		}
+		parsed, err := imp.parseChromiumOwners(file)
+		if err != nil {
+			return nil, err
+		}
+		ownersFiles[dirOfRelativePath(file)] = parsed
+	}
+
+	// The effective owners of every directory with an OWNERS file
+	effective := make(map[string][]string)
+	var effectiveOwners func(dir string) []string
+	effectiveOwners = func(dir string) []string {
+		if owners, ok := effective[dir]; ok {
+			return owners
+		}
+		o := ownersFiles[dir]
+		owners := append([]string{}, o.owners...)
+		if !o.noparent {
+			if parent, ok := nearestOwnersDir(ownersFiles, dir, false); ok {
+				owners = appendUnique(owners, effectiveOwners(parent)...)
+			}
+		}
+		effective[dir] = owners
+		return owners
+	}
+
+	dirs := make([]string, 0, len(ownersFiles))
+	for dir := range ownersFiles {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		o := ownersFiles[dir]
+		base := effectiveOwners(dir)
+		imp.entries[dir] = append(imp.entries[dir], importEntry{owners: base})
+
+		for _, rule := range combinePerFile(o.perFile) {
+			owners := append([]string{}, rule.owners...)
+			if !rule.noparent {
+				owners = appendUnique(owners, base...)
+			}
+			imp.entries[dir] = append(imp.entries[dir], importEntry{owners: owners, globs: rule.globs})
+		}
+	}
+
+	for _, file := range imp.files {
+		dir, ok := nearestOwnersDir(ownersFiles, dirOfRelativePath(file), true)
+		if !ok {
+			imp.expected[file] = nil
+			continue
+		}
+
+		var perFile []string
+		noparent := false
+		matched := false
+		for _, rule := range ownersFiles[dir].perFile {
+			if matchesAnyGlob(rule.globs, dir, file) {
+				perFile = appendUnique(perFile, rule.owners...)
+				noparent = noparent || rule.noparent
+				matched = true
+			}
+		}
+		if !matched {
+			imp.expected[file] = effectiveOwners(dir)
+		} else if noparent {
+			imp.expected[file] = perFile
+		} else {
+			imp.expected[file] = appendUnique(perFile, effectiveOwners(dir)...)
+		}
+	}
+
+	return imp.finish()
+}
+
+// combinePerFile combines per-file rules with the same patterns, which are
+// commonly used to set noparent and the owners on separate lines
+func combinePerFile(rules []chromiumPerFile) []chromiumPerFile {
+	combined := make([]chromiumPerFile, 0, len(rules))
+	index := make(map[string]int)
+	for _, rule := range rules {
+		k := strings.Join(rule.globs, "\x00")
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(combined)
+			combined = append(combined, chromiumPerFile{globs: rule.globs})
+			i = len(combined) - 1
+		}
+		combined[i].owners = appendUnique(combined[i].owners, rule.owners...)
+		combined[i].noparent = combined[i].noparent || rule.noparent
+	}
+	return combined
+}
+
+// nearestOwnersDir returns the closest directory to dir, or above it, with an
+// OWNERS file
+func nearestOwnersDir(ownersFiles map[string]*chromiumOwners, dir string, includeSelf bool) (string, bool) {
+	if includeSelf {
+		if _, ok := ownersFiles[dir]; ok {
+			return dir, true
+		}
+	}
+	for dir != "" {
+		dir = dirOfRelativePath(dir)
+		if _, ok := ownersFiles[dir]; ok {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+func matchesAnyGlob(globs []string, dir, file string) bool {
+	for _, pattern := range globs {
+		glob, err := NewGlobRelativeTo(pattern, dir)
+		if err == nil && glob.Match(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		if !containsString(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (imp *ownersImporter) parseChromiumOwners(path string) (*chromiumOwners, error) {
+	o := &chromiumOwners{path: path}
+	lines, err := imp.readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range lines {
+		lineNumber := i + 1
+		line = strings.TrimSpace(line)
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = strings.TrimSpace(line[:comment])
+		}
+
+		switch {
+		case line == "":
+		case line == "set noparent":
+			o.noparent = true
+		case strings.HasPrefix(line, "per-file "):
+			rule, ok := imp.parsePerFile(path, lineNumber, strings.TrimPrefix(line, "per-file "))
+			if ok {
+				o.perFile = append(o.perFile, rule)
+			}
+		case strings.HasPrefix(line, "file:") || strings.HasPrefix(line, "include "):
+			o.owners = appendUnique(o.owners, imp.includedOwners(path, lineNumber, line, 0)...)
+		case isChromiumOwner(line):
+			o.owners = appendUnique(o.owners, line)
+		default:
+			imp.problem(path, lineNumber, "Cannot translate '%s'", line)
+		}
+	}
+	return o, nil
+}
+
+func (imp *ownersImporter) parsePerFile(path string, lineNumber int, rule string) (chromiumPerFile, bool) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 {
+		imp.problem(path, lineNumber, "Cannot translate per-file rule without '=': '%s'", rule)
+		return chromiumPerFile{}, false
+	}
+
+	perFile := chromiumPerFile{}
+	for _, glob := range strings.Split(parts[0], ",") {
+		glob = strings.TrimSpace(glob)
+		if strings.ContainsAny(glob, "?[") {
+			imp.problem(path, lineNumber, "Cannot translate per-file pattern '%s': '?' and character classes are not supported by glob()", glob)
+			continue
+		}
+		if _, err := NewGlob(glob); err != nil {
+			imp.problem(path, lineNumber, "Cannot translate per-file pattern '%s': %v", glob, err)
+			continue
+		}
+		perFile.globs = append(perFile.globs, glob)
+	}
+	if len(perFile.globs) == 0 {
+		return chromiumPerFile{}, false
+	}
+
+	owners := strings.TrimSpace(parts[1])
+	switch {
+	case owners == "set noparent":
+		perFile.noparent = true
+	case strings.HasPrefix(owners, "file:") || strings.HasPrefix(owners, "include "):
+		perFile.owners = imp.includedOwners(path, lineNumber, owners, 0)
+	default:
+		for _, owner := range strings.Split(owners, ",") {
+			owner = strings.TrimSpace(owner)
+			if isChromiumOwner(owner) {
+				perFile.owners = appendUnique(perFile.owners, owner)
+			} else if owner != "" {
+				imp.problem(path, lineNumber, "Cannot translate per-file owner '%s'", owner)
+			}
+		}
+	}
+	return perFile, true
+}
+
+// Deepest chain of includes that is followed
+const maxIncludeDepth = 10
+
+// includedOwners returns the plain owners of an OWNERS file included with
+// "file://path" or "include path". Rules other than plain owners in included
+// files are ignored, like Chromium does.
+func (imp *ownersImporter) includedOwners(path string, lineNumber int, line string, depth int) []string {
+	target := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, "include "), "file:"))
+	if strings.HasPrefix(target, "//") {
+		target = target[2:]
+	} else {
+		target = filepath.Join(dirOfRelativePath(path), target)
+	}
+
+	if depth > maxIncludeDepth {
+		imp.problem(path, lineNumber, "Cannot include '%s': too many nested includes", target)
+		return nil
+	}
+	lines, err := imp.readLines(target)
+	if err != nil {
+		imp.problem(path, lineNumber, "Cannot include '%s': %v", target, err)
+		return nil
+	}
+
+	owners := make([]string, 0)
+	for i, included := range lines {
+		included = strings.TrimSpace(included)
+		if comment := strings.Index(included, "#"); comment >= 0 {
+			included = strings.TrimSpace(included[:comment])
+		}
+		switch {
+		case strings.HasPrefix(included, "file:") || strings.HasPrefix(included, "include "):
+			owners = appendUnique(owners, imp.includedOwners(target, i+1, included, depth+1)...)
+		case isChromiumOwner(included):
+			owners = appendUnique(owners, included)
+		}
+	}
+	return owners
+}
+
+// isChromiumOwner reports whether a line of an OWNERS file is an owner, which
+// is an email address or "*" for everyone
+func isChromiumOwner(s string) bool {
+	return s == "*" || (strings.Contains(s, "@") && !strings.ContainsAny(s, " \t=,"))
+}
+
+func (imp *ownersImporter) readLines(path string) ([]string, error) {
+	contents, err := imp.repo.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// finish renders the METADATA files, then checks that every file gets the
+// owners it is expected to. Files that don't are given explicit entries in
+// their own directory, which wins over everything else.
+func (imp *ownersImporter) finish() (*OwnersImport, error) {
+	result := &OwnersImport{Problems: imp.problems}
+
+	mismatches, err := imp.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mismatches) > 0 {
+		explicit := make(map[string]map[string]*importEntry)
+		order := make(map[string][]string)
+		for _, file := range mismatches {
+			dir := dirOfRelativePath(file)
+			owners := imp.expected[file]
+			k := strings.Join(owners, "\x00")
+			if explicit[dir] == nil {
+				explicit[dir] = make(map[string]*importEntry)
+			}
+			entry, ok := explicit[dir][k]
+			if !ok {
+				entry = &importEntry{owners: owners}
+				explicit[dir][k] = entry
+				order[dir] = append(order[dir], k)
+			}
+			entry.exact = append(entry.exact, filepath.Base(file))
+		}
+		for dir, keys := range order {
+			for _, k := range keys {
+				imp.entries[dir] = append(imp.entries[dir], *explicit[dir][k])
+			}
+		}
+		result.ExplicitFiles = mismatches
+
+		if mismatches, err = imp.verify(); err != nil {
+			return nil, err
+		}
+		result.Mismatches = mismatches
+	}
+
+	result.Files = imp.render()
+	return result, nil
+}
+
+// verify parses the rendered METADATA files and returns the files whose owners
+// are not the expected ones
+func (imp *ownersImporter) verify() ([]string, error) {
+	files := imp.render()
+
+	repo := *imp.repo
+	if repo.MetadataFilename == "" {
+		repo.MetadataFilename = defaultMetadataFilename
+	}
+	metadataFiles, err := repo.MetadataFiles()
+	if err != nil {
+		return nil, err
+	}
+	for path := range files {
+		if !repo.IsMetadataFile(filepath.Base(path)) {
+			continue
+		}
+		if _, err := fs.Stat(repo.fsys(), filepath.ToSlash(path)); err == nil {
+			continue
+		}
+		file, err := repo.newFile(filepath.Join(repo.Root, path))
+		if err != nil {
+			return nil, err
+		}
+		metadataFiles = append(metadataFiles, file)
+	}
+
+	parser := NewParser(&repo, WithOverlay(files))
+	results, err := parser.ParseAll(metadataFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse imported METADATA files: %v", err)
+	}
+	tree := NewMetadataTree(results)
+
+	mismatches := make([]string, 0)
+	for _, file := range imp.files {
+		value, err := tree.Get(file, imp.opts.Key)
+		if _, ok := err.(NoMetadataFoundError); ok {
+			value = nil
+		} else if err != nil {
+			return nil, err
+		}
+		owners, err := OwnersFromValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot use '%s' metadata for '%s' as owners: %v", imp.opts.Key, file, err)
+		}
+		if !sameOwners(owners, appendUnique(nil, imp.expected[file]...)) {
+			mismatches = append(mismatches, file)
+		}
+	}
+	return mismatches, nil
+}
+
+// render returns the contents of the .meta file and every METADATA file with
+// entries
+func (imp *ownersImporter) render() map[string]string {
+	repo := *imp.repo
+	if repo.MetadataFilename == "" {
+		repo.MetadataFilename = defaultMetadataFilename
+	}
+
+	files := map[string]string{
+		imp.opts.MetaPath: fmt.Sprintf(importedOwnersMeta, starlark.String(imp.opts.Key)),
+	}
+
+	for dir, entries := range imp.entries {
+		if len(entries) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		path := repo.metadataFileIn(dir)
+		if existing, err := imp.repo.ReadFile(path); err == nil {
+			b.WriteString(existing)
+			if !strings.HasSuffix(existing, "\n") {
+				b.WriteString("\n")
+			}
+			b.WriteString("\n")
+		}
+
+		// The owners function is loaded under a private name, so it can't
+		// clash with anything the existing file already binds
+		b.WriteString("# Owners imported by `meta import`\n")
+		fmt.Fprintf(&b, "load(%s, %s = \"owners\")\n\n", starlark.String("//"+filepath.ToSlash(imp.opts.MetaPath)), importedOwnersName)
+		for _, entry := range entries {
+			b.WriteString(importedOwnersName + "(")
+			writeStringList(&b, entry.owners)
+			if len(entry.exact) > 0 || len(entry.globs) > 0 {
+				b.WriteString(", files=[")
+				for i, file := range entry.exact {
+					if i > 0 {
+						b.WriteString(", ")
+					}
+					b.WriteString(starlark.String(file).String())
+				}
+				for i, glob := range entry.globs {
+					if i > 0 || len(entry.exact) > 0 {
+						b.WriteString(", ")
+					}
+					fmt.Fprintf(&b, "glob(%s)", starlark.String(glob))
+				}
+				b.WriteString("]")
+			}
+			b.WriteString(")\n")
+		}
+		files[path] = b.String()
+	}
+	return files
+}
+
+func writeStringList(b *strings.Builder, list []string) {
+	b.WriteString("[")
+	for i, s := range list {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(starlark.String(s).String())
+	}
+	b.WriteString("]")
+}
+
+// Name that imported METADATA files load the owners function as
+const importedOwnersName = "_imported_owners"
+
+// The .meta file written by an import. Deeper METADATA files and later entries
+// replace owners instead of adding to them, since the imported entries already
+// have the effective owners written out.
+const importedOwnersMeta = `# Generated by ` + "`meta import`" + `. METADATA files in subdirectories replace
+# the owners of their parents, and later owners() calls in a METADATA file
+# replace the owners set by earlier ones.
+
+def _owners_vertical_merge(upper, lower):
+    return lower
+
+def _owners_horizontal_merge(left, right):
+    return right
+
+owners = meta(
+    key = %s,
+    vertical_merge = _owners_vertical_merge,
+    horizontal_merge = _owners_horizontal_merge,
+)
+`
@@ -0,0 +1,139 @@
+package metadata
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importedOwners writes the files of an import and returns the owners of
+// every file in the resulting tree
+func importedOwners(t *testing.T, root string, imp *OwnersImport, files []string) map[string][]string {
+	writeFiles(t, root, imp.Files)
+	tree, err := NewEagerTree(root)
+	require.NoError(t, err)
+
+	owners := make(map[string][]string)
+	for _, file := range files {
+		value, err := tree.Get(file, "owners")
+		if _, ok := err.(NoMetadataFoundError); ok {
+			continue
+		}
+		require.NoError(t, err)
+		owners[file], err = OwnersFromValue(value)
+		require.NoError(t, err)
+	}
+	return owners
+}
+
+func TestImportCodeowners(t *testing.T) {
+	root := t.TempDir()
+	files := []string{"README.md", "main.js", "a/main.go", "a/web/app.js", "a/file1.txt", "docs/guide.md", "docs/deep/x.md"}
+	contents := map[string]string{
+		".github/CODEOWNERS": `* @everyone
+/a/ @team-a
+*.js @js
+/docs/*.md @docs
+/a/file[0-9].txt @numbers
+`,
+		"a/METADATA": "metadata(key=\"tier\", value=1)\n",
+	}
+	for _, file := range files {
+		contents[file] = ""
+	}
+	writeFiles(t, root, contents)
+
+	imp, err := ImportCodeowners(&Repo{Root: root}, ".github/CODEOWNERS", ImportOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, imp.Mismatches)
+	require.Len(t, imp.Problems, 1)
+	assert.Equal(t, 5, imp.Problems[0].Line)
+	assert.Contains(t, imp.Problems[0].String(), "character classes")
+	assert.Equal(t, []string{"a/file1.txt"}, imp.ExplicitFiles)
+
+	assert.Contains(t, imp.Files, "owners.meta")
+	assert.Equal(t, `metadata(key="tier", value=1)
+
+# Owners imported by `+"`meta import`"+`
+load("//owners.meta", _imported_owners = "owners")
+
+_imported_owners(["@team-a"])
+_imported_owners(["@js"], files=[glob("**/*.js"), glob("*.js")])
+_imported_owners(["@numbers"], files=["file1.txt"])
+`, imp.Files["a/METADATA"])
+
+	assert.Equal(t, map[string][]string{
+		"README.md":      {"@everyone"},
+		"main.js":        {"@js"},
+		"a/main.go":      {"@team-a"},
+		"a/web/app.js":   {"@js"},
+		"a/file1.txt":    {"@numbers"},
+		"docs/guide.md":  {"@docs"},
+		"docs/deep/x.md": {"@everyone"},
+	}, importedOwners(t, root, imp, files))
+}
+
+func TestImportChromiumOwners(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"OWNERS": "root@example.com\n",
+		"a/OWNERS": `# comment
+a@example.com
+per-file *.py=py@example.com
+per-file BUILD=set noparent
+per-file BUILD=build@example.com
+`,
+		"a/b/OWNERS": `set noparent
+file://common/OWNERS
+COMPONENT: Foo
+`,
+		"common/OWNERS": "common@example.com\nper-file *=ignored@example.com\n",
+		"a/main.py":     "",
+		"a/main.cc":     "",
+		"a/BUILD":       "",
+		"a/b/c/x.cc":    "",
+	})
+
+	imp, err := ImportChromiumOwners(&Repo{Root: root}, ImportOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, imp.Mismatches)
+	assert.Empty(t, imp.ExplicitFiles)
+	require.Len(t, imp.Problems, 1)
+	assert.Equal(t, "a/b/OWNERS:3: Cannot translate 'COMPONENT: Foo'", imp.Problems[0].String())
+
+	owners := importedOwners(t, root, imp, []string{"a/main.py", "a/main.cc", "a/BUILD", "a/b/c/x.cc", "OWNERS"})
+	assert.Equal(t, map[string][]string{
+		"OWNERS":     {"root@example.com"},
+		"a/main.py":  {"py@example.com", "a@example.com", "root@example.com"},
+		"a/main.cc":  {"a@example.com", "root@example.com"},
+		"a/BUILD":    {"build@example.com"},
+		"a/b/c/x.cc": {"common@example.com"},
+	}, owners)
+	assert.True(t, strings.HasPrefix(imp.Files["a/b/METADATA"], "# Owners imported by `meta import`\n"))
+}
+
+func TestImportIntoMetadataFileThatBindsOwners(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".github/CODEOWNERS": "/a/ @team-a\n",
+		"team.meta":          "owners = meta(key = \"team_owners\")\n",
+		"a/METADATA":         "load(\"//team.meta\", \"owners\")\n\nowners([\"@old\"])\n",
+		"a/main.go":          "",
+	})
+
+	imp, err := ImportCodeowners(&Repo{Root: root}, ".github/CODEOWNERS", ImportOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, imp.Mismatches)
+
+	assert.Equal(t, map[string][]string{
+		"a/main.go": {"@team-a"},
+	}, importedOwners(t, root, imp, []string{"a/main.go"}))
+
+	tree, err := NewEagerTree(root)
+	require.NoError(t, err)
+	value, err := tree.Get("a/main.go", "team_owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["@old"]`, value.String())
+}
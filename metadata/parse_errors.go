@@ -0,0 +1,140 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// ParseError is an error from parsing a METADATA file
+type ParseError struct {
+	// Repo-relative path of the METADATA file
+	File string
+
+	// Where parsing the file failed in it. For errors in a module that the
+	// file loads, this is the load() of the module.
+	Pos syntax.Position
+
+	Err error
+}
+
+func newParseError(file string, err error) *ParseError {
+	e := &ParseError{File: file, Err: err}
+	for cause := err; cause != nil; cause = errors.Unwrap(cause) {
+		var pos syntax.Position
+		switch cause := cause.(type) {
+		case *LoadError:
+			pos = cause.Pos
+		case syntax.Error:
+			pos = cause.Pos
+		case resolve.ErrorList:
+			if len(cause) > 0 {
+				pos = cause[0].Pos
+			}
+		case *starlark.EvalError:
+			// The outermost call in the file
+			for _, frame := range cause.CallStack {
+				if frame.Pos.Filename() == file {
+					pos = frame.Pos
+					break
+				}
+			}
+		}
+		if pos.IsValid() && pos.Filename() == file {
+			e.Pos = pos
+			break
+		}
+	}
+	return e
+}
+
+func (e *ParseError) Error() string {
+	return errorMessage(e.Err)
+}
+
+// errorMessage returns the message of an error, with where it happened for
+// evaluation errors, whose messages don't say
+func errorMessage(err error) string {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		// The innermost call that isn't to a builtin
+		for i := len(evalErr.CallStack) - 1; i >= 0; i-- {
+			if pos := evalErr.CallStack[i].Pos; pos.Line > 0 {
+				return fmt.Sprintf("%s: %s", pos, evalErr.Msg)
+			}
+		}
+	}
+	return err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors is every error from parsing the METADATA files of a repo, with
+// WithKeepGoing
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d METADATA files failed to parse:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+func (e ParseErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// TaintedError is returned for files under a METADATA file that failed to
+// parse, since their metadata would be missing whatever it sets
+type TaintedError struct {
+	Path string
+	Err  *ParseError
+}
+
+func (e TaintedError) Error() string {
+	return fmt.Sprintf("Cannot get metadata for '%s': %s failed to parse: %v", e.Path, e.Err.File, e.Err)
+}
+
+func (e TaintedError) Unwrap() error {
+	return e.Err
+}
+
+// taint marks the directories of METADATA files that failed to parse
+func (m *MetadataTree) taint(errs ParseErrors) {
+	for _, err := range errs {
+		tree := m
+		if dir := dirOfRelativePath(err.File); dir != "" {
+			for _, dirPart := range strings.Split(dir, string(filepath.Separator)) {
+				tree = tree.get(dirPart)
+			}
+		}
+		tree.broken = err
+	}
+}
+
+// checkTainted returns a TaintedError if a METADATA file above a file failed to
+// parse
+func (m *MetadataTree) checkTainted(filePath string) error {
+	currentTree := m
+	for _, dirPart := range strings.Split(filePath, string(filepath.Separator)) {
+		if currentTree.broken != nil {
+			return TaintedError{filePath, currentTree.broken}
+		}
+		var ok bool
+		currentTree, ok = currentTree.subTrees[dirPart]
+		if !ok {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package metadata
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+func TestKeepGoing(t *testing.T) {
+	files := map[string]string{
+		"owners.meta":        ownersMeta,
+		"broken.meta":        "x = 1 +\n",
+		"METADATA":           "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"a.txt":              "a",
+		"one/METADATA":       "load(\"//owners.meta\", \"owners\")\nowners(\n",
+		"one/a.txt":          "a",
+		"one/sub/METADATA":   "load(\"//owners.meta\", \"owners\")\nowners([\"bob\"])\n",
+		"one/sub/a.txt":      "a",
+		"two/METADATA":       "load(\"//owners.meta\", \"owners\")\n\nowners(undefined)\n",
+		"two/a.txt":          "a",
+		"three/METADATA":     "\n\nload(\"//broken.meta\", \"x\")\n",
+		"four/METADATA":      "load(\"//owners.meta\", \"owners\")\nowners([\"carol\"])\n",
+		"four/a.txt":         "a",
+		"five/METADATA":      "def f():\n    fail(\"oops\")\n\nf()\n",
+		"five/deeper/a.txt":  "a",
+		"four/deeper/a.txt":  "a",
+		"three/deeper/a.txt": "a",
+	}
+
+	_, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.Error(t, err)
+	assert.NotEqual(t, ParseErrors{}, err)
+
+	for _, concurrency := range []int{1, 4} {
+		tree, err := NewEagerTree("", WithFS(NewMapFS(files)), WithKeepGoing(), WithConcurrency(concurrency))
+		require.NotNil(t, tree)
+		require.IsType(t, ParseErrors{}, err)
+
+		errs := err.(ParseErrors)
+		messages := make([]string, 0)
+		positions := make([]string, 0)
+		for _, e := range errs {
+			messages = append(messages, e.Error())
+			positions = append(positions, e.Pos.String())
+		}
+		assert.ElementsMatch(t, []string{
+			"five/METADATA:2:9: fail: oops",
+			"one/METADATA:3:1: got end of file, want ')'",
+			"three/METADATA:3:1: cannot load //broken.meta: broken.meta:2:1: got newline, want primary expression",
+			"two/METADATA:3:8: undefined: undefined",
+		}, messages)
+		assert.ElementsMatch(t, []string{"five/METADATA:4:2", "one/METADATA:3:1", "three/METADATA:3:1", "two/METADATA:3:8"}, positions)
+
+		value, err := tree.Get("four/a.txt", "owners")
+		require.NoError(t, err)
+		assert.Equal(t, `["carol", "alice"]`, value.String())
+
+		// Everything under a broken METADATA file is tainted, even if a deeper
+		// METADATA file parsed
+		for _, path := range []string{"one/a.txt", "one/sub/a.txt", "two/a.txt", "three/deeper/a.txt", "five/deeper/a.txt"} {
+			_, err = tree.Get(path, "owners")
+			var tainted TaintedError
+			require.True(t, errors.As(err, &tainted), path)
+			assert.Equal(t, path, tainted.Path)
+		}
+		_, err = tree.GetClosest("one/sub/a.txt", "owners")
+		assert.IsType(t, TaintedError{}, err)
+		_, err = tree.Explain("one/sub/a.txt", "owners")
+		assert.EqualError(t, err, "Cannot get metadata for 'one/sub/a.txt': one/METADATA failed to parse: one/METADATA:3:1: got end of file, want ')'")
+	}
+
+	// A value cached before the METADATA file above it broke isn't returned
+	cache := NewMemoryCache()
+	cache.Put("one/a.txt", "owners", starlark.NewList([]starlark.Value{starlark.String("alice")}))
+	tree, _ := NewEagerTree("", WithFS(NewMapFS(files)), WithKeepGoing(), WithCache(cache))
+	_, err = tree.Get("one/a.txt", "owners")
+	assert.IsType(t, TaintedError{}, err)
+}
@@ -1,12 +1,18 @@
 package metadata
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 type ParseResult struct {
@@ -14,75 +20,416 @@ type ParseResult struct {
 	entries []Entry
 }
 
-type execFileResult struct {
-	globals starlark.StringDict
-	err     error
+// File returns the METADATA file that was parsed
+func (r ParseResult) File() MetadataFile {
+	return r.file
+}
+
+// Entries returns the metadata entries defined in the file, in the order they
+// were defined
+func (r ParseResult) Entries() []Entry {
+	return r.entries
 }
 
 type Parser struct {
-	cache         map[string]*execFileResult
+	modules       *moduleCache
 	repo          *Repo
-	metadataStore metadataStore
+	metadataStore *metadataStore
+	predeclared   starlark.StringDict
+	concurrency   int
+	metaRoots     []string
+	prelude       []string
+	keepGoing     bool
+	limits        limits
+	// repo alias -> filesystem of the repo
+	aliases    map[string]fs.FS
+	strictness Strictness
+	log        logger
+	stats      *Stats
+	programs   *programCache
+
+	// Contents to use instead of what is in the repo for some files, keyed by
+	// repo-relative path
+	overlayMu sync.RWMutex
+	overlay   map[string]string
 }
 
-func NewParser(repo *Repo) Parser {
-	return Parser{
-		cache:         make(map[string]*execFileResult),
+func NewParser(repo *Repo, opts ...Option) *Parser {
+	return newParser(repo, newOptions(opts))
+}
+
+func newParser(repo *Repo, o options) *Parser {
+	p := &Parser{
+		modules:       newModuleCache(),
 		repo:          repo,
 		metadataStore: newMetadataStore(),
+		concurrency:   o.concurrency,
+		metaRoots:     o.metaRoots,
+		prelude:       o.prelude,
+		keepGoing:     o.keepGoing,
+		limits:        limits{maxSteps: o.maxSteps, timeout: o.timeout},
+		strictness:    o.strictness,
+		log:           logger{o.logger},
+		stats:         o.stats,
+		overlay:       o.overlay,
+		aliases:       make(map[string]fs.FS),
+	}
+	for alias, dir := range o.aliases {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repo.Root, dir)
+		}
+		p.aliases[alias] = os.DirFS(dir)
+	}
+	if dir := o.cacheDir; dir != "" {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repo.Root, dir)
+		}
+		p.programs = &programCache{dir: filepath.Join(dir, "programs")}
+	}
+
+	p.predeclared = starlark.StringDict{}
+	for name, value := range o.predeclared {
+		p.predeclared[name] = value
 	}
+	p.predeclared["meta"] = starlark.NewBuiltin("meta", p.meta_new_starlark_func)
+	p.predeclared["metadata"] = starlark.NewBuiltin("metadata", p.metadata_starlark_func)
+	p.predeclared["glob"] = starlark.NewBuiltin("glob", p.glob_starlark_func)
+	p.predeclared.Freeze()
+
+	return p
 }
 
+// ParseAll parses every file. It stops at the first file that fails to parse,
+// unless the parser was made with WithKeepGoing, in which case it returns the
+// results of every file that parsed and a ParseErrors for the rest.
 func (p *Parser) ParseAll(files []MetadataFile) ([]ParseResult, error) {
-	parsed := make([]ParseResult, 0)
-	for _, file := range files {
-		p, err := p.ParseOne(file)
+	return p.ParseAllContext(context.Background(), files)
+}
+
+// ParseAllContext is ParseAll, but stops once ctx is done, with an error that
+// wraps ctx.Err() even with WithKeepGoing
+func (p *Parser) ParseAllContext(ctx context.Context, files []MetadataFile) ([]ParseResult, error) {
+	start := time.Now()
+	defer func() {
+		p.log.debug(ctx, "parsed METADATA files", "files", len(files), "concurrency", p.concurrency, "duration", time.Since(start))
+	}()
+
+	var errs ParseErrors
+	if p.concurrency <= 1 || len(files) <= 1 {
+		parsed := make([]ParseResult, 0)
+		for _, file := range files {
+			result, err := p.ParseOneContext(ctx, file)
+			if err != nil {
+				if !p.keepGoing || ctx.Err() != nil {
+					return parsed, err
+				}
+				errs = append(errs, newParseError(file.pathRelativeToRoot, err))
+				continue
+			}
+			parsed = append(parsed, result)
+		}
+		return parsed, errs.orNil()
+	}
+
+	results := make([]ParseResult, len(files))
+	fileErrs := make([]error, len(files))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < p.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i], fileErrs[i] = p.ParseOneContext(ctx, files[i])
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot parse METADATA files: %w", err)
+	}
+	parsed := make([]ParseResult, 0, len(files))
+	for i, err := range fileErrs {
 		if err != nil {
-			return parsed, err
+			// Report the same error that a sequential parse would have
+			if !p.keepGoing {
+				return parsed, err
+			}
+			errs = append(errs, newParseError(files[i].pathRelativeToRoot, err))
+			continue
 		}
-		parsed = append(parsed, p)
+		parsed = append(parsed, results[i])
 	}
-	return parsed, nil
+	return parsed, errs.orNil()
 }
 
 func (p *Parser) ParseOne(file MetadataFile) (ParseResult, error) {
+	return p.ParseOneContext(context.Background(), file)
+}
+
+// ParseOneContext is ParseOne, but stops executing Starlark code once ctx is
+// done
+func (p *Parser) ParseOneContext(ctx context.Context, file MetadataFile) (ParseResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ParseResult{}, fmt.Errorf("Cannot parse %s: %w", file.pathRelativeToRoot, err)
+	}
+	start := time.Now()
+	thread := &starlark.Thread{Name: "parse " + file.pathRelativeToRoot}
+	thread.SetLocal(loaderLocalKey, &loader{ctx: ctx})
 
-	_, execErr := p.starlarkLoadFunc(nil, "//"+file.pathRelativeToRoot)
+	_, execErr := p.starlarkLoadFunc(thread, "//"+file.pathRelativeToRoot)
 	if execErr != nil {
-		return ParseResult{}, execErr
+		return ParseResult{}, checkCancelled(ctx, execErr)
+	}
+	p.log.trace(ctx, "parsed METADATA file", "file", file.pathRelativeToRoot, "duration", time.Since(start))
+	p.stats.addParse(file.pathRelativeToRoot, time.Since(start))
+
+	// Merge functions are called concurrently by anyone querying the tree, so
+	// they must not be able to change the values that they are merging. Values
+	// are only frozen once the file is done, so that it can keep changing a
+	// value after passing it.
+	entries := p.metadataStore.get(file.pathRelativeToRoot)
+	for _, entry := range entries {
+		entry.value.Freeze()
 	}
 
 	return ParseResult{
 		file:    file,
-		entries: p.metadataStore.get(file.pathRelativeToRoot),
+		entries: entries,
 		//entries: globalMetadataStore.get(file.pathRelativeToRoot),
 	}, nil
 }
 
-func (p *Parser) starlarkLoadFunc(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-	if !strings.HasPrefix(module, "//") {
-		return nil, errors.New("Cannot load module that does not start with '//'")
+// invalidate forgets everything the parser knows about the given files, and
+// about every module that loads them, so that they are read from the repo again
+// the next time they are parsed or loaded. Returns the repo-relative paths of
+// every file that was invalidated.
+func (p *Parser) invalidate(paths []string) []string {
+	affected := p.modules.invalidate(paths)
+	for _, path := range affected {
+		p.metadataStore.clear(path)
 	}
+	return affected
+}
+
+// loads returns the repo-relative paths of every module that a file loads,
+// directly or indirectly. Only known for files that have been parsed or loaded.
+func (p *Parser) loads(path string) []string {
+	return p.modules.transitiveDeps(path)
+}
 
-	// strip leading "//"
-	path := module[2:]
+func (p *Parser) starlarkLoadFunc(parent *starlark.Thread, module string) (starlark.StringDict, error) {
+	// Only threads that are executing a module can load, so the thread name
+	// is the path of the module doing the loading
+	from := ""
+	frame := loadFrame{}
+	if parent.Load != nil {
+		from = parent.Name
+		// Prelude modules are loaded before the module starts executing
+		if parent.CallStackDepth() > 0 {
+			frame.pos = parent.CallFrame(0).Pos
+		}
+	}
 
-	result, ok := p.cache[path]
-	if result != nil {
-		return result.globals, result.err
+	path, err := p.resolveModule(from, module)
+	if err != nil {
+		return nil, err
+	}
+	if from != "" {
+		p.modules.addDep(from, path)
 	}
+	frame.path = path
 
-	// If result is nil, and it was put in the cache, then we've already started trying
-	// to load this file.
-	if ok {
-		return nil, errors.New("Cycle detected in load graph")
+	l := parent.Local(loaderLocalKey).(*loader)
+	executed := false
+	globals, err := p.modules.get(l, frame, func() (starlark.StringDict, error) {
+		executed = true
+		return p.execModule(l, path)
+	})
+	if !executed {
+		p.log.trace(l.ctx, "loaded module from cache", "module", path, "from", from)
+	}
+	if from != "" {
+		p.stats.addLoad(!executed)
+	}
+	if err != nil && from != "" {
+		// The whole cycle is already in the error
+		if cycleErr, ok := err.(*LoadCycleError); ok {
+			return nil, cycleErr
+		}
+		return nil, &LoadError{Module: module, Pos: frame.pos, Err: err}
 	}
+	return globals, err
+}
+
+// LoadError is returned when a module cannot be loaded by another one
+type LoadError struct {
+	// The module given to load()
+	Module string
+	// Where load() is called
+	Pos syntax.Position
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s: cannot load %s: %s", e.Pos, e.Module, errorMessage(e.Err))
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// resolveModule returns the path of a module given to load() by the module at
+// from, which is empty for modules that aren't loaded by another one. Paths
+// are repo-relative, or "@alias//path" for modules in an aliased repo.
+//
+// Modules can be given as:
+//   - "//path", relative to the root of the repo that from is in
+//   - "@alias//path", relative to the root of an aliased repo
+//   - ":path", "./path" or "../path", relative to the directory of from
+//   - "path", which is looked for in each of the meta roots
+func (p *Parser) resolveModule(from, module string) (string, error) {
+	alias, fromPath := splitAlias(from)
+
+	var path string
+	switch {
+	case strings.HasPrefix(module, "@"):
+		i := strings.Index(module, "//")
+		if i < 0 {
+			return "", fmt.Errorf("Cannot load module '%s': expected '@alias//path'", module)
+		}
+		alias = module[1:i]
+		if _, ok := p.aliases[alias]; !ok {
+			return "", fmt.Errorf("Cannot load module '%s': unknown repo alias '%s'", module, alias)
+		}
+		path = filepath.Clean(filepath.FromSlash(module[i+2:]))
+
+	case strings.HasPrefix(module, "//"):
+		path = filepath.Clean(filepath.FromSlash(module[2:]))
+
+	case strings.HasPrefix(module, ":"), strings.HasPrefix(module, "./"), strings.HasPrefix(module, "../"):
+		if from == "" {
+			return "", fmt.Errorf("Cannot load module '%s': relative modules can only be loaded by other modules", module)
+		}
+		rel := strings.TrimPrefix(module, ":")
+		path = filepath.Join(filepath.Dir(fromPath), filepath.FromSlash(rel))
+
+	default:
+		if len(p.metaRoots) == 0 {
+			return "", fmt.Errorf("Cannot load module '%s': it has to start with '//', '@', ':', './' or '../'", module)
+		}
+		for _, root := range p.metaRoots {
+			path := filepath.Join(root, filepath.FromSlash(module))
+			if p.exists(path) {
+				return path, nil
+			}
+		}
+		return "", fmt.Errorf("Cannot load module '%s': not found in meta roots %s", module, strings.Join(p.metaRoots, ", "))
+	}
+
+	if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) || filepath.IsAbs(path) {
+		if from == "" {
+			return "", fmt.Errorf("Cannot load module '%s': it is outside of the repo", module)
+		}
+		return "", fmt.Errorf("Cannot load module '%s' from %s: it is outside of the repo", module, from)
+	}
+	return joinAlias(alias, path), nil
+}
+
+// splitAlias splits the path of a module into the alias of the repo that it is
+// in, which is empty for this repo, and its path in that repo
+func splitAlias(path string) (string, string) {
+	if !strings.HasPrefix(path, "@") {
+		return "", path
+	}
+	i := strings.Index(path, "//")
+	return path[1:i], path[i+2:]
+}
+
+func joinAlias(alias, path string) string {
+	if alias == "" {
+		return path
+	}
+	return "@" + alias + "//" + filepath.ToSlash(path)
+}
+
+// fsFor returns the filesystem that the file at a module path is in, and its
+// path in that filesystem
+func (p *Parser) fsFor(path string) (fs.FS, string) {
+	alias, path := splitAlias(path)
+	if alias != "" {
+		return p.aliases[alias], filepath.ToSlash(path)
+	}
+	return p.repo.fsys(), filepath.ToSlash(path)
+}
+
+// exists reports whether a module path is in the repo or the overlay
+func (p *Parser) exists(path string) bool {
+	if p.hasOverlay(path) {
+		return true
+	}
+	fsys, name := p.fsFor(path)
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
+
+// load returns the globals of a module, executing it if it hasn't been loaded
+// yet
+func (p *Parser) load(ctx context.Context, path string) (starlark.StringDict, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot load %s: %w", path, err)
+	}
+	thread := &starlark.Thread{Name: "load " + path}
+	thread.SetLocal(loaderLocalKey, &loader{ctx: ctx})
+	globals, err := p.starlarkLoadFunc(thread, "//"+path)
+	return globals, checkCancelled(ctx, err)
+}
+
+func (p *Parser) setOverlay(path, contents string) {
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+	p.overlay[path] = contents
+}
+
+func (p *Parser) removeOverlay(path string) {
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+	delete(p.overlay, path)
+}
+
+func (p *Parser) hasOverlay(path string) bool {
+	p.overlayMu.RLock()
+	defer p.overlayMu.RUnlock()
+	_, ok := p.overlay[path]
+	return ok
+}
 
-	// Start actually loading the module. Mark that load is in progress by adding
-	// nil to the cache
-	p.cache[path] = nil
+func (p *Parser) readFile(path string) (string, error) {
+	p.overlayMu.RLock()
+	contents, ok := p.overlay[path]
+	p.overlayMu.RUnlock()
+	if ok {
+		return contents, nil
+	}
+	if alias, _ := splitAlias(path); alias != "" {
+		fsys, name := p.fsFor(path)
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return "", fmt.Errorf("Could not get contents of %s: %v", path, err)
+		}
+		return string(contents), nil
+	}
+	return p.repo.ReadFile(path)
+}
 
-	fileContents, err := p.repo.ReadFile(path)
+func (p *Parser) execModule(l *loader, path string) (starlark.StringDict, error) {
+	fileContents, err := p.readFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -92,23 +439,70 @@ func (p *Parser) starlarkLoadFunc(_ *starlark.Thread, module string) (starlark.S
 	// 	threadName = ""
 	// }
 
-	thread := &starlark.Thread{
-		Name: threadName,
-		Load: p.starlarkLoadFunc,
-	}
+	thread, done := p.limits.newThread(l.ctx, threadName)
+	defer done()
+	thread.Load = p.starlarkLoadFunc
+	thread.SetLocal(loaderLocalKey, l)
 
-	predeclared := starlark.StringDict{
-		"meta":     starlark.NewBuiltin("meta", p.meta_new_starlark_func),
-		"metadata": starlark.NewBuiltin("metadata", p.metadata_starlark_func),
-		"glob":     starlark.NewBuiltin("glob", glob_starlark_func),
+	start := time.Now()
+	defer func() {
+		p.log.trace(l.ctx, "executed module", "module", path, "duration", time.Since(start))
+		p.stats.addModule(path, time.Since(start))
+	}()
+
+	predeclared := p.predeclared
+	if len(p.prelude) > 0 && p.repo.IsMetadataFile(filepath.Base(path)) {
+		predeclared, err = p.preludeGlobals(thread)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	globals, execErr := starlark.ExecFile(thread, threadName, fileContents, predeclared)
-	result = &execFileResult{globals, execErr}
+	prog, cached, err := p.programs.compile(threadName, fileContents, predeclared)
+	if p.programs != nil {
+		p.stats.addProgramLookup(cached)
+	}
+	if err != nil {
+		return nil, err
+	}
+	globals, err := prog.Init(thread, predeclared)
+	globals.Freeze()
+	if err != nil {
+		// Leave out the "cannot load" that Starlark adds, since the errors
+		// from starlarkLoadFunc say where the load failed
+		var loadErr *LoadError
+		var cycleErr *LoadCycleError
+		if errors.As(err, &cycleErr) {
+			return nil, cycleErr
+		} else if errors.As(err, &loadErr) && loadErr.Pos.Filename() == path {
+			return nil, loadErr
+		}
+	}
+	return globals, err
+}
 
-	p.cache[path] = result
+// preludeGlobals loads the prelude modules from the thread of a METADATA file,
+// and returns its predeclared globals with their public globals added
+func (p *Parser) preludeGlobals(thread *starlark.Thread) (starlark.StringDict, error) {
+	predeclared := make(starlark.StringDict, len(p.predeclared))
+	for name, value := range p.predeclared {
+		predeclared[name] = value
+	}
 
-	return result.globals, result.err
+	for _, module := range p.prelude {
+		globals, err := p.starlarkLoadFunc(thread, module)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load prelude module '%s': %v", module, err)
+		}
+		for name, value := range globals {
+			// The builtins of this package cannot be overridden
+			if strings.HasPrefix(name, "_") || name == "meta" || name == "metadata" || name == "glob" {
+				continue
+			}
+			predeclared[name] = value
+		}
+	}
+	return predeclared, nil
 }
 
 func (p *Parser) meta_new_starlark_func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -126,38 +520,62 @@ func (p *Parser) meta_new_starlark_func(thread *starlark.Thread, b *starlark.Bui
 		return nil, err
 	}
 
-	returnFunc := starlark.NewBuiltin("metadata", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return &StarlarkMeta{
+		parser:          p,
+		key:             key,
+		verticalMerge:   verticalMergeFunc,
+		horizontalMerge: horizontalMergeFunc,
+		pos:             thread.CallFrame(1).Pos,
+	}, nil
+}
 
-		var value starlark.Value
-		var filesArg starlark.Value
-		if err := starlark.UnpackArgs(b.Name(), args, kwargs,
-			"value", &value,
-			"files?", &filesArg,
-		); err != nil {
-			return nil, err
-		}
+// addEntry is the implementation of calling the function returned by meta()
+func (m *StarlarkMeta) addEntry(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var value starlark.Value
+	var filesArg starlark.Value
+	if err := starlark.UnpackArgs(m.Name(), args, kwargs,
+		"value", &value,
+		"files?", &filesArg,
+	); err != nil {
+		return nil, err
+	}
+	if thread.Local(loaderLocalKey) == nil {
+		return nil, fmt.Errorf("Cannot set '%s': entries can only be added by METADATA files", m.key)
+	}
 
-		fileMatchSet, err := handleFilesArg(filesArg, dirOfRelativePath(thread.Name))
-		if err != nil {
-			return nil, err
-		}
+	fileMatchSet, err := m.parser.handleFilesArg(filesArg, thread)
+	if err != nil {
+		return nil, err
+	}
 
-		entry := Entry{
-			key:               key,
-			value:             value,
-			fileMatchSet:      fileMatchSet,
-			mergeVertically:   newVerticalMerger(verticalMergeFunc),
-			mergeHorizontally: newHorizontalMerger(horizontalMergeFunc),
-		}
+	entry := Entry{
+		key:               m.key,
+		value:             value,
+		file:              thread.Name,
+		pos:               callerPosition(thread),
+		fileMatchSet:      fileMatchSet,
+		mergeVertically:   m.parser.newVerticalMerger(m.key, m.verticalMerge),
+		mergeHorizontally: m.parser.newHorizontalMerger(m.key, m.horizontalMerge),
+	}
 
-		p.metadataStore.addEntry(thread.Name, entry)
-		return starlark.None, nil
-	})
+	m.parser.metadataStore.addEntry(thread.Name, entry)
+	return starlark.None, nil
+}
 
-	return returnFunc, nil
+// callerPosition returns the innermost position in the call stack that is in
+// the file that the thread is executing, so that entries added by helper
+// functions in .meta files point at the line in METADATA that called them
+func callerPosition(thread *starlark.Thread) syntax.Position {
+	stack := thread.CallStack()
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Pos.Filename() == thread.Name {
+			return stack[i].Pos
+		}
+	}
+	return syntax.Position{}
 }
 
-func glob_starlark_func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+func (p *Parser) glob_starlark_func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 
 	var pattern string
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
@@ -166,10 +584,12 @@ func glob_starlark_func(thread *starlark.Thread, b *starlark.Builtin, args starl
 		//TODO: Add some way to show the file name in this error?
 		return nil, err
 	}
+	start := time.Now()
 	glob, err := NewGlobRelativeTo(pattern, dirOfRelativePath(thread.Name))
 	if err != nil {
 		return nil, err
 	}
+	p.log.trace(loaderContext(thread), "compiled glob", "file", thread.Name, "pattern", pattern, "duration", time.Since(start))
 
 	return &StarlarkGlob{glob}, nil
 }
@@ -188,15 +608,23 @@ func (p *Parser) metadata_starlark_func(thread *starlark.Thread, b *starlark.Bui
 		return nil, err
 	}
 
-	fileMatchSet, err := handleFilesArg(filesArg, dirOfRelativePath(thread.Name))
+	if p.strictness.DeclaredKeys {
+		return nil, fmt.Errorf("Cannot set '%s' with metadata(): keys have to be declared with meta() in strict mode", key)
+	}
+
+	fileMatchSet, err := p.handleFilesArg(filesArg, thread)
 	if err != nil {
 		return nil, err
 	}
 
 	entry := Entry{
-		key:          key,
-		value:        value,
-		fileMatchSet: fileMatchSet,
+		key:               key,
+		value:             value,
+		file:              thread.Name,
+		pos:               callerPosition(thread),
+		fileMatchSet:      fileMatchSet,
+		mergeVertically:   p.newVerticalMerger(key, nil),
+		mergeHorizontally: p.newHorizontalMerger(key, nil),
 	}
 
 	p.metadataStore.addEntry(thread.Name, entry)
@@ -204,6 +632,22 @@ func (p *Parser) metadata_starlark_func(thread *starlark.Thread, b *starlark.Bui
 	return starlark.None, nil
 }
 
+// handleFilesArg parses the files argument of an entry added by a thread
+func (p *Parser) handleFilesArg(filesArg starlark.Value, thread *starlark.Thread) (*FileMatchSet, error) {
+	fileMatchSet, err := handleFilesArg(filesArg, dirOfRelativePath(thread.Name))
+	if err != nil {
+		return nil, err
+	}
+	if p.strictness.ExistingFiles {
+		for path := range fileMatchSet.exactMatches {
+			if !p.exists(path) {
+				return nil, fmt.Errorf("Cannot use files=[...]: %s does not exist", path)
+			}
+		}
+	}
+	return fileMatchSet, nil
+}
+
 func handleFilesArg(filesArg starlark.Value, relativeDir string) (*FileMatchSet, error) {
 	exactMatchSet := make(StringSet)
 	globList := make([]*Glob, 0)
@@ -240,17 +684,20 @@ func handleFilesArg(filesArg starlark.Value, relativeDir string) (*FileMatchSet,
 	}, nil
 }
 
-func newMetadataStore() metadataStore {
-	return metadataStore{
+func newMetadataStore() *metadataStore {
+	return &metadataStore{
 		store: make(map[string][]Entry),
 	}
 }
 
 type metadataStore struct {
+	mu    sync.Mutex
 	store map[string][]Entry
 }
 
 func (m *metadataStore) addEntry(path string, entry Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if val, ok := m.store[path]; ok {
 		val = append(val, entry)
 		m.store[path] = val
@@ -261,44 +708,121 @@ func (m *metadataStore) addEntry(path string, entry Entry) {
 	}
 }
 
+func (m *metadataStore) clear(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.store, path)
+}
+
 func (m *metadataStore) get(path string) []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.store[path]
 }
 
-func newVerticalMerger(vertMergeFunc starlark.Callable) VerticalMergeFunc {
-	return func(upper, lower starlark.Value) (starlark.Value, error) {
+// mergeError is the error from a merge function failing. Merge functions don't
+// know where the values they merge came from, so whoever merges values from a
+// tree fills in their METADATA files with setMergeFiles.
+type mergeError struct {
+	key        string
+	horizontal bool
+	function   string
+	err        error
+
+	// The upper and lower values of a vertical merge, or the left and right
+	// values of a horizontal one, and the METADATA files they came from. The
+	// lower value of a vertical merge may already be merged from several.
+	values [2]starlark.Value
+	files  [2][]string
+}
+
+func (e *mergeError) Error() string {
+	if e.horizontal {
+		in := ""
+		if len(e.files[0]) > 0 {
+			in = " in " + e.files[0][0]
+		}
+		return fmt.Sprintf("Could not horizontally merge '%s' left(%v) and right(%v)%s with %s: %s",
+			e.key, e.values[0], e.values[1], in, e.function, errorMessage(e.err))
+	}
+
+	from := [2]string{}
+	for i, files := range e.files {
+		switch {
+		case len(files) == 1:
+			from[i] = " from " + files[0]
+		case len(files) > 1:
+			from[i] = " merged from " + strings.Join(files, ", ")
+		}
+	}
+	return fmt.Sprintf("Could not vertically merge '%s' upper(%v)%s and lower(%v)%s with %s: %s",
+		e.key, e.values[0], from[0], e.values[1], from[1], e.function, errorMessage(e.err))
+}
+
+// setMergeFiles records the METADATA files of the values of a failed merge in
+// err, if it is from a merge function
+func setMergeFiles(err error, first, second []string) {
+	var mergeErr *mergeError
+	if errors.As(err, &mergeErr) {
+		mergeErr.files = [2][]string{first, second}
+	}
+}
+
+func (p *Parser) newVerticalMerger(key string, vertMergeFunc starlark.Callable) VerticalMergeFunc {
+	return func(ctx context.Context, upper, lower starlark.Value) (starlark.Value, error) {
 		if vertMergeFunc == nil {
 			return nil, fmt.Errorf("Cannot merge vertically. No vertical merge function defined for this metadata type")
 		}
 
-		thread := &starlark.Thread{
-			Name: "Vertically Merging",
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Could not vertically merge '%s': %w", key, err)
 		}
+		thread, done := p.limits.newThread(ctx, "Vertically Merging")
+		defer done()
+		start := time.Now()
 		args := []starlark.Value{upper, lower}
 		res, err := starlark.Call(thread, vertMergeFunc, args, []starlark.Tuple{})
 		if err != nil {
-			return nil, fmt.Errorf("Could not vertically merge upper(%v) and lower(%v): %v", upper, lower, err)
+			return nil, checkCancelled(ctx, &mergeError{
+				key:      key,
+				function: describeCallable(vertMergeFunc),
+				err:      err,
+				values:   [2]starlark.Value{upper, lower},
+			})
 		}
 
+		p.log.trace(ctx, "merged vertically", "key", key, "function", describeCallable(vertMergeFunc), "duration", time.Since(start))
+		p.stats.addMerge(describeCallable(vertMergeFunc), thread.ExecutionSteps(), time.Since(start))
 		return res, nil
 	}
 }
 
-func newHorizontalMerger(horizMergeFunc starlark.Callable) HorizontalMergeFunc {
-	return func(left, right starlark.Value) (starlark.Value, error) {
+func (p *Parser) newHorizontalMerger(key string, horizMergeFunc starlark.Callable) HorizontalMergeFunc {
+	return func(ctx context.Context, left, right starlark.Value) (starlark.Value, error) {
 		if horizMergeFunc == nil {
 			return nil, fmt.Errorf("Cannot merge horizontally. No horizontal merge function defined for this metadata type")
 		}
 
-		thread := &starlark.Thread{
-			Name: "Vertically Merging",
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("Could not horizontally merge '%s': %w", key, err)
 		}
+		thread, done := p.limits.newThread(ctx, "Horizontally Merging")
+		defer done()
+		start := time.Now()
 		args := []starlark.Value{left, right}
 		res, err := starlark.Call(thread, horizMergeFunc, args, []starlark.Tuple{})
 		if err != nil {
-			return nil, fmt.Errorf("Could not horizontally merge left(%v) and right(%v): %v", left, right, err)
+			return nil, checkCancelled(ctx, &mergeError{
+				key:        key,
+				horizontal: true,
+				function:   describeCallable(horizMergeFunc),
+				err:        err,
+				values:     [2]starlark.Value{left, right},
+			})
 		}
 
+		p.log.trace(ctx, "merged horizontally", "key", key, "function", describeCallable(horizMergeFunc), "duration", time.Since(start))
+		p.stats.addMerge(describeCallable(horizMergeFunc), thread.ExecutionSteps(), time.Since(start))
 		return res, nil
 	}
 }
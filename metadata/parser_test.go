@@ -0,0 +1,195 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.starlark.net/starlark"
+)
+
+func TestPrelude(t *testing.T) {
+	files := map[string]string{
+		ConfigFilename: "prelude = [\"//owners.meta\", \"//team.meta\"]\n",
+		"owners.meta":  ownersMeta,
+		"team.meta":    "_team = meta(key=\"team\")\n\ndef team(name):\n    _team(name)\n\ndef glob(pattern):\n    fail(\"overridden\")\n",
+		"METADATA":     "owners([\"alice\"])\nteam(\"infra\")\n",
+		// Explicit loads still work, and can rename
+		"one/METADATA": "load(\"//owners.meta\", \"owners\", add_owners=\"owners\")\nadd_owners([\"bob\"], files=[glob(\"*.txt\")])\n",
+		"one/a.txt":    "a",
+	}
+
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	value, err := tree.Get("one/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+	value, err = tree.Get("one/a.txt", "team")
+	require.NoError(t, err)
+	assert.Equal(t, `"infra"`, value.String())
+
+	// Private globals and .meta files don't get the prelude
+	files["two/METADATA"] = "_team(\"web\")\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	assert.Error(t, err)
+	files["lib.meta"] = "web_owners = owners\n"
+	files["two/METADATA"] = "load(\"//lib.meta\", \"web_owners\")\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "lib.meta:1:14: undefined: owners")
+	delete(files, "lib.meta")
+	delete(files, "two/METADATA")
+
+	// Changes to the prelude affect every METADATA file
+	tree2, err := NewLiveTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	assert.True(t, tree2.IsRelevant("team.meta"))
+	assert.Contains(t, tree2.parser.loads("METADATA"), "team.meta")
+
+	files[ConfigFilename] = "prelude = [\"//missing.meta\"]\n"
+	_, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot load prelude module '//missing.meta'")
+}
+
+func TestRelativeLoads(t *testing.T) {
+	files := map[string]string{
+		"meta/owners.meta": ownersMeta,
+		"meta/common.meta": "load(\":owners.meta\", _owners=\"owners\")\nowners = _owners\n",
+		"one/two/METADATA": "load(\"../../meta/common.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"one/two/a.txt":    "a",
+		"one/METADATA":     "load(\"./local.meta\", \"owners\")\nowners([\"bob\"])\n",
+		"one/local.meta":   "load(\"//meta/owners.meta\", _owners=\"owners\")\nowners = _owners\n",
+		"outside/METADATA": "load(\"../../owners.meta\", \"owners\")\n",
+	}
+
+	fsys := NewMapFS(files)
+	repo := &Repo{MetadataFilename: "METADATA", FS: fsys}
+	parser := NewParser(repo)
+	results := make([]ParseResult, 0)
+	for _, path := range []string{"one/METADATA", "one/two/METADATA"} {
+		file, err := repo.newFile(path)
+		require.NoError(t, err)
+		result, err := parser.ParseOne(file)
+		require.NoError(t, err)
+		results = append(results, result)
+	}
+	value, err := NewMetadataTree(results).Get("one/two/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["alice", "bob"]`, value.String())
+	assert.ElementsMatch(t, []string{"meta/common.meta", "meta/owners.meta"}, parser.loads("one/two/METADATA"))
+
+	file, err := repo.newFile("outside/METADATA")
+	require.NoError(t, err)
+	_, err = parser.ParseOne(file)
+	assert.EqualError(t, err, "cannot load ../../owners.meta: Cannot load module '../../owners.meta' from outside/METADATA: it is outside of the repo")
+
+	_, err = parser.load(context.Background(), "../owners.meta")
+	assert.EqualError(t, err, "Cannot load module '//../owners.meta': it is outside of the repo")
+}
+
+func TestAliases(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, filepath.Join(dir, "shared"), map[string]string{
+		"lib/owners.meta": ownersMeta,
+		"lib/all.meta":    "load(\"//lib/owners.meta\", _owners=\"owners\")\nowners = _owners\n",
+	})
+	writeFiles(t, filepath.Join(dir, "repo"), map[string]string{
+		ConfigFilename: "aliases = {\"shared\": \"../shared\"}\n",
+		"METADATA":     "load(\"@shared//lib/all.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"a.txt":        "a",
+	})
+
+	tree, err := NewEagerTree(filepath.Join(dir, "repo"))
+	require.NoError(t, err)
+	value, err := tree.Get("a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["alice"]`, value.String())
+
+	writeFiles(t, filepath.Join(dir, "repo"), map[string]string{
+		"METADATA": "load(\"@other//lib/all.meta\", \"owners\")\n",
+	})
+	_, err = NewEagerTree(filepath.Join(dir, "repo"))
+	assert.EqualError(t, err, "cannot load @other//lib/all.meta: Cannot load module '@other//lib/all.meta': unknown repo alias 'other'")
+}
+
+func TestNestedLoadError(t *testing.T) {
+	files := map[string]string{
+		"METADATA": "\nload(\"//a.meta\", \"a\")\n",
+		"a.meta":   "load(\":b.meta\", \"b\")\na = b\n",
+		"b.meta":   "b = 1 +\n",
+	}
+
+	_, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.Error(t, err)
+	assert.Equal(t, "METADATA:2:1: cannot load //a.meta: a.meta:1:1: cannot load :b.meta: b.meta:2:1: got newline, want primary expression", err.Error())
+
+	var loadErr *LoadError
+	require.True(t, errors.As(err, &loadErr))
+	assert.Equal(t, "//a.meta", loadErr.Module)
+	assert.Equal(t, "METADATA:2:1", loadErr.Pos.String())
+	require.True(t, errors.As(loadErr.Err, &loadErr))
+	assert.Equal(t, ":b.meta", loadErr.Module)
+}
+
+func TestMetaAttrs(t *testing.T) {
+	files := map[string]string{
+		"owners.meta": ownersMeta + "\ntier = meta(key=\"tier\")\n",
+		"METADATA":    "load(\"//owners.meta\", \"owners\")\nowners([owners.key])\n",
+		"a.txt":       "a",
+	}
+	tree, err := NewLiveTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	value, err := tree.Get("a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["owners"]`, value.String())
+
+	globals, err := tree.Module("owners.meta")
+	require.NoError(t, err)
+	owners := globals["owners"].(*StarlarkMeta)
+	assert.Equal(t, []string{"horizontal_merge", "key", "vertical_merge"}, owners.AttrNames())
+
+	thread := &starlark.Thread{Name: "test"}
+	merge, err := owners.Attr("vertical_merge")
+	require.NoError(t, err)
+	merged, err := starlark.Call(thread, merge, starlark.Tuple{starlark.NewList([]starlark.Value{starlark.String("alice")}), starlark.NewList([]starlark.Value{starlark.String("bob")})}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, merged.String())
+
+	merge, err = globals["tier"].(*StarlarkMeta).Attr("horizontal_merge")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.None, merge)
+
+	// Entries can't be added outside of parsing
+	_, err = starlark.Call(thread, owners, starlark.Tuple{starlark.String("alice")}, nil)
+	assert.EqualError(t, err, "Cannot set 'owners': entries can only be added by METADATA files")
+}
+
+func TestFrozenValues(t *testing.T) {
+	files := map[string]string{
+		"owners.meta": ownersMeta,
+		"extend.meta": "def _merge(upper, lower):\n    lower.extend(upper)\n    return lower\n\nowners = meta(key=\"owners\", vertical_merge=_merge)\n",
+		// A value can still be changed while the file is executing
+		"METADATA":     "load(\"//owners.meta\", \"owners\")\n\ndef _add():\n    names = [\"alice\"]\n    owners(names)\n    names.append(\"bob\")\n\n_add()\n",
+		"one/METADATA": "load(\"//owners.meta\", \"owners\")\nowners([\"carol\"])\n",
+		"one/a.txt":    "a",
+	}
+
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	value, err := tree.Get("one/a.txt", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["carol", "alice", "bob"]`, value.String())
+
+	// Merge functions can't change the values that they merge
+	files["METADATA"] = "load(\"//extend.meta\", \"owners\")\nowners([\"alice\"])\n"
+	files["one/METADATA"] = "load(\"//extend.meta\", \"owners\")\nowners([\"carol\"])\n"
+	tree, err = NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+	_, err = tree.Get("one/a.txt", "owners")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "frozen list")
+}
@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.starlark.net/starlark"
+)
+
+// programCache keeps compiled modules in a directory, so that modules that
+// haven't changed aren't parsed and compiled again by every process that
+// reads the repo. A nil programCache compiles every module.
+type programCache struct {
+	dir string
+}
+
+// Bumped whenever what a cached program depends on changes, so that programs
+// written by older versions are never read
+const programCacheVersion = "1"
+
+// compile returns the compiled program of a module, and whether it came from
+// the cache. Failing to write the cache isn't an error, since the module is
+// compiled either way.
+func (c *programCache) compile(path, contents string, predeclared starlark.StringDict) (*starlark.Program, bool, error) {
+	if c == nil {
+		_, prog, err := starlark.SourceProgram(path, contents, predeclared.Has)
+		return prog, false, err
+	}
+
+	cachePath := filepath.Join(c.dir, programKey(path, contents, predeclared))
+	if compiled, err := ioutil.ReadFile(cachePath); err == nil {
+		// Programs that can't be decoded, like ones written by a different
+		// version of Starlark, are compiled again and overwritten
+		if prog, err := starlark.CompiledProgram(bytes.NewReader(compiled)); err == nil {
+			return prog, true, nil
+		}
+	}
+
+	_, prog, err := starlark.SourceProgram(path, contents, predeclared.Has)
+	if err != nil {
+		return nil, false, err
+	}
+	c.write(cachePath, prog)
+	return prog, false, nil
+}
+
+// write stores a program under a temporary name and then renames it, so that
+// other processes never read a program that is partly written
+func (c *programCache) write(cachePath string, prog *starlark.Program) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(c.dir, "program-*.tmp")
+	if err != nil {
+		return
+	}
+	err = prog.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// programKey hashes everything that compiling a module depends on. Positions
+// in the program include its path, and which names are predeclared decides
+// how the names in it are resolved.
+func programKey(path, contents string, predeclared starlark.StringDict) string {
+	h := sha256.New()
+	for _, s := range append([]string{programCacheVersion, path, contents}, predeclared.Keys()...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,62 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheDir(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		ConfigFilename: "cache_dir = \".cache/meta\"\n",
+		"owners.meta":  ownersMeta,
+		"METADATA":     "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\n",
+		"one/METADATA": "load(\"//owners.meta\", \"owners\")\nowners([\"bob\"])\n",
+		"one/a.txt":    "a",
+	})
+
+	build := func() *Stats {
+		stats := NewStats()
+		tree, err := NewEagerTree(root, WithStats(stats))
+		require.NoError(t, err)
+		value, err := tree.Get("one/a.txt", "owners")
+		require.NoError(t, err)
+		assert.Equal(t, `["bob", "alice"]`, value.String())
+		return stats
+	}
+
+	stats := build()
+	assert.Equal(t, 3, stats.ProgramLookups)
+	assert.Equal(t, 0, stats.ProgramCacheHits)
+	programs, err := filepath.Glob(filepath.Join(root, ".cache/meta/programs/*"))
+	require.NoError(t, err)
+	assert.Len(t, programs, 3)
+
+	// Another tree, like one in the next process, reads the compiled modules
+	stats = build()
+	assert.Equal(t, 3, stats.ProgramLookups)
+	assert.Equal(t, 3, stats.ProgramCacheHits)
+
+	// Changed modules are compiled again, and programs that can't be read
+	// are replaced
+	writeFiles(t, root, map[string]string{
+		"one/METADATA": "load(\"//owners.meta\", \"owners\")\n\nowners([\"bob\"])\n",
+	})
+	for _, program := range programs {
+		require.NoError(t, ioutil.WriteFile(program, []byte("not a program"), 0644))
+	}
+	stats = build()
+	assert.Equal(t, 0, stats.ProgramCacheHits)
+	stats = build()
+	assert.Equal(t, 3, stats.ProgramCacheHits)
+
+	// Without a cache dir, nothing is looked up
+	stats = NewStats()
+	_, err = NewEagerTree(root, WithStats(stats), WithoutConfig())
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.ProgramLookups)
+}
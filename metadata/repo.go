@@ -1,46 +1,409 @@
 package metadata
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
-	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Repo struct {
 	Root             string
 	MetadataFilename string
+
+	// Other names that METADATA files can have. A directory can only have one
+	// METADATA file.
+	AltMetadataFilenames []string
+
+	// Filesystem to read the repo from instead of the directory at Root, with
+	// the root of the repo at "."
+	FS fs.FS
+
+	// Patterns of paths to skip, in .gitignore syntax, on top of the ones in
+	// the .metaignore file at the root of the repo
+	Ignore []string
+
+	// Don't skip paths ignored by .gitignore files and .git/info/exclude
+	NoGitignore bool
+
+	// Only walk files in the git index. Ignore files other than .metaignore
+	// don't apply, since tracked files can't be ignored. Only supported for
+	// repos on disk and read from a GitFS, any other FS is an error.
+	TrackedOnly bool
+
+	// What to do with symbolic links
+	Symlinks SymlinkMode
+
+	log logger
+}
+
+// SymlinkMode is what to do with symbolic links when walking a repo
+type SymlinkMode int
+
+const (
+	// Symlinks are left out
+	SymlinksSkip SymlinkMode = iota
+	// Symlinks are followed, except ones to a directory that is already being
+	// walked, which would loop forever
+	SymlinksFollow
+	// Symlinks are followed, and ones to a directory that is already being
+	// walked are an error
+	SymlinksError
+)
+
+// ParseSymlinkMode parses "skip", "follow" or "error" into a SymlinkMode
+func ParseSymlinkMode(s string) (SymlinkMode, error) {
+	switch s {
+	case "skip":
+		return SymlinksSkip, nil
+	case "follow":
+		return SymlinksFollow, nil
+	case "error":
+		return SymlinksError, nil
+	}
+	return SymlinksSkip, fmt.Errorf("Unknown symlink mode '%s', expected one of: skip, follow, error", s)
+}
+
+// NewRepo returns the repo at root, configured by its ConfigFilename file and
+// the options that affect how it is read
+func NewRepo(root string, opts ...Option) (*Repo, error) {
+	o, err := loadOptions(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newRepo(root, o), nil
+}
+
+func newRepo(root string, o options) *Repo {
+	return &Repo{
+		Root:                 root,
+		MetadataFilename:     o.metadataFilename,
+		AltMetadataFilenames: o.altFilenames,
+		FS:                   o.fs,
+		Ignore:               o.ignore,
+		NoGitignore:          o.noGitignore,
+		TrackedOnly:          o.trackedOnly,
+		Symlinks:             o.symlinks,
+		log:                  logger{o.logger},
+	}
+}
+
+// fsys returns the filesystem that the repo is read from
+func (r *Repo) fsys() fs.FS {
+	if r.FS != nil {
+		return r.FS
+	}
+	return os.DirFS(r.Root)
+}
+
+// IsMetadataFile reports whether a file name is one of the names of METADATA
+// files
+func (r *Repo) IsMetadataFile(name string) bool {
+	if name == r.MetadataFilename {
+		return true
+	}
+	for _, alt := range r.AltMetadataFilenames {
+		if name == alt {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataFileIn returns the repo-relative path of the METADATA file in a
+// directory, or where it would be created if there isn't one
+func (r *Repo) metadataFileIn(dir string) string {
+	for _, name := range r.AltMetadataFilenames {
+		p := filepath.Join(dir, name)
+		if _, err := fs.Stat(r.fsys(), filepath.ToSlash(p)); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(dir, r.MetadataFilename)
 }
 
 func (r *Repo) MetadataFiles() ([]MetadataFile, error) {
+	return r.MetadataFilesContext(context.Background())
+}
+
+// MetadataFilesContext is MetadataFiles, but stops walking the repo once ctx
+// is done
+func (r *Repo) MetadataFilesContext(ctx context.Context) ([]MetadataFile, error) {
 	files := make([]MetadataFile, 0)
-	err := filepath.WalkDir(r.Root, func(path string, d fs.DirEntry, err error) error {
+	// directory -> name of its METADATA file
+	seen := make(map[string]string)
+	err := r.walk(ctx, func(p string) error {
+		name := path.Base(p)
+		if !r.IsMetadataFile(name) {
+			return nil
+		}
+		dir := path.Dir(p)
+		if other, ok := seen[dir]; ok {
+			return fmt.Errorf("Cannot use both %s and %s in %s: a directory can only have one METADATA file",
+				other, name, filepath.Join(r.Root, filepath.FromSlash(dir)))
+		}
+		seen[dir] = name
+		f, err := r.newFile(filepath.Join(r.Root, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// Files returns the repo-relative path of every regular file in the repo,
+// skipping the .git directory and ignored files
+func (r *Repo) Files() ([]string, error) {
+	return r.FilesContext(context.Background())
+}
+
+// FilesContext is Files, but stops walking the repo once ctx is done
+func (r *Repo) FilesContext(ctx context.Context) ([]string, error) {
+	files := make([]string, 0)
+	err := r.walk(ctx, func(p string) error {
+		files = append(files, filepath.FromSlash(p))
+		return nil
+	})
+	return files, err
+}
+
+// walk calls fn with the slash-separated repo-relative path of every regular
+// file in the repo that isn't skipped, in lexical order
+func (r *Repo) walk(ctx context.Context, fn func(p string) error) error {
+	return r.walkUnder(ctx, "", nil, fn)
+}
+
+// walkUnder is walk, but only for the files in the slash-separated directory
+// dir and below it, which is "" for the whole repo. Paths are skipped the same
+// way as they are by walk, so nothing is walked if dir is skipped itself. If
+// dirFn isn't nil, it is called with every directory that is walked, dir
+// included, before the files in it.
+func (r *Repo) walkUnder(ctx context.Context, dir string, dirFn, fn func(p string) error) error {
+	start := time.Now()
+	defer func() {
+		r.log.debug(ctx, "walked repo", "root", r.Root, "duration", time.Since(start))
+	}()
+	w := &repoWalker{ctx: ctx, repo: r, fsys: r.fsys(), fn: fn, dirFn: dirFn, under: dir}
+
+	lines := append([]string{}, r.Ignore...)
+	metaignore, err := fs.ReadFile(w.fsys, metaignoreFilename)
+	if err == nil {
+		lines = append(lines, strings.Split(string(metaignore), "\n")...)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if w.skip, err = newIgnoreFile("", lines); err != nil {
+		return err
+	}
+
+	if r.TrackedOnly {
+		if err := w.readTracked(); err != nil {
+			return err
+		}
+	}
+
+	// Tracked files can't be ignored, so .gitignore files only apply when the
+	// walk isn't limited to tracked files
+	var stack ignoreStack
+	w.gitignore = !r.NoGitignore && !r.TrackedOnly
+	if w.gitignore {
+		exclude, err := fs.ReadFile(w.fsys, ".git/info/exclude")
+		if err == nil {
+			f, err := parseIgnoreFile("", string(exclude))
+			if err != nil {
+				return err
+			}
+			stack = stack.push(f)
+		}
+	}
+
+	var ancestors []fs.FileInfo
+	if r.Symlinks != SymlinksSkip {
+		info, err := fs.Stat(w.fsys, ".")
 		if err != nil {
 			return err
 		}
+		ancestors = []fs.FileInfo{info}
+	}
+	return w.walkDir("", stack, ancestors)
+}
 
-		if d.IsDir() {
+// readTracked reads the files in the git index, for Repo.TrackedOnly. A GitFS
+// only has files from a commit, which are all tracked, so it isn't filtered.
+func (w *repoWalker) readTracked() error {
+	if w.repo.FS != nil {
+		if _, ok := w.repo.FS.(*GitFS); ok {
 			return nil
 		}
+		return fmt.Errorf("Cannot walk only tracked files of %s: it isn't read from a git repository", w.repo.Root)
+	}
+
+	out, err := git(w.repo.Root, "ls-files", "--cached", "-z")
+	if err != nil {
+		return err
+	}
+	w.tracked = make(StringSet)
+	w.trackedDirs = make(StringSet)
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p == "" {
+			continue
+		}
+		w.tracked.Add(p)
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			w.trackedDirs.Add(dir)
+		}
+	}
+	return nil
+}
+
+type repoWalker struct {
+	ctx  context.Context
+	repo *Repo
+	fsys fs.FS
+	fn   func(p string) error
 
-		if d.Name() == r.MetadataFilename {
-			f, err := r.newFile(path)
+	// the directory to walk, which the directories above it are only walked
+	// on the way to, and what to call with every walked directory
+	under string
+	dirFn func(p string) error
+
+	// .metaignore and Repo.Ignore, which always apply
+	skip *ignoreFile
+	// whether .gitignore files apply
+	gitignore bool
+	// files in the git index and their directories, with Repo.TrackedOnly
+	tracked     StringSet
+	trackedDirs StringSet
+}
+
+// walkDir walks a directory, given the ignore files above it and the
+// directories that it is in, which are only tracked when following symlinks
+func (w *repoWalker) walkDir(dir string, stack ignoreStack, ancestors []fs.FileInfo) error {
+	if err := w.ctx.Err(); err != nil {
+		return fmt.Errorf("Cannot walk %s: %w", w.repo.Root, err)
+	}
+	fsDir := dir
+	if fsDir == "" {
+		fsDir = "."
+	}
+
+	if w.gitignore {
+		gitignore, err := fs.ReadFile(w.fsys, path.Join(fsDir, ".gitignore"))
+		if err == nil {
+			f, err := parseIgnoreFile(dir, string(gitignore))
 			if err != nil {
 				return err
 			}
-			files = append(files, f)
+			stack = stack.push(f)
+		}
+	}
+	if w.dirFn != nil && w.isUnder(dir) {
+		if err := w.dirFn(dir); err != nil {
+			return err
 		}
+	}
 
-		return nil
-	})
-	return files, err
+	start := time.Now()
+	entries, err := fs.ReadDir(w.fsys, fsDir)
+	if err != nil {
+		return err
+	}
+	w.repo.log.trace(w.ctx, "read directory", "dir", fsDir, "entries", len(entries), "duration", time.Since(start))
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if !w.isUnder(p) && !strings.HasPrefix(w.under, p+"/") {
+			continue
+		}
+		isDir, isRegular := entry.IsDir(), entry.Type().IsRegular()
+
+		var info fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if w.repo.Symlinks == SymlinksSkip {
+				continue
+			}
+			info, err = fs.Stat(w.fsys, p)
+			if err != nil {
+				// Broken links are left out
+				continue
+			}
+			isDir, isRegular = info.IsDir(), info.Mode().IsRegular()
+			if isDir && isSymlinkLoop(info, ancestors) {
+				if w.repo.Symlinks == SymlinksError {
+					return fmt.Errorf("Cannot walk %s: symlink loop", filepath.Join(w.repo.Root, filepath.FromSlash(p)))
+				}
+				continue
+			}
+		}
+
+		switch {
+		case isDir:
+			if entry.Name() == ".git" || w.skipped(p, true, stack) {
+				continue
+			}
+			if w.tracked != nil && !w.trackedDirs.Contains(p) {
+				continue
+			}
+			dirAncestors := ancestors
+			if w.repo.Symlinks != SymlinksSkip {
+				if info == nil {
+					if info, err = entry.Info(); err != nil {
+						return err
+					}
+				}
+				dirAncestors = append(ancestors[:len(ancestors):len(ancestors)], info)
+			}
+			if err := w.walkDir(p, stack, dirAncestors); err != nil {
+				return err
+			}
+		case isRegular:
+			if w.skipped(p, false, stack) {
+				continue
+			}
+			if w.tracked != nil && !w.tracked.Contains(p) {
+				continue
+			}
+			if err := w.fn(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isUnder reports whether a path is the directory being walked or below it
+func (w *repoWalker) isUnder(p string) bool {
+	return w.under == "" || p == w.under || strings.HasPrefix(p, w.under+"/")
+}
+
+func (w *repoWalker) skipped(p string, isDir bool, stack ignoreStack) bool {
+	if ignored, _ := w.skip.match(p, isDir); ignored {
+		return true
+	}
+	return stack.ignored(p, isDir)
+}
+
+// isSymlinkLoop reports whether a directory that a symlink leads to is one of
+// the directories that it is in
+func isSymlinkLoop(info fs.FileInfo, ancestors []fs.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(info, ancestor) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Repo) ReadFile(pathRelativeToRoot string) (string, error) {
-	fullPath := filepath.Join(r.Root, pathRelativeToRoot)
-	content, err := ioutil.ReadFile(fullPath)
+	content, err := fs.ReadFile(r.fsys(), filepath.ToSlash(filepath.Clean(pathRelativeToRoot)))
 	if err != nil {
+		fullPath := filepath.Join(r.Root, pathRelativeToRoot)
 		return "", fmt.Errorf("Could not get contents of %s: %v", fullPath, err)
 	}
 	return string(content), nil
@@ -65,6 +428,16 @@ type MetadataFile struct {
 	repo               *Repo
 }
 
+// Path returns the full path to the file on disk
+func (f *MetadataFile) Path() string {
+	return f.path
+}
+
+// RelativePath returns the path to the file relative to the root of the repo
+func (f *MetadataFile) RelativePath() string {
+	return f.pathRelativeToRoot
+}
+
 func (f *MetadataFile) Contents() (string, error) {
 	return f.repo.ReadFile(f.pathRelativeToRoot)
 }
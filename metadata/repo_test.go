@@ -0,0 +1,116 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func repoFiles(t *testing.T, repo *Repo) []string {
+	files, err := repo.Files()
+	require.NoError(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func TestRepoIgnore(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".gitignore":                "node_modules/\n*.log\n",
+		".git/info/exclude":         "local.txt\n",
+		".git/config":               "",
+		".metaignore":               "vendor/\n",
+		"a.txt":                     "",
+		"debug.log":                 "",
+		"local.txt":                 "",
+		"node_modules/pkg/METADATA": "",
+		"vendor/lib/METADATA":       "",
+		"out/generated.txt":         "",
+		"src/.gitignore":            "!keep.log\n",
+		"src/keep.log":              "",
+		"src/other.log":             "",
+		"src/METADATA":              "",
+	})
+
+	repo := &Repo{Root: root, MetadataFilename: "METADATA"}
+	assert.Equal(t, []string{".gitignore", ".metaignore", "a.txt", "out/generated.txt", "src/.gitignore", "src/METADATA", "src/keep.log"}, repoFiles(t, repo))
+
+	repo.Ignore = []string{"/out"}
+	assert.NotContains(t, repoFiles(t, repo), "out/generated.txt")
+
+	metadataFiles, err := repo.MetadataFiles()
+	require.NoError(t, err)
+	require.Len(t, metadataFiles, 1)
+	assert.Equal(t, "src/METADATA", metadataFiles[0].RelativePath())
+
+	// .metaignore still applies without .gitignore files
+	repo = &Repo{Root: root, NoGitignore: true}
+	files := repoFiles(t, repo)
+	assert.Contains(t, files, "node_modules/pkg/METADATA")
+	assert.Contains(t, files, "debug.log")
+	assert.Contains(t, files, "local.txt")
+	assert.NotContains(t, files, "vendor/lib/METADATA")
+	assert.NotContains(t, files, ".git/config")
+}
+
+func TestRepoTrackedOnly(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".gitignore":  "*.log\n",
+		"tracked.txt": "",
+		"forced.log":  "",
+		"sub/a.txt":   "",
+	})
+	runGit(t, root, "init", "-q")
+	runGit(t, root, "add", "tracked.txt", ".gitignore")
+	runGit(t, root, "add", "-f", "forced.log")
+	writeFiles(t, root, map[string]string{"untracked.txt": ""})
+
+	repo := &Repo{Root: root, TrackedOnly: true}
+	assert.Equal(t, []string{".gitignore", "forced.log", "tracked.txt"}, repoFiles(t, repo))
+
+	// The files of a commit are all tracked, including ignored ones
+	runGit(t, root, "commit", "-q", "-m", "first")
+	gitFS, err := NewGitFS(root, "HEAD")
+	require.NoError(t, err)
+	defer gitFS.Close()
+	repo.FS = gitFS
+	assert.Equal(t, []string{".gitignore", "forced.log", "tracked.txt"}, repoFiles(t, repo))
+
+	// Other filesystems have no index to filter by
+	repo.FS = NewMapFS(map[string]string{"a.txt": "", "b.log": ""})
+	_, err = repo.Files()
+	assert.EqualError(t, err, "Cannot walk only tracked files of "+root+": it isn't read from a git repository")
+}
+
+func TestRepoSymlinks(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"real/METADATA": "",
+		"real/a.txt":    "",
+	})
+	require.NoError(t, os.Symlink("real", filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(root, "real", "b.txt")))
+	require.NoError(t, os.Symlink("missing", filepath.Join(root, "broken")))
+
+	repo := &Repo{Root: root}
+	assert.Equal(t, []string{"real/METADATA", "real/a.txt"}, repoFiles(t, repo))
+
+	repo.Symlinks = SymlinksFollow
+	assert.Equal(t, []string{"link/METADATA", "link/a.txt", "link/b.txt", "real/METADATA", "real/a.txt", "real/b.txt"}, repoFiles(t, repo))
+
+	// A link back up the tree is skipped, or an error
+	require.NoError(t, os.Symlink("..", filepath.Join(root, "real", "loop")))
+	assert.Len(t, repoFiles(t, repo), 6)
+
+	repo.Symlinks = SymlinksError
+	_, err := repo.Files()
+	assert.EqualError(t, err, "Cannot walk "+filepath.Join(root, "link", "loop")+": symlink loop")
+
+	_, err = ParseSymlinkMode("sometimes")
+	assert.Error(t, err)
+}
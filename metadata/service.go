@@ -0,0 +1,375 @@
+package metadata
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.starlark.net/starlark"
+)
+
+// Service answers metadata queries against a tree. Its methods follow the
+// net/rpc conventions so that it can be registered with an rpc.Server as is,
+// and NewHTTPHandler serves the same methods over HTTP. Values are passed as
+// JSON. Each method has a variant that takes a context, which NewHTTPHandler
+// uses so that queries stop when their request is cancelled. A Service is safe
+// for concurrent use.
+type Service struct {
+	tree Tree
+
+	// every file in the repo, used by the queries that look at all files
+	files []string
+}
+
+func NewService(tree Tree, files []string) *Service {
+	return &Service{
+		tree:  tree,
+		files: files,
+	}
+}
+
+type GetArgs struct {
+	File string `json:"file"`
+	Key  string `json:"key"`
+}
+
+type ValueReply struct {
+	Value stdjson.RawMessage `json:"value"`
+}
+
+// Get returns the merged value of a key for a file
+func (s *Service) Get(args *GetArgs, reply *ValueReply) error {
+	return s.GetContext(context.Background(), args, reply)
+}
+
+func (s *Service) GetContext(ctx context.Context, args *GetArgs, reply *ValueReply) error {
+	value, err := s.tree.GetContext(ctx, args.File, args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Value, err = rawJson(value)
+	return err
+}
+
+type MultiArgs struct {
+	Files []string `json:"files"`
+
+	// Keys to get for each file. If AllKeys is set, every key that applies to
+	// each file is returned instead.
+	Keys    []string `json:"keys"`
+	AllKeys bool     `json:"all_keys"`
+}
+
+type MultiReply struct {
+	// Values maps file to key to value. Requested keys without a value are
+	// null.
+	Values map[string]map[string]stdjson.RawMessage `json:"values"`
+}
+
+// Multi returns the merged values of several keys for several files
+func (s *Service) Multi(args *MultiArgs, reply *MultiReply) error {
+	return s.MultiContext(context.Background(), args, reply)
+}
+
+func (s *Service) MultiContext(ctx context.Context, args *MultiArgs, reply *MultiReply) error {
+	var keys []string
+	if !args.AllKeys {
+		if len(args.Keys) == 0 {
+			return errors.New("At least one key is required unless all_keys is set")
+		}
+		keys = args.Keys
+	}
+	return s.getMany(ctx, args.Files, keys, reply)
+}
+
+type DumpArgs struct {
+	// Keys to get for each file. If empty, every key is returned.
+	Keys []string `json:"keys"`
+}
+
+// Dump returns the merged values of every file in the repo
+func (s *Service) Dump(args *DumpArgs, reply *MultiReply) error {
+	return s.DumpContext(context.Background(), args, reply)
+}
+
+func (s *Service) DumpContext(ctx context.Context, args *DumpArgs, reply *MultiReply) error {
+	var keys []string
+	if len(args.Keys) > 0 {
+		keys = args.Keys
+	}
+	return s.getMany(ctx, s.files, keys, reply)
+}
+
+func (s *Service) getMany(ctx context.Context, files []string, keys []string, reply *MultiReply) error {
+	reply.Values = make(map[string]map[string]stdjson.RawMessage, len(files))
+	for _, file := range files {
+		values, err := s.tree.GetManyContext(ctx, file, keys)
+		if err != nil {
+			return err
+		}
+
+		fileValues := make(map[string]stdjson.RawMessage, len(values))
+		for _, key := range keys {
+			fileValues[key] = stdjson.RawMessage("null")
+		}
+		for key, value := range values {
+			fileValues[key], err = rawJson(value)
+			if err != nil {
+				return fmt.Errorf("Cannot convert '%s' metadata for '%s' to json: %v", key, file, err)
+			}
+		}
+		reply.Values[file] = fileValues
+	}
+	return nil
+}
+
+type ExplainReply struct {
+	File   string              `json:"file"`
+	Key    string              `json:"key"`
+	Levels []ExplainLevelReply `json:"levels"`
+	Value  stdjson.RawMessage  `json:"value"`
+}
+
+type ExplainLevelReply struct {
+	MetadataFile string             `json:"metadata_file"`
+	Entries      []EntryReply       `json:"entries"`
+	Value        stdjson.RawMessage `json:"value"`
+	Merged       stdjson.RawMessage `json:"merged"`
+}
+
+type EntryReply struct {
+	Key   string             `json:"key"`
+	Value stdjson.RawMessage `json:"value"`
+	Files []string           `json:"files,omitempty"`
+	Globs []string           `json:"globs,omitempty"`
+}
+
+// Explain returns how the merged value of a key for a file was built up from
+// the METADATA files above it
+func (s *Service) Explain(args *GetArgs, reply *ExplainReply) error {
+	return s.ExplainContext(context.Background(), args, reply)
+}
+
+func (s *Service) ExplainContext(ctx context.Context, args *GetArgs, reply *ExplainReply) error {
+	explanation, err := s.tree.ExplainContext(ctx, args.File, args.Key)
+	if err != nil {
+		return err
+	}
+
+	reply.File = explanation.File
+	reply.Key = explanation.Key
+	reply.Levels = make([]ExplainLevelReply, 0, len(explanation.Levels))
+	if reply.Value, err = rawJson(explanation.Value); err != nil {
+		return err
+	}
+
+	for _, level := range explanation.Levels {
+		levelReply := ExplainLevelReply{
+			MetadataFile: level.MetadataFile,
+			Entries:      make([]EntryReply, 0, len(level.Entries)),
+		}
+		if levelReply.Value, err = rawJson(level.Value); err != nil {
+			return err
+		}
+		if levelReply.Merged, err = rawJson(level.Merged); err != nil {
+			return err
+		}
+
+		for _, entry := range level.Entries {
+			entryReply := EntryReply{
+				Key:   entry.Key(),
+				Files: entry.FileMatchSet().ExactMatches(),
+			}
+			if entryReply.Value, err = rawJson(entry.Value()); err != nil {
+				return err
+			}
+			for _, glob := range entry.FileMatchSet().Globs() {
+				entryReply.Globs = append(entryReply.Globs, glob.Pattern())
+			}
+			levelReply.Entries = append(levelReply.Entries, entryReply)
+		}
+		reply.Levels = append(reply.Levels, levelReply)
+	}
+	return nil
+}
+
+type ListMatchingArgs struct {
+	Key   string             `json:"key"`
+	Value stdjson.RawMessage `json:"value"`
+}
+
+type FilesReply struct {
+	Files []string `json:"files"`
+}
+
+// ListMatching returns every file in the repo whose merged value for a key is
+// equal to the given value
+func (s *Service) ListMatching(args *ListMatchingArgs, reply *FilesReply) error {
+	return s.ListMatchingContext(context.Background(), args, reply)
+}
+
+func (s *Service) ListMatchingContext(ctx context.Context, args *ListMatchingArgs, reply *FilesReply) error {
+	want, err := JsonToValue(string(args.Value))
+	if err != nil {
+		return err
+	}
+
+	reply.Files = make([]string, 0)
+	for _, file := range s.files {
+		value, err := s.tree.GetContext(ctx, file, args.Key)
+		if _, ok := err.(NoMetadataFoundError); ok {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Compare the values the way they look in JSON, so that tuples
+		// match lists and so on
+		j, err := ValueToJson(value)
+		if err != nil {
+			return err
+		}
+		got, err := JsonToValue(j)
+		if err != nil {
+			return err
+		}
+		equal, err := starlark.Equal(want, got)
+		if err != nil {
+			return err
+		}
+		if equal {
+			reply.Files = append(reply.Files, file)
+		}
+	}
+	return nil
+}
+
+// rawJson converts a value into JSON. A nil value is null.
+func rawJson(value starlark.Value) (stdjson.RawMessage, error) {
+	if value == nil {
+		return stdjson.RawMessage("null"), nil
+	}
+	j, err := ValueToJson(value)
+	if err != nil {
+		return nil, err
+	}
+	return stdjson.RawMessage(j), nil
+}
+
+// NewHTTPHandler serves the methods of a Service as JSON over HTTP at /get,
+// /multi, /explain, /list-matching and /dump. Arguments are read from a JSON
+// request body for POST requests, or from the query string otherwise, where
+// lists are given by repeating a parameter.
+func NewHTTPHandler(s *Service) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		args := &GetArgs{}
+		serveHTTP(w, r, args, func() error {
+			args.File = r.URL.Query().Get("file")
+			args.Key = r.URL.Query().Get("key")
+			return nil
+		}, func() (interface{}, error) {
+			reply := &ValueReply{}
+			return reply, s.GetContext(r.Context(), args, reply)
+		})
+	})
+
+	mux.HandleFunc("/multi", func(w http.ResponseWriter, r *http.Request) {
+		args := &MultiArgs{}
+		serveHTTP(w, r, args, func() error {
+			q := r.URL.Query()
+			args.Files = q["file"]
+			args.Keys = q["key"]
+			var err error
+			if q.Get("all_keys") != "" {
+				args.AllKeys, err = strconv.ParseBool(q.Get("all_keys"))
+			}
+			return err
+		}, func() (interface{}, error) {
+			reply := &MultiReply{}
+			return reply, s.MultiContext(r.Context(), args, reply)
+		})
+	})
+
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		args := &GetArgs{}
+		serveHTTP(w, r, args, func() error {
+			args.File = r.URL.Query().Get("file")
+			args.Key = r.URL.Query().Get("key")
+			return nil
+		}, func() (interface{}, error) {
+			reply := &ExplainReply{}
+			return reply, s.ExplainContext(r.Context(), args, reply)
+		})
+	})
+
+	mux.HandleFunc("/list-matching", func(w http.ResponseWriter, r *http.Request) {
+		args := &ListMatchingArgs{}
+		serveHTTP(w, r, args, func() error {
+			args.Key = r.URL.Query().Get("key")
+			args.Value = stdjson.RawMessage(r.URL.Query().Get("value"))
+			return nil
+		}, func() (interface{}, error) {
+			reply := &FilesReply{}
+			return reply, s.ListMatchingContext(r.Context(), args, reply)
+		})
+	})
+
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+		args := &DumpArgs{}
+		serveHTTP(w, r, args, func() error {
+			args.Keys = r.URL.Query()["key"]
+			return nil
+		}, func() (interface{}, error) {
+			reply := &MultiReply{}
+			return reply, s.DumpContext(r.Context(), args, reply)
+		})
+	})
+
+	return mux
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// serveHTTP reads the arguments of a request into args, either from the body
+// or with fromQuery, then calls the method and writes its reply
+func serveHTTP(w http.ResponseWriter, r *http.Request, args interface{}, fromQuery func() error, call func() (interface{}, error)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = stdjson.NewDecoder(r.Body).Decode(args)
+	case http.MethodGet:
+		err = fromQuery()
+	default:
+		writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method))
+		return
+	}
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	reply, err := call()
+	if _, ok := err.(NoMetadataFoundError); ok {
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	_ = stdjson.NewEncoder(w).Encode(reply)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	_ = stdjson.NewEncoder(w).Encode(httpError{err.Error()})
+}
@@ -0,0 +1,138 @@
+package metadata
+
+import (
+	stdjson "encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t *testing.T) *Service {
+	repo := Repo{Root: "../test_data/horizontal_and_vertical_merge"}
+	files, err := repo.Files()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"METADATA", "one/METADATA", "owners.meta"}, files)
+
+	tree, err := NewEagerTree(repo.Root, WithCache(NewMemoryCache()))
+	require.NoError(t, err)
+	return NewService(tree, files)
+}
+
+func TestService(t *testing.T) {
+	s := newTestService(t)
+
+	value := &ValueReply{}
+	require.NoError(t, s.Get(&GetArgs{File: "one/main.py", Key: "owners"}, value))
+	assert.JSONEq(t, `["carol","alice","bob"]`, string(value.Value))
+
+	err := s.Get(&GetArgs{File: "main.py", Key: "missing"}, value)
+	assert.IsType(t, NoMetadataFoundError{}, err)
+
+	multi := &MultiReply{}
+	require.NoError(t, s.Multi(&MultiArgs{Files: []string{"main.py"}, Keys: []string{"owners", "missing"}}, multi))
+	assert.Equal(t, `{"main.py":{"missing":null,"owners":["alice","bob"]}}`, marshal(t, multi.Values))
+	assert.Error(t, s.Multi(&MultiArgs{Files: []string{"main.py"}}, multi))
+
+	dump := &MultiReply{}
+	require.NoError(t, s.Dump(&DumpArgs{}, dump))
+	assert.Len(t, dump.Values, 3)
+
+	explain := &ExplainReply{}
+	require.NoError(t, s.Explain(&GetArgs{File: "main.py", Key: "owners"}, explain))
+	require.Len(t, explain.Levels, 1)
+	assert.Equal(t, []string{"**/*.py", "*.py"}, explain.Levels[0].Entries[1].Globs)
+
+	matching := &FilesReply{}
+	require.NoError(t, s.ListMatching(&ListMatchingArgs{Key: "owners", Value: stdjson.RawMessage(`["carol", "alice"]`)}, matching))
+	assert.Equal(t, []string{"one/METADATA"}, matching.Files)
+}
+
+func TestServiceConcurrentReaders(t *testing.T) {
+	s := newTestService(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := &MultiReply{}
+			assert.NoError(t, s.Dump(&DumpArgs{}, reply))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHTTPHandler(t *testing.T) {
+	server := httptest.NewServer(NewHTTPHandler(newTestService(t)))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/get?file=one/main.py&key=owners")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"value":["carol","alice","bob"]}`, body)
+
+	status, body = get("/get?file=main.py&key=missing")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error":"No 'missing' metadata found for 'main.py'"}`, body)
+
+	status, body = get("/multi?file=main.cc&file=main.py&all_keys=true")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"values":{"main.cc":{"owners":["alice"]},"main.py":{"owners":["alice","bob"]}}}`, body)
+
+	status, body = get(`/list-matching?key=owners&value=["alice"]`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"files":["METADATA","owners.meta"]}`, body)
+
+	resp, err := http.Post(server.URL+"/explain", "application/json", strings.NewReader(`{"file":"main.cc","key":"owners"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	explain := &ExplainReply{}
+	require.NoError(t, stdjson.NewDecoder(resp.Body).Decode(explain))
+	assert.JSONEq(t, `["alice"]`, string(explain.Value))
+
+	resp, err = http.Post(server.URL+"/get", "application/json", strings.NewReader(`not json`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestJsonRPC(t *testing.T) {
+	server := rpc.NewServer()
+	require.NoError(t, server.RegisterName("Metadata", newTestService(t)))
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	reply := &ValueReply{}
+	require.NoError(t, client.Call("Metadata.Get", &GetArgs{File: "main.py", Key: "owners"}, reply))
+	assert.JSONEq(t, `["alice","bob"]`, string(reply.Value))
+
+	err := client.Call("Metadata.Get", &GetArgs{File: "main.py", Key: "missing"}, reply)
+	require.Error(t, err)
+	assert.Equal(t, "No 'missing' metadata found for 'main.py'", err.Error())
+}
+
+func marshal(t *testing.T, v interface{}) string {
+	b, err := stdjson.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
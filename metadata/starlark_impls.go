@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 type StarlarkGlob struct {
@@ -17,3 +18,67 @@ func (s *StarlarkGlob) Type() string          { return "meta.glob" }
 func (s *StarlarkGlob) Freeze()               {}
 func (s *StarlarkGlob) Truth() starlark.Bool  { return starlark.True }
 func (s *StarlarkGlob) Hash() (uint32, error) { return 0, errors.New("not hashable") }
+
+// StarlarkMeta is the function returned by meta(). Calling it adds an entry for
+// its key to the METADATA file being parsed.
+type StarlarkMeta struct {
+	parser          *Parser
+	key             string
+	verticalMerge   starlark.Callable
+	horizontalMerge starlark.Callable
+	pos             syntax.Position
+}
+
+// Key returns the metadata key that this function sets
+func (m *StarlarkMeta) Key() string { return m.key }
+
+// VerticalMerge returns the function that merges values from METADATA files in
+// parent and child directories, or nil if there is none. The values that merge
+// functions are called with are frozen, so they have to return a new value
+// instead of changing one of them.
+func (m *StarlarkMeta) VerticalMerge() starlark.Callable { return m.verticalMerge }
+
+// HorizontalMerge returns the function that merges values from the same
+// METADATA file, or nil if there is none. Like with VerticalMerge, its values
+// are frozen.
+func (m *StarlarkMeta) HorizontalMerge() starlark.Callable { return m.horizontalMerge }
+
+// Position returns where meta() was called to define this function
+func (m *StarlarkMeta) Position() syntax.Position { return m.pos }
+
+// starlark.Value methods
+func (m *StarlarkMeta) String() string        { return fmt.Sprintf("meta.metadata(%s)", m.key) }
+func (m *StarlarkMeta) Type() string          { return "meta.metadata" }
+func (m *StarlarkMeta) Freeze()               {}
+func (m *StarlarkMeta) Truth() starlark.Bool  { return starlark.True }
+func (m *StarlarkMeta) Hash() (uint32, error) { return 0, errors.New("not hashable") }
+
+// starlark.HasAttrs methods, so that the merge functions can be called
+// directly, like owners.vertical_merge(upper, lower)
+func (m *StarlarkMeta) Attr(name string) (starlark.Value, error) {
+	var fn starlark.Callable
+	switch name {
+	case "key":
+		return starlark.String(m.key), nil
+	case "vertical_merge":
+		fn = m.verticalMerge
+	case "horizontal_merge":
+		fn = m.horizontalMerge
+	default:
+		return nil, nil
+	}
+	if fn == nil {
+		return starlark.None, nil
+	}
+	return fn, nil
+}
+
+func (m *StarlarkMeta) AttrNames() []string {
+	return []string{"horizontal_merge", "key", "vertical_merge"}
+}
+
+// starlark.Callable methods
+func (m *StarlarkMeta) Name() string { return "metadata" }
+func (m *StarlarkMeta) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return m.addEntry(thread, args, kwargs)
+}
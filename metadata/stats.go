@@ -0,0 +1,128 @@
+package metadata
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats collects measurements of how expensive building and querying a tree
+// is, for finding the METADATA files and merge functions that are slow. Pass
+// it to WithStats, and read it once the tree is done being used.
+type Stats struct {
+	mu sync.Mutex
+
+	// Repo-relative path of each METADATA file -> how long parsing it took,
+	// including executing the modules that it loads for the first time
+	ParseTimes map[string]time.Duration
+
+	// Path of each executed module, METADATA files included -> how long
+	// executing it took, including the modules that it loads for the first
+	// time
+	ModuleTimes map[string]time.Duration
+
+	// Merge functions, as "name (position)" -> the cost of calling them
+	MergeFunctions map[string]*MergeFunctionStats
+
+	// Modules loaded by other modules, and how many of them were already
+	// loaded
+	ModuleLoads     int
+	ModuleCacheHits int
+
+	// Lookups of merged values in the Cache given with WithCache, and how
+	// many of them found the value
+	ValueLookups   int
+	ValueCacheHits int
+
+	// Lookups of compiled modules in the directory given with WithCacheDir,
+	// and how many of them found the module
+	ProgramLookups   int
+	ProgramCacheHits int
+}
+
+// MergeFunctionStats is the cost of the calls to a merge function
+type MergeFunctionStats struct {
+	Calls    int
+	Steps    uint64
+	Duration time.Duration
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		ParseTimes:     make(map[string]time.Duration),
+		ModuleTimes:    make(map[string]time.Duration),
+		MergeFunctions: make(map[string]*MergeFunctionStats),
+	}
+}
+
+// The methods below do nothing on a nil Stats, so that callers don't have to
+// check whether stats are being collected
+
+func (s *Stats) addParse(file string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ParseTimes[file] = d
+}
+
+func (s *Stats) addModule(path string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ModuleTimes[path] = d
+}
+
+func (s *Stats) addLoad(cached bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ModuleLoads++
+	if cached {
+		s.ModuleCacheHits++
+	}
+}
+
+func (s *Stats) addMerge(function string, steps uint64, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.MergeFunctions[function]
+	if !ok {
+		m = &MergeFunctionStats{}
+		s.MergeFunctions[function] = m
+	}
+	m.Calls++
+	m.Steps += steps
+	m.Duration += d
+}
+
+func (s *Stats) addValueLookup(hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ValueLookups++
+	if hit {
+		s.ValueCacheHits++
+	}
+}
+
+func (s *Stats) addProgramLookup(hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ProgramLookups++
+	if hit {
+		s.ProgramCacheHits++
+	}
+}
@@ -0,0 +1,50 @@
+package metadata
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	files := map[string]string{
+		"owners.meta":  ownersMeta,
+		"METADATA":     "load(\"//owners.meta\", \"owners\")\nowners([\"alice\"])\nowners([\"bob\"])\n",
+		"one/METADATA": "load(\"//owners.meta\", \"owners\")\nowners([\"carol\"])\n",
+		"one/a.txt":    "a",
+	}
+
+	stats := NewStats()
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)), WithStats(stats), WithCache(NewMemoryCache()))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		value, err := tree.Get("one/a.txt", "owners")
+		require.NoError(t, err)
+		assert.Equal(t, `["carol", "alice", "bob"]`, value.String())
+	}
+
+	parsed := make([]string, 0)
+	for file := range stats.ParseTimes {
+		parsed = append(parsed, file)
+	}
+	sort.Strings(parsed)
+	assert.Equal(t, []string{"METADATA", "one/METADATA"}, parsed)
+	assert.Contains(t, stats.ModuleTimes, "owners.meta")
+
+	assert.Equal(t, 2, stats.ModuleLoads)
+	assert.Equal(t, 1, stats.ModuleCacheHits)
+	assert.Equal(t, 2, stats.ValueLookups)
+	assert.Equal(t, 1, stats.ValueCacheHits)
+
+	require.Len(t, stats.MergeFunctions, 2)
+	horizontal := stats.MergeFunctions["_owners_horizontal_merge_impl (owners.meta:2:1)"]
+	require.NotNil(t, horizontal)
+	assert.Equal(t, 1, horizontal.Calls)
+	assert.NotZero(t, horizontal.Steps)
+	vertical := stats.MergeFunctions["_owners_vertical_merge_impl (owners.meta:5:1)"]
+	require.NotNil(t, vertical)
+	assert.Equal(t, 1, vertical.Calls)
+	assert.NotZero(t, vertical.Steps)
+}
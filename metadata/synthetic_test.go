@@ -0,0 +1,154 @@
+package metadata
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticRepo describes a generated repo for benchmarks. The repo is a tree
+// of directories Depth levels deep, each with Fanout subdirectories and
+// FilesPerDir files.
+type syntheticRepo struct {
+	Depth       int
+	Fanout      int
+	FilesPerDir int
+
+	// Fraction of directories, other than the root, with a METADATA file
+	MetadataDensity float64
+	// Entries limited to a glob in each METADATA file
+	GlobsPerFile int
+	// .meta files, each defining a key. Every library after the first loads
+	// the one before it, and each METADATA file sets up to three keys.
+	Libraries int
+	// Fraction of METADATA files, other than the root's, that fail to parse
+	BrokenDensity float64
+
+	Seed int64
+}
+
+// Flags for sizing the repo of the benchmarks, like
+//
+//	go test -run ^$ -bench . ./metadata -synthetic.depth 5
+var syntheticFlags = syntheticRepo{}
+
+func init() {
+	flag.IntVar(&syntheticFlags.Depth, "synthetic.depth", 3, "Depth of the synthetic repo for benchmarks")
+	flag.IntVar(&syntheticFlags.Fanout, "synthetic.fanout", 6, "Subdirectories of each directory of the synthetic repo")
+	flag.IntVar(&syntheticFlags.FilesPerDir, "synthetic.files", 8, "Files in each directory of the synthetic repo")
+	flag.Float64Var(&syntheticFlags.MetadataDensity, "synthetic.density", 0.5, "Fraction of directories of the synthetic repo with a METADATA file")
+	flag.IntVar(&syntheticFlags.GlobsPerFile, "synthetic.globs", 2, "Glob entries in each METADATA file of the synthetic repo")
+	flag.IntVar(&syntheticFlags.Libraries, "synthetic.libraries", 4, ".meta files in the synthetic repo")
+	flag.Int64Var(&syntheticFlags.Seed, "synthetic.seed", 1, "Seed for generating the synthetic repo")
+}
+
+// Extensions of the generated files, which the globs match on
+var syntheticExtensions = []string{"go", "py", "md", "txt"}
+
+// generate returns the contents of every file in the repo, by repo-relative
+// path. The same description always generates the same repo.
+func (s syntheticRepo) generate() map[string]string {
+	r := rand.New(rand.NewSource(s.Seed))
+	files := make(map[string]string)
+
+	libraries := s.Libraries
+	if libraries < 1 {
+		libraries = 1
+	}
+	for i := 0; i < libraries; i++ {
+		var lib strings.Builder
+		if i > 0 {
+			fmt.Fprintf(&lib, "load(\"//meta/lib%d.meta\", _concat=\"concat\")\nconcat = _concat\n", i-1)
+		} else {
+			lib.WriteString("def concat(a, b):\n    return a + b\n")
+		}
+		fmt.Fprintf(&lib, `
+def _vertical_%[1]d(upper, lower):
+    merged = list(lower)
+    for value in upper:
+        if value not in merged:
+            merged.append(value)
+    return merged
+
+key%[1]d = meta(key="key%[1]d", horizontal_merge=concat, vertical_merge=_vertical_%[1]d)
+`, i)
+		files[fmt.Sprintf("meta/lib%d.meta", i)] = lib.String()
+	}
+
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		for i := 0; i < s.FilesPerDir; i++ {
+			ext := syntheticExtensions[i%len(syntheticExtensions)]
+			files[path.Join(dir, fmt.Sprintf("file%d.%s", i, ext))] = "contents\n"
+		}
+		if dir == "" || r.Float64() < s.MetadataDensity {
+			files[path.Join(dir, "METADATA")] = s.metadataFile(r, dir, libraries)
+		}
+		if depth == s.Depth {
+			return
+		}
+		for i := 0; i < s.Fanout; i++ {
+			walk(path.Join(dir, fmt.Sprintf("dir%d", i)), depth+1)
+		}
+	}
+	walk("", 0)
+	return files
+}
+
+func (s syntheticRepo) metadataFile(r *rand.Rand, dir string, libraries int) string {
+	var f strings.Builder
+	keys := r.Perm(libraries)
+	if len(keys) > 3 {
+		keys = keys[:3]
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&f, "load(\"//meta/lib%d.meta\", \"key%d\")\n", key, key)
+	}
+	name := strings.Replace(dir, "/", "-", -1)
+	if dir == "" {
+		name = "root"
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&f, "key%d([\"team-%s-%d\"])\n", key, name, key)
+	}
+	for i := 0; i < s.GlobsPerFile; i++ {
+		key := keys[i%len(keys)]
+		ext := syntheticExtensions[i%len(syntheticExtensions)]
+		fmt.Fprintf(&f, "key%d([\"%s-reviewers-%d\"], files=[glob(\"**/*.%s\")])\n", key, ext, i, ext)
+	}
+	if dir != "" && r.Float64() < s.BrokenDensity {
+		f.WriteString("key0(\n")
+	}
+	return f.String()
+}
+
+// write generates the repo into a temporary directory and returns its root
+func (s syntheticRepo) write(tb testing.TB) string {
+	root := tb.TempDir()
+	writeFiles(tb, root, s.generate())
+	return root
+}
+
+func TestSyntheticRepo(t *testing.T) {
+	s := syntheticRepo{Depth: 2, Fanout: 3, FilesPerDir: 4, MetadataDensity: 0.5, GlobsPerFile: 2, Libraries: 3, Seed: 1}
+	assert.Equal(t, s.generate(), s.generate())
+
+	root := s.write(t)
+	tree, err := NewEagerTree(root)
+	require.NoError(t, err)
+	// With three libraries, the root sets every key
+	assert.Equal(t, []string{"key0", "key1", "key2"}, tree.Keys())
+	value, err := tree.Get("dir0/dir1/file0.go", "key0")
+	require.NoError(t, err)
+	assert.Contains(t, value.String(), `"team-root-0", "go-reviewers-0"`)
+
+	s.BrokenDensity = 1
+	_, err = NewEagerTree(s.write(t), WithKeepGoing())
+	assert.IsType(t, ParseErrors{}, err)
+}
@@ -1,31 +1,110 @@
 package metadata
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"go.starlark.net/starlark"
 )
 
-func NewEagerTree(root, metadataFilename string) (*MetadataTree, error) {
-	r := Repo{
-		Root:             root,
-		MetadataFilename: metadataFilename,
-	}
+// Tree is a read-only view of the metadata defined in a repo. All paths are
+// relative to the root of the repo.
+type Tree interface {
+	// Get returns the value of a metadata key for a file, after merging the
+	// entries of every METADATA file above it
+	Get(filePath, key string) (starlark.Value, error)
+
+	// GetContext is Get, but stops merging once ctx is done
+	GetContext(ctx context.Context, filePath, key string) (starlark.Value, error)
+
+	// GetMany returns the merged values of several metadata keys for a file.
+	// If keys is nil, every key that applies to the file is returned. Keys
+	// without a value for the file are left out.
+	GetMany(filePath string, keys []string) (map[string]starlark.Value, error)
+
+	// GetManyContext is GetMany, but stops merging once ctx is done
+	GetManyContext(ctx context.Context, filePath string, keys []string) (map[string]starlark.Value, error)
+
+	// GetInto decodes the merged value of a metadata key for a file into the
+	// Go value pointed to by target. See Decode.
+	GetInto(filePath, key string, target interface{}) error
+
+	// GetIntoContext is GetInto, but stops merging once ctx is done
+	GetIntoContext(ctx context.Context, filePath, key string, target interface{}) error
+
+	// GetClosest returns the value of a metadata key from the METADATA file
+	// closest to the file, without any merging
+	GetClosest(filePath, key string) (starlark.Value, error)
+
+	// Explain returns how the merged value of a metadata key for a file was
+	// built up from the METADATA files above it
+	Explain(filePath, key string) (*Explanation, error)
+
+	// ExplainContext is Explain, but stops merging once ctx is done
+	ExplainContext(ctx context.Context, filePath, key string) (*Explanation, error)
+
+	// Entries returns the entries defined by the METADATA file in a directory.
+	// The root of the repo is "".
+	Entries(dirPath string) []Entry
+
+	// Keys returns every metadata key used in the tree, sorted
+	Keys() []string
+
+	// Walk calls fn for every directory with a METADATA file, parents before
+	// children and siblings in lexical order. If fn returns filepath.SkipDir,
+	// the directory's children are skipped.
+	Walk(fn WalkFunc) error
+}
+
+// WalkFunc is called by Tree.Walk for each directory that has a METADATA file
+type WalkFunc func(dirPath string, entries []Entry) error
+
+var _ Tree = (*MetadataTree)(nil)
+
+// NewEagerTree parses every METADATA file under root and builds a tree out of
+// them
+func NewEagerTree(root string, opts ...Option) (*MetadataTree, error) {
+	return NewEagerTreeContext(context.Background(), root, opts...)
+}
 
-	files, err := r.MetadataFiles()
+// NewEagerTreeContext is NewEagerTree, but stops walking the repo and parsing
+// once ctx is done
+func NewEagerTreeContext(ctx context.Context, root string, opts ...Option) (*MetadataTree, error) {
+	o, err := loadOptions(root, opts)
 	if err != nil {
 		return nil, err
 	}
+	r := newRepo(root, o)
 
-	parser := NewParser(&r)
-	parsed, err := parser.ParseAll(files)
+	files, err := r.MetadataFilesContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewMetadataTree(parsed), nil
+	parser := newParser(r, o)
+	tree, err := buildTree(ctx, parser, files)
+	if tree != nil {
+		tree.cache = o.cache
+		tree.stats = o.stats
+	}
+	return tree, err
+}
+
+// buildTree parses files into a tree. With WithKeepGoing, the tree is built
+// even if some files fail, and returned along with their ParseErrors.
+func buildTree(ctx context.Context, parser *Parser, files []MetadataFile) (*MetadataTree, error) {
+	parsed, err := parser.ParseAllContext(ctx, files)
+	errs, partial := err.(ParseErrors)
+	if err != nil && !partial {
+		return nil, err
+	}
+
+	tree := NewMetadataTree(parsed)
+	tree.taint(errs)
+	return tree, err
 }
 
 // MetadataTree is a tree matching the structure of the filesystem in a repo,
@@ -35,6 +114,15 @@ type MetadataTree struct {
 	subTrees map[string]*MetadataTree
 	entries  []Entry
 	entryMap map[string][]Entry
+
+	// the METADATA file in this folder, if there is one
+	file *MetadataFile
+	// the error from parsing the METADATA file in this folder, if it failed
+	broken *ParseError
+
+	// only set on the root of the tree
+	cache Cache
+	stats *Stats
 }
 
 type NoMetadataFoundError struct {
@@ -49,31 +137,93 @@ func (e NoMetadataFoundError) Error() string {
 // GetMergedValue - get the value of a particular metadata type for a file
 // merge the values with any upper values
 func (m *MetadataTree) GetMergedValue(filePath string, metadataKey string) (starlark.Value, error) {
-	metStack := m.getMetadataStack(filePath, metadataKey)
-	if len(metStack) == 0 {
+	return m.GetMergedValueContext(context.Background(), filePath, metadataKey)
+}
+
+// GetMergedValueContext is GetMergedValue, but stops merging once ctx is done
+func (m *MetadataTree) GetMergedValueContext(ctx context.Context, filePath string, metadataKey string) (starlark.Value, error) {
+	values, err := m.GetManyContext(ctx, filePath, []string{metadataKey})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := values[metadataKey]
+	if !ok {
 		return nil, NoMetadataFoundError{filePath, metadataKey}
 	}
-	// TODO: Implement a metadata type store that can hold these functions
-	vertMergeFunc := metStack[0].mergeVertically
+	return value, nil
+}
 
-	valueStack, err := m.getValueStack(filePath, metadataKey)
+// GetMany gets the merged values of several metadata keys for a file, walking
+// down the tree only once. If keys is nil, every key that applies to the file
+// is returned. Keys without a value for the file are left out of the result.
+// The returned values are frozen.
+func (m *MetadataTree) GetMany(filePath string, keys []string) (map[string]starlark.Value, error) {
+	return m.GetManyContext(context.Background(), filePath, keys)
+}
+
+// GetManyContext is GetMany, but stops merging values once ctx is done
+func (m *MetadataTree) GetManyContext(ctx context.Context, filePath string, keys []string) (map[string]starlark.Value, error) {
+	// A cached value may have been merged before the METADATA file above it
+	// broke, so tainted files are checked first
+	if err := m.checkTainted(filePath); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]starlark.Value)
+	missingKeys := keys
+	if m.cache != nil && keys != nil {
+		missingKeys = make([]string, 0, len(keys))
+		for _, key := range keys {
+			value, ok := m.cache.Get(filePath, key)
+			m.stats.addValueLookup(ok)
+			if ok {
+				values[key] = value
+			} else {
+				missingKeys = append(missingKeys, key)
+			}
+		}
+		if len(missingKeys) == 0 {
+			return values, nil
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot get metadata for '%s': %w", filePath, err)
+	}
+	stacks, err := m.getValueStacks(ctx, filePath, missingKeys)
 	if err != nil {
 		return nil, err
-	} else if len(valueStack) == 0 {
-		return nil, NoMetadataFoundError{filePath, metadataKey}
 	}
 
-	return mergeVerticalStack(valueStack, vertMergeFunc)
+	for key, stack := range stacks {
+		value, err := mergeVerticalStack(ctx, stack.values, stack.files, stack.mergeVertically)
+		if err != nil {
+			return nil, err
+		}
+
+		// Merged values may be the same values that are in the tree, or in the
+		// cache, so callers must not be able to change them
+		value.Freeze()
+		if m.cache != nil {
+			m.cache.Put(filePath, key, value)
+		}
+		values[key] = value
+	}
+	return values, nil
 }
 
-func mergeVerticalStack(stack []starlark.Value, mergeFunc VerticalMergeFunc) (starlark.Value, error) {
+// mergeVerticalStack merges the values of a key from the top of the tree down,
+// given the METADATA file that each value came from
+func mergeVerticalStack(ctx context.Context, stack []starlark.Value, files []string, mergeFunc VerticalMergeFunc) (starlark.Value, error) {
 	lowerValue := stack[len(stack)-1]
 	for i := len(stack) - 2; i >= 0; i-- {
 		upperValue := stack[i]
 
 		var err error
-		lowerValue, err = mergeFunc(upperValue, lowerValue)
+		lowerValue, err = mergeFunc(ctx, upperValue, lowerValue)
 		if err != nil {
+			// The lower value is everything below this level merged together
+			setMergeFiles(err, files[i:i+1], files[i+1:])
 			return nil, err
 		}
 	}
@@ -81,6 +231,9 @@ func mergeVerticalStack(stack []starlark.Value, mergeFunc VerticalMergeFunc) (st
 }
 
 func (m *MetadataTree) GetClosestValue(filePath string, metadataKey string) (starlark.Value, error) {
+	if err := m.checkTainted(filePath); err != nil {
+		return nil, err
+	}
 	stack := m.getMetadataStack(filePath, metadataKey)
 	if len(stack) == 0 {
 		return nil, NoMetadataFoundError{filePath, metadataKey}
@@ -89,6 +242,111 @@ func (m *MetadataTree) GetClosestValue(filePath string, metadataKey string) (sta
 
 }
 
+// Get is the same as GetMergedValue
+func (m *MetadataTree) Get(filePath, key string) (starlark.Value, error) {
+	return m.GetMergedValue(filePath, key)
+}
+
+// GetContext is the same as GetMergedValueContext
+func (m *MetadataTree) GetContext(ctx context.Context, filePath, key string) (starlark.Value, error) {
+	return m.GetMergedValueContext(ctx, filePath, key)
+}
+
+func (m *MetadataTree) GetInto(filePath, key string, target interface{}) error {
+	return m.GetIntoContext(context.Background(), filePath, key, target)
+}
+
+func (m *MetadataTree) GetIntoContext(ctx context.Context, filePath, key string, target interface{}) error {
+	value, err := m.GetMergedValueContext(ctx, filePath, key)
+	if err != nil {
+		return err
+	}
+	if err := Decode(value, target); err != nil {
+		return fmt.Errorf("Cannot decode '%s' metadata for '%s': %w", key, filePath, err)
+	}
+	return nil
+}
+
+// GetClosest is the same as GetClosestValue
+func (m *MetadataTree) GetClosest(filePath, key string) (starlark.Value, error) {
+	return m.GetClosestValue(filePath, key)
+}
+
+func (m *MetadataTree) Entries(dirPath string) []Entry {
+	tree := m.find(dirPath)
+	if tree == nil {
+		return nil
+	}
+	entries := make([]Entry, len(tree.entries))
+	copy(entries, tree.entries)
+	return entries
+}
+
+func (m *MetadataTree) Keys() []string {
+	keys := make(StringSet)
+	m.walk("", func(_ string, tree *MetadataTree) error {
+		for key := range tree.entryMap {
+			keys.Add(key)
+		}
+		return nil
+	})
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (m *MetadataTree) Walk(fn WalkFunc) error {
+	return m.walk("", func(dirPath string, tree *MetadataTree) error {
+		if tree.file == nil {
+			return nil
+		}
+		return fn(dirPath, tree.Entries(""))
+	})
+}
+
+func (m *MetadataTree) walk(dirPath string, fn func(string, *MetadataTree) error) error {
+	if err := fn(dirPath, m); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	names := make([]string, 0, len(m.subTrees))
+	for name := range m.subTrees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := m.subTrees[name].walk(filepath.Join(dirPath, name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the subtree for a directory, or nil if there is no METADATA
+// file in or below it
+func (m *MetadataTree) find(dirPath string) *MetadataTree {
+	currentTree := m
+	if dirPath == "" || dirPath == "." {
+		return currentTree
+	}
+	for _, dirPart := range strings.Split(filepath.Clean(dirPath), string(filepath.Separator)) {
+		var ok bool
+		currentTree, ok = currentTree.subTrees[dirPart]
+		if !ok {
+			return nil
+		}
+	}
+	return currentTree
+}
+
 func (m *MetadataTree) getMetadataStack(filePath string, metadataKey string) []Entry {
 	stack := make([]Entry, 0)
 
@@ -111,18 +369,53 @@ func (m *MetadataTree) getMetadataStack(filePath string, metadataKey string) []E
 	return stack
 }
 
-func (m *MetadataTree) getValueStack(filePath string, metadataKey string) ([]starlark.Value, error) {
-	stack := make([]starlark.Value, 0)
+type valueStack struct {
+	values []starlark.Value
+	// the METADATA file of each value
+	files []string
+
+	// TODO: Implement a metadata type store that can hold these functions
+	mergeVertically VerticalMergeFunc
+}
+
+// getValueStacks walks down the tree to a file, and for each key, collects the
+// horizontally merged value of each METADATA file that applies to the file. If
+// keys is nil, every key is collected.
+func (m *MetadataTree) getValueStacks(ctx context.Context, filePath string, keys []string) (map[string]*valueStack, error) {
+	stacks := make(map[string]*valueStack)
 
 	currentTree := m
 	for _, dirPart := range strings.Split(filePath, string(filepath.Separator)) {
-		if entries, ok := currentTree.entryMap[metadataKey]; ok {
-			val, err := m.resolveSiblingEntries(entries, filePath, metadataKey)
+		levelKeys := keys
+		if levelKeys == nil {
+			levelKeys = make([]string, 0, len(currentTree.entryMap))
+			for key := range currentTree.entryMap {
+				levelKeys = append(levelKeys, key)
+			}
+		}
+
+		for _, key := range levelKeys {
+			entries, ok := currentTree.entryMap[key]
+			if !ok {
+				continue
+			}
+			val, first, err := m.resolveSiblingEntries(ctx, entries, filePath)
 			if err != nil {
 				return nil, err
 			}
-			stack = append(stack, val)
+			if first == nil {
+				continue
+			}
+
+			stack, ok := stacks[key]
+			if !ok {
+				stack = &valueStack{mergeVertically: first.mergeVertically}
+				stacks[key] = stack
+			}
+			stack.values = append(stack.values, val)
+			stack.files = append(stack.files, first.file)
 		}
+
 		var nextSubtreeExists bool
 		currentTree, nextSubtreeExists = currentTree.subTrees[dirPart]
 		if !nextSubtreeExists {
@@ -130,10 +423,13 @@ func (m *MetadataTree) getValueStack(filePath string, metadataKey string) ([]sta
 		}
 	}
 
-	return stack, nil
+	return stacks, nil
 }
 
-func (m MetadataTree) resolveSiblingEntries(entries []Entry, filePath string, metadataKey string) (starlark.Value, error) {
+// resolveSiblingEntries horizontally merges the entries that apply to a file,
+// returning the merged value and the first entry that applied. If no entries
+// apply, the returned entry is nil.
+func (m MetadataTree) resolveSiblingEntries(ctx context.Context, entries []Entry, filePath string) (starlark.Value, *Entry, error) {
 	// Find all entries that match the given file
 	matchingEntries := make([]Entry, 0)
 	for _, entry := range entries {
@@ -143,7 +439,7 @@ func (m MetadataTree) resolveSiblingEntries(entries []Entry, filePath string, me
 	}
 
 	if len(matchingEntries) == 0 {
-		return nil, NoMetadataFoundError{filePath, metadataKey}
+		return nil, nil, nil
 	}
 
 	// Merge the siblings
@@ -153,13 +449,14 @@ func (m MetadataTree) resolveSiblingEntries(entries []Entry, filePath string, me
 		rightValue := right.value
 
 		var err error
-		leftValue, err = right.mergeHorizontally(leftValue, rightValue)
+		leftValue, err = right.mergeHorizontally(ctx, leftValue, rightValue)
 		if err != nil {
-			return nil, err
+			setMergeFiles(err, []string{right.file}, []string{right.file})
+			return nil, nil, err
 		}
 	}
 
-	return leftValue, nil
+	return leftValue, &matchingEntries[0], nil
 }
 
 func (m *MetadataTree) get(dirName string) *MetadataTree {
@@ -192,16 +489,84 @@ func NewMetadataTree(results []ParseResult) *MetadataTree {
 	rootTree := newTree()
 	for _, result := range results {
 		tree := getTree(rootTree, result)
-		tree.entries = result.entries
-		for _, entry := range tree.entries {
-			//TODO: This overwrites any duplicated metadata entry key. Implement horizontal flattening.
-			if prev, seen_key := tree.entryMap[entry.key]; seen_key {
-				tree.entryMap[entry.key] = append(prev, entry)
-			} else {
-				tree.entryMap[entry.key] = []Entry{entry}
+		tree.setResult(result)
+	}
+
+	return rootTree
+}
+
+func (m *MetadataTree) setResult(result ParseResult) {
+	file := result.file
+	m.file = &file
+	m.broken = nil
+	m.entries = result.entries
+	m.entryMap = make(map[string][]Entry)
+	for _, entry := range m.entries {
+		//TODO: This overwrites any duplicated metadata entry key. Implement horizontal flattening.
+		if prev, seen_key := m.entryMap[entry.key]; seen_key {
+			m.entryMap[entry.key] = append(prev, entry)
+		} else {
+			m.entryMap[entry.key] = []Entry{entry}
+		}
+	}
+}
+
+// replace returns a copy of the tree with the METADATA files of some
+// directories replaced. A nil result removes the directory's METADATA file, and
+// the directories of METADATA files that failed to parse are tainted. Only the
+// nodes on the path to a replaced directory are copied, the rest are shared
+// with the original tree, which is left unchanged.
+func (m *MetadataTree) replace(results map[string]*ParseResult, errs ParseErrors) *MetadataTree {
+	root := m.shallowCopy()
+	copied := map[*MetadataTree]bool{root: true}
+
+	copyPath := func(dir string) *MetadataTree {
+		tree := root
+		if dir != "" {
+			for _, dirPart := range strings.Split(dir, string(filepath.Separator)) {
+				sub, ok := tree.subTrees[dirPart]
+				if !ok {
+					sub = newTree()
+				} else if !copied[sub] {
+					sub = sub.shallowCopy()
+				}
+				copied[sub] = true
+				tree.subTrees[dirPart] = sub
+				tree = sub
 			}
 		}
+		return tree
 	}
 
-	return rootTree
+	for dir, result := range results {
+		tree := copyPath(dir)
+		if result != nil {
+			tree.setResult(*result)
+		} else {
+			tree.clear()
+		}
+	}
+	for _, err := range errs {
+		tree := copyPath(dirOfRelativePath(err.File))
+		tree.clear()
+		tree.broken = err
+	}
+	return root
+}
+
+// clear removes the METADATA file of the tree's directory
+func (m *MetadataTree) clear() {
+	m.file = nil
+	m.broken = nil
+	m.entries = make([]Entry, 0)
+	m.entryMap = make(map[string][]Entry)
+}
+
+func (m *MetadataTree) shallowCopy() *MetadataTree {
+	c := *m
+	c.subTrees = make(map[string]*MetadataTree, len(m.subTrees))
+	for name, sub := range m.subTrees {
+		c.subTrees[name] = sub
+	}
+	return &c
 }
@@ -1,6 +1,7 @@
 package metadata
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,7 +11,7 @@ import (
 
 func TestSimpleMetadataTree(t *testing.T) {
 	fullPath := "../test_data/simple_test_case"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -42,7 +43,7 @@ func TestSimpleMetadataTree(t *testing.T) {
 
 func TestImportMetadataTree(t *testing.T) {
 	fullPath := "../test_data/import_file"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -67,7 +68,7 @@ func TestImportMetadataTree(t *testing.T) {
 
 func TestFileListMetadataTree(t *testing.T) {
 	fullPath := "../test_data/limit_with_file_list"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -83,7 +84,7 @@ func TestFileListMetadataTree(t *testing.T) {
 
 func TestGlobMetadataTree(t *testing.T) {
 	fullPath := "../test_data/limit_with_globs"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -104,7 +105,7 @@ func TestGlobMetadataTree(t *testing.T) {
 
 func TestVerticalMergeMetadataTree(t *testing.T) {
 	fullPath := "../test_data/vertical_merge"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -128,7 +129,7 @@ func TestVerticalMergeMetadataTree(t *testing.T) {
 
 func TestHorizontalMergeMetadataTree(t *testing.T) {
 	fullPath := "../test_data/horizontal_merge"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -136,7 +137,7 @@ func TestHorizontalMergeMetadataTree(t *testing.T) {
 	value, err := tree.GetMergedValue("main.cc", "owners")
 	require.NoError(t, err)
 	assert.Equal(t,
-		starlark.NewList([]starlark.Value{
+		frozenList([]starlark.Value{
 			starlark.String("alice"),
 			starlark.String("bob"),
 		}),
@@ -146,7 +147,7 @@ func TestHorizontalMergeMetadataTree(t *testing.T) {
 	value, err = tree.GetMergedValue("main.py", "owners")
 	require.NoError(t, err)
 	assert.Equal(t,
-		starlark.NewList([]starlark.Value{
+		frozenList([]starlark.Value{
 			starlark.String("alice"),
 			starlark.String("bob"),
 			starlark.String("carol"),
@@ -158,7 +159,7 @@ func TestHorizontalMergeMetadataTree(t *testing.T) {
 
 func TestHorizontalAndVerticalMergeMetadataTree(t *testing.T) {
 	fullPath := "../test_data/horizontal_and_vertical_merge"
-	tree, err := NewEagerTree(fullPath, "METADATA")
+	tree, err := NewEagerTree(fullPath)
 	if err != nil {
 		require.NoError(t, err, "Unexpected error")
 	}
@@ -166,7 +167,7 @@ func TestHorizontalAndVerticalMergeMetadataTree(t *testing.T) {
 	value, err := tree.GetMergedValue("main.cc", "owners")
 	require.NoError(t, err)
 	assert.Equal(t,
-		starlark.NewList([]starlark.Value{
+		frozenList([]starlark.Value{
 			starlark.String("alice"),
 		}),
 		value,
@@ -175,7 +176,7 @@ func TestHorizontalAndVerticalMergeMetadataTree(t *testing.T) {
 	value, err = tree.GetMergedValue("main.py", "owners")
 	require.NoError(t, err)
 	assert.Equal(t,
-		starlark.NewList([]starlark.Value{
+		frozenList([]starlark.Value{
 			starlark.String("alice"),
 			starlark.String("bob"),
 		}),
@@ -185,7 +186,7 @@ func TestHorizontalAndVerticalMergeMetadataTree(t *testing.T) {
 	value, err = tree.GetMergedValue("one/main.py", "owners")
 	require.NoError(t, err)
 	assert.Equal(t,
-		starlark.NewList([]starlark.Value{
+		frozenList([]starlark.Value{
 			starlark.String("carol"),
 			starlark.String("alice"),
 			starlark.String("bob"),
@@ -194,14 +195,182 @@ func TestHorizontalAndVerticalMergeMetadataTree(t *testing.T) {
 	)
 }
 
-// func TestJsonExport(t *testing.T) {
-// 	fullPath := "../test_data/json_export"
-// 	tree, err := NewEagerTree(fullPath, "METADATA")
-// 	if err != nil {
-// 		require.NoError(t, err, "Unexpected error")
-// 	}
-
-// 	value, err := tree.GetMergedValue("one.txt", "key")
-// 	require.NoError(t, err)
-// 	assert.Equal(t, "[1,2,3]", ValueToJson(value))
-// }
+func TestJsonExport(t *testing.T) {
+	fullPath := "../test_data/json_export"
+	tree, err := NewEagerTree(fullPath)
+	if err != nil {
+		require.NoError(t, err, "Unexpected error")
+	}
+
+	value, err := tree.GetMergedValue("one.txt", "key")
+	require.NoError(t, err)
+	j, err := ValueToJson(value)
+	require.NoError(t, err)
+	assert.Equal(t, "[1,2,3]", j)
+}
+
+// frozenList makes a list that compares equal to the frozen values returned by
+// the tree
+func frozenList(elems []starlark.Value) *starlark.List {
+	l := starlark.NewList(elems)
+	l.Freeze()
+	return l
+}
+
+func TestTreeAccessors(t *testing.T) {
+	fullPath := "../test_data/horizontal_and_vertical_merge"
+	tree, err := NewEagerTree(fullPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"owners"}, tree.Keys())
+
+	entries := tree.Entries("")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "owners", entries[0].Key())
+	assert.Equal(t, "METADATA", entries[0].File())
+	assert.True(t, entries[0].FileMatchSet().IsEmpty())
+	assert.True(t, entries[0].AppliesTo("anything.txt"))
+
+	globs := entries[1].FileMatchSet().Globs()
+	require.Len(t, globs, 2)
+	assert.Equal(t, "**/*.py", globs[0].Pattern())
+	assert.False(t, entries[1].AppliesTo("main.cc"))
+
+	entries = tree.Entries("one")
+	require.Len(t, entries, 1)
+	assert.Equal(t, "one/METADATA", entries[0].File())
+
+	assert.Nil(t, tree.Entries("does/not/exist"))
+
+	visited := make([]string, 0)
+	err = tree.Walk(func(dirPath string, entries []Entry) error {
+		visited = append(visited, dirPath)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "one"}, visited)
+
+	visited = make([]string, 0)
+	err = tree.Walk(func(dirPath string, entries []Entry) error {
+		visited = append(visited, dirPath)
+		return filepath.SkipDir
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{""}, visited)
+}
+
+func TestTreeOptions(t *testing.T) {
+	fullPath := "../test_data/horizontal_and_vertical_merge"
+	cache := NewMemoryCache()
+	tree, err := NewEagerTree(fullPath, WithConcurrency(4), WithCache(cache))
+	require.NoError(t, err)
+
+	value, err := tree.Get("one/main.py", "owners")
+	require.NoError(t, err)
+	cached, ok := cache.Get("one/main.py", "owners")
+	require.True(t, ok)
+	assert.Equal(t, value, cached)
+
+	// Cached values are frozen so that callers can't modify them
+	assert.Error(t, value.(*starlark.List).Append(starlark.String("mallory")))
+
+	tree, err = NewEagerTree("../test_data/predeclared", WithPredeclared(starlark.StringDict{
+		"default_team": starlark.String("infra"),
+	}))
+	require.NoError(t, err)
+	value, err = tree.GetClosest("main.go", "team")
+	require.NoError(t, err)
+	assert.Equal(t, starlark.String("infra"), value)
+
+	tree, err = NewEagerTree("../test_data/vertical_merge", WithMetadataFilename("OWNERS"))
+	require.NoError(t, err)
+	assert.Empty(t, tree.Keys())
+}
+
+func TestLoadCycle(t *testing.T) {
+	expected := "Cycle detected in load graph: a.meta -> b.meta -> a.meta\n" +
+		"    a.meta:1:1: loads b.meta\n" +
+		"    b.meta:1:1: loads a.meta"
+
+	_, err := NewEagerTree("../test_data/load_cycle")
+	assert.EqualError(t, err, expected)
+
+	_, err = NewEagerTree("../test_data/load_cycle", WithConcurrency(4))
+	assert.EqualError(t, err, expected)
+
+	// Two parses can each be loading one of the modules in the cycle
+	files := map[string]string{
+		"a.meta":       "x = 1\nload(\"//b.meta\", \"b\")\na = 1\n",
+		"b.meta":       "load(\"//a.meta\", \"a\")\nb = 2\n",
+		"one/METADATA": "load(\"//a.meta\", \"a\")\n",
+		"two/METADATA": "load(\"//b.meta\", \"b\")\n",
+	}
+	for i := 0; i < 20; i++ {
+		_, err = NewEagerTree("", WithFS(NewMapFS(files)), WithConcurrency(2))
+		require.IsType(t, &LoadCycleError{}, err)
+		cycle := err.(*LoadCycleError)
+		if cycle.Modules[0] == "a.meta" {
+			assert.Equal(t, []string{"a.meta", "b.meta", "a.meta"}, cycle.Modules)
+			assert.Equal(t, []string{"a.meta:2:1", "b.meta:1:1"}, []string{cycle.Loads[0].String(), cycle.Loads[1].String()})
+		} else {
+			assert.Equal(t, []string{"b.meta", "a.meta", "b.meta"}, cycle.Modules)
+			assert.Equal(t, []string{"b.meta:1:1", "a.meta:2:1"}, []string{cycle.Loads[0].String(), cycle.Loads[1].String()})
+		}
+	}
+}
+
+func TestUnmatchedEntriesFallThrough(t *testing.T) {
+	tree, err := NewEagerTree("../test_data/multi_key")
+	require.NoError(t, err)
+
+	// one/METADATA has owners entries, but none of them apply to .cc files, so
+	// the value comes from the METADATA files above it
+	value, err := tree.GetMergedValue("one/main.cc", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["alice"]`, value.String())
+
+	value, err = tree.GetMergedValue("one/main.py", "owners")
+	require.NoError(t, err)
+	assert.Equal(t, `["bob", "alice"]`, value.String())
+}
+
+func TestGetMany(t *testing.T) {
+	fullPath := "../test_data/multi_key"
+	for _, cache := range []Cache{nil, NewMemoryCache()} {
+		tree, err := NewEagerTree(fullPath, WithCache(cache))
+		require.NoError(t, err)
+
+		values, err := tree.GetMany("one/main.py", []string{"owners", "tier", "missing"})
+		require.NoError(t, err)
+		require.Len(t, values, 2)
+		assert.Equal(t, `["bob", "alice"]`, values["owners"].String())
+		assert.Equal(t, starlark.MakeInt(1), values["tier"])
+
+		// one/METADATA has owners entries, but none of them apply to .cc files
+		values, err = tree.GetMany("one/main.cc", nil)
+		require.NoError(t, err)
+		require.Len(t, values, 2)
+		assert.Equal(t, `["alice"]`, values["owners"].String())
+		assert.Equal(t, starlark.MakeInt(1), values["tier"])
+
+		_, err = tree.GetMergedValue("one/main.cc", "missing")
+		assert.IsType(t, NoMetadataFoundError{}, err)
+	}
+}
+
+func TestVerticalMergeErrorFiles(t *testing.T) {
+	files := map[string]string{
+		"picky.meta":       "def _merge(upper, lower):\n    if upper == [\"a\"]:\n        fail(\"no\")\n    return lower + upper\n\npicky = meta(key=\"picky\", vertical_merge=_merge)\n",
+		"METADATA":         "load(\"//picky.meta\", \"picky\")\npicky([\"a\"])\n",
+		"one/METADATA":     "load(\"//picky.meta\", \"picky\")\npicky([\"b\"])\n",
+		"one/two/METADATA": "load(\"//picky.meta\", \"picky\")\npicky([\"c\"])\n",
+		"one/two/a.txt":    "a",
+	}
+	tree, err := NewEagerTree("", WithFS(NewMapFS(files)))
+	require.NoError(t, err)
+
+	// The lower value was merged from both METADATA files below the root
+	_, err = tree.Get("one/two/a.txt", "picky")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `Could not vertically merge 'picky' upper(["a"]) from METADATA and lower(["c", "b"]) merged from one/METADATA, one/two/METADATA with _merge`)
+}
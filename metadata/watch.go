@@ -0,0 +1,178 @@
+package metadata
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long to wait for more changes before reloading, so that a burst of
+// changes (like a git checkout) only causes one reload
+const watchDebounce = 100 * time.Millisecond
+
+// Watcher reloads a LiveTree whenever a METADATA or .meta file in its repo is
+// created, changed or removed
+type Watcher struct {
+	tree    *LiveTree
+	watcher *fsnotify.Watcher
+	errors  chan error
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Watch starts watching every directory in the repo of a LiveTree until the
+// returned Watcher is closed. Directories that walking the repo skips, because
+// they are ignored or behind a symlink that isn't followed, aren't watched.
+func Watch(tree *LiveTree) (*Watcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		tree:    tree,
+		watcher: fsWatcher,
+		errors:  make(chan error, 16),
+		done:    make(chan struct{}),
+	}
+	if _, err := w.addDir(tree.repo.Root); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Errors returns the errors from watching the repo and from reloading the tree.
+// Errors are dropped if they are not received. The channel is closed when the
+// Watcher is closed.
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stops watching the repo. The tree keeps the state of the last reload.
+func (w *Watcher) Close() error {
+	close(w.done)
+	err := w.watcher.Close()
+	w.wg.Wait()
+	return err
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+	defer close(w.errors)
+
+	changed := make(StringSet)
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			for _, path := range w.changedPaths(event) {
+				changed.Add(path)
+			}
+			if len(changed) > 0 {
+				timer.Reset(watchDebounce)
+			}
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.sendError(err)
+
+		case <-timer.C:
+			paths := make([]string, 0, len(changed))
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			changed = make(StringSet)
+
+			if err := w.tree.Reload(paths); err != nil {
+				w.sendError(err)
+			}
+		}
+	}
+}
+
+// changedPaths returns the repo-relative paths of the files that an event could
+// have changed the tree through
+func (w *Watcher) changedPaths(event fsnotify.Event) []string {
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// A new directory may already have files in it by the time
+			// that it is watched
+			paths, err := w.addDir(event.Name)
+			if err != nil {
+				w.sendError(err)
+			}
+			return paths
+		}
+	}
+
+	if event.Op == fsnotify.Chmod {
+		return nil
+	}
+
+	path, err := filepath.Rel(w.tree.repo.Root, event.Name)
+	if err != nil {
+		w.sendError(err)
+		return nil
+	}
+	if !w.tree.IsRelevant(path) {
+		return nil
+	}
+	return []string{path}
+}
+
+// addDir watches a directory and every directory below it, and returns the
+// repo-relative paths of the relevant files in them. Directories that walking
+// the repo skips, like ignored ones, aren't watched.
+func (w *Watcher) addDir(dirPath string) ([]string, error) {
+	repo := w.tree.repo
+	dir, err := filepath.Rel(repo.Root, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "." {
+		dir = ""
+	}
+
+	paths := make([]string, 0)
+	err = repo.walkUnder(context.Background(), filepath.ToSlash(dir), func(p string) error {
+		return w.watcher.Add(filepath.Join(repo.Root, filepath.FromSlash(p)))
+	}, func(p string) error {
+		relativePath := filepath.FromSlash(p)
+		if w.tree.IsRelevant(relativePath) {
+			paths = append(paths, relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}